@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/application-research/delta-dm/core"
+	db "github.com/application-research/delta-dm/db"
+	"github.com/labstack/echo/v4"
+)
+
+// CAR file download routes, only available when DDM's built-in CAR server is enabled
+func ConfigureCarRouter(e *echo.Group, dldm *core.DeltaDM) {
+	if dldm.CarServer == nil {
+		return
+	}
+
+	car := e.Group("/car")
+
+	// Any provider with a deal for the content may download it, regardless of whether it can self-serve
+	car.Use(providerTokenMiddleware(dldm, false))
+
+	car.GET("/:piece", func(c echo.Context) error {
+		return handleGetCar(c, dldm)
+	})
+
+	car.HEAD("/:piece", func(c echo.Context) error {
+		return handleGetCar(c, dldm)
+	})
+}
+
+// GET /api/v1/car/:piece
+// @param :piece Piece CID of the content to download
+// @returns the CAR file. Supports range requests
+func handleGetCar(c echo.Context, dldm *core.DeltaDM) error {
+	piece := c.Param("piece")
+	p := c.Get(PROVIDER).(db.Provider)
+
+	if dldm.Signer != nil {
+		if err := verifyCarUrl(c, dldm, p.ActorID); err != nil {
+			return &HttpError{
+				Code:    http.StatusForbidden,
+				Reason:  "invalid signed url",
+				Details: err.Error(),
+			}
+		}
+	}
+
+	repl, err := core.FindTransferReplication(dldm.DB, p.ActorID, piece)
+	if err != nil {
+		return &HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  "provider may not download this piece",
+			Details: err.Error(),
+		}
+	}
+
+	f, err := dldm.CarServer.Store.Open(piece)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &HttpError{
+				Code:   http.StatusNotFound,
+				Reason: "car file not found for piece " + piece,
+			}
+		}
+		return err
+	}
+	defer f.Close()
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/vnd.ipld.car")
+
+	tw := dldm.CarServer.NewTransferWriter(c.Request().Context(), c.Response(), p.ActorID)
+	defer tw.Close()
+	http.ServeContent(tw, c.Request(), f.Name(), f.ModTime(), f)
+
+	if err := core.RecordTransfer(dldm.DB, repl.ID, tw.Written); err != nil {
+		log.Errorf("could not record transfer of %d bytes for replication %d: %s", tw.Written, repl.ID, err)
+	}
+
+	return nil
+}
+
+// With URL signing enabled, the CAR server's locations are handed out signed, so downloads must present a valid, unexpired signature issued to the provider
+func verifyCarUrl(c echo.Context, dldm *core.DeltaDM, providerActorID string) error {
+	signedUrl := dldm.CarServer.LocationFor(c.Param("piece"))
+	if dldm.CarServer.PublicUrl == "" {
+		signedUrl = c.Scheme() + "://" + c.Request().Host + c.Request().URL.Path
+	}
+	if c.Request().URL.RawQuery != "" {
+		signedUrl += "?" + c.Request().URL.RawQuery
+	}
+
+	claims, err := dldm.Signer.Verify(signedUrl)
+	if err != nil {
+		return err
+	}
+	if claims.ProviderActorID != providerActorID {
+		return fmt.Errorf("url was issued to provider %s", claims.ProviderActorID)
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/application-research/delta-dm/core"
 	db "github.com/application-research/delta-dm/db"
@@ -14,6 +15,9 @@ type DatasetPutBody struct {
 	Name             *string `json:"name"`
 	ReplicationQuota *uint64 `json:"replication_quota"`
 	DealDuration     *uint64 `json:"deal_duration"`
+	Budget           *string `json:"budget"`
+	ConnectionMode   *string `json:"connection_mode"`
+	DeltaNode        *string `json:"delta_node"` // name of the delta node to pin the dataset to, or empty to unpin it
 }
 
 func ConfigureDatasetsRouter(e *echo.Group, dldm *core.DeltaDM) {
@@ -22,31 +26,7 @@ func ConfigureDatasetsRouter(e *echo.Group, dldm *core.DeltaDM) {
 	datasets.Use(dldm.AS.AuthMiddleware)
 
 	datasets.GET("", func(c echo.Context) error {
-		var ds []db.Dataset
-
-		dldm.DB.Preload("Wallets").Preload("ReplicationProfiles").Find(&ds)
-
-		// Find  # of bytes total and replicated for each dataset
-		for i, d := range ds {
-			var rb [2]uint64
-			dldm.DB.Raw("select SUM(size) s, SUM(padded_size) ps FROM contents c inner join replications r on r.content_comm_p = c.comm_p where r.status NOT IN ? AND dataset_id = ?", db.FailedStatuses, d.ID).Row().Scan(&rb[0], &rb[1])
-
-			var tb [2]uint64
-			dldm.DB.Raw("select SUM(size) s, SUM(padded_size) ps FROM contents where dataset_id = ?", d.ID).Row().Scan(&tb[0], &tb[1])
-
-			ds[i].BytesReplicated = db.ByteSizes{Raw: rb[0], Padded: rb[1]}
-			ds[i].BytesTotal = db.ByteSizes{Raw: tb[0], Padded: tb[1]}
-
-			var countReplicated uint64 = 0
-			var countTotal uint64 = 0
-			dldm.DB.Raw("select count(*) cr FROM contents c inner join replications r on r.content_comm_p = c.comm_p where r.status NOT IN ? AND dataset_id = ?", db.FailedStatuses, d.ID).Row().Scan(&countReplicated)
-			dldm.DB.Raw("select count(*) cr FROM contents c where dataset_id = ?", d.ID).Row().Scan(&countTotal)
-
-			ds[i].CountReplicated = countReplicated
-			ds[i].CountTotal = countTotal
-		}
-
-		return c.JSON(http.StatusOK, ds)
+		return handleGetDatasets(c, dldm)
 	})
 
 	datasets.POST("", func(c echo.Context) error {
@@ -69,6 +49,20 @@ func ConfigureDatasetsRouter(e *echo.Group, dldm *core.DeltaDM) {
 			return fmt.Errorf("invalid dataset name. must contain only lowercase letters, numbers and hyphens. must begin and end with a letter. must not contain consecutive hyphens")
 		}
 
+		if _, err := core.ParseAttoFil(ads.Budget); err != nil {
+			return fmt.Errorf("invalid budget: %s", err)
+		}
+
+		cm, err := db.ParseConnectionMode(string(ads.ConnectionMode))
+		if err != nil {
+			return err
+		}
+		ads.ConnectionMode = cm
+
+		if err := dldm.Nodes.CheckPin(ads.DeltaNodeID); err != nil {
+			return err
+		}
+
 		res := dldm.DB.Create(&ads)
 
 		if res.Error != nil {
@@ -93,8 +87,8 @@ func ConfigureDatasetsRouter(e *echo.Group, dldm *core.DeltaDM) {
 			return err
 		}
 
-		if d.Name == nil && d.ReplicationQuota == nil && d.DealDuration == nil {
-			return fmt.Errorf("at least one parameter is required: name, replication_quota or deal_duration")
+		if d.Name == nil && d.ReplicationQuota == nil && d.DealDuration == nil && d.Budget == nil && d.ConnectionMode == nil && d.DeltaNode == nil {
+			return fmt.Errorf("at least one parameter is required: name, replication_quota, deal_duration, budget, connection_mode or delta_node")
 		}
 
 		var existing db.Dataset
@@ -125,6 +119,30 @@ func ConfigureDatasetsRouter(e *echo.Group, dldm *core.DeltaDM) {
 			existing.DealDuration = *d.DealDuration
 		}
 
+		// An empty budget removes the limit
+		if d.Budget != nil {
+			if _, err := core.ParseAttoFil(*d.Budget); err != nil {
+				return fmt.Errorf("invalid budget: %s", err)
+			}
+			existing.Budget = *d.Budget
+		}
+
+		if d.ConnectionMode != nil {
+			cm, err := db.ParseConnectionMode(*d.ConnectionMode)
+			if err != nil {
+				return err
+			}
+			existing.ConnectionMode = cm
+		}
+
+		if d.DeltaNode != nil {
+			pin, err := dldm.Nodes.Pin(*d.DeltaNode)
+			if err != nil {
+				return err
+			}
+			existing.DeltaNodeID = pin
+		}
+
 		res = dldm.DB.Save(&existing)
 		if res.Error != nil {
 			return fmt.Errorf("error saving dataset %s", res.Error)
@@ -133,3 +151,73 @@ func ConfigureDatasetsRouter(e *echo.Group, dldm *core.DeltaDM) {
 		return c.JSON(http.StatusOK, existing)
 	})
 }
+
+// GET /api/datasets
+// @description list datasets, with the sizes and counts of their content and replications
+// @queryparam limit max number of datasets to return. the total is returned in the X-Total-Count header
+// @queryparam offset number of datasets to skip
+// @queryparam fields comma-separated fields to return, i.e name,bytes_replicated. associations and aggregates that are not requested are not loaded
+func handleGetDatasets(c echo.Context, dldm *core.DeltaDM) error {
+	lo, err := extractListOptions(c, db.Dataset{})
+	if err != nil {
+		return &HttpError{Code: http.StatusBadRequest, Reason: http.StatusText(http.StatusBadRequest), Details: err.Error()}
+	}
+
+	var total int64
+	if res := dldm.DB.Model(&db.Dataset{}).Count(&total); res.Error != nil {
+		return fmt.Errorf("unable to count datasets: %s", res.Error)
+	}
+
+	tx := lo.Paginate(dldm.DB.Model(&db.Dataset{}).Order("id ASC"))
+	if lo.Wants("wallets") {
+		tx = tx.Preload("Wallets")
+	}
+	if lo.Wants("replication_profiles") {
+		tx = tx.Preload("ReplicationProfiles")
+	}
+
+	var ds []db.Dataset
+	if res := tx.Find(&ds); res.Error != nil {
+		return fmt.Errorf("unable to find datasets: %s", res.Error)
+	}
+
+	ids := make([]uint, len(ds))
+	for i, d := range ds {
+		ids[i] = d.ID
+	}
+
+	if lo.Wants("bytes_replicated") || lo.Wants("bytes_total") || lo.Wants("count_replicated") || lo.Wants("count_total") {
+		aggs, err := core.DatasetAggregates(dldm.DB, ids)
+		if err != nil {
+			return err
+		}
+		for i, d := range ds {
+			if a, ok := aggs[d.ID]; ok {
+				ds[i].BytesReplicated = a.BytesReplicated
+				ds[i].BytesTotal = a.BytesTotal
+				ds[i].CountReplicated = a.CountReplicated
+				ds[i].CountTotal = a.CountTotal
+			}
+		}
+	}
+
+	if lo.Wants("spent") {
+		spends, err := core.DatasetSpends(dldm.DB, ids)
+		if err != nil {
+			return err
+		}
+		for i, d := range ds {
+			if spent, ok := spends[d.ID]; ok && spent.Sign() > 0 {
+				ds[i].Spent = spent.String()
+			}
+		}
+	}
+
+	res, err := selectFields(ds, lo)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(HEADER_TOTAL_COUNT, strconv.FormatInt(total, 10))
+	return c.JSON(http.StatusOK, res)
+}
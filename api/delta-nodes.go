@@ -0,0 +1,109 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/application-research/delta-dm/core"
+	db "github.com/application-research/delta-dm/db"
+	"github.com/labstack/echo/v4"
+)
+
+type DeltaNodePostBody struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	AuthToken string `json:"auth_token"`
+}
+
+func ConfigureDeltaNodesRouter(e *echo.Group, dldm *core.DeltaDM) {
+	deltaNodes := e.Group("/delta-nodes")
+
+	deltaNodes.Use(dldm.AS.AuthMiddleware)
+
+	deltaNodes.GET("", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, dldm.Nodes.Status())
+	})
+
+	deltaNodes.POST("", func(c echo.Context) error {
+		return handlePostDeltaNode(c, dldm)
+	})
+
+	deltaNodes.DELETE("/:name", func(c echo.Context) error {
+		return handleDeleteDeltaNode(c, dldm)
+	})
+}
+
+// POST /api/v1/delta-nodes
+// @description register a delta node to make deals through. the node must be reachable with the given service token
+// @returns the registered node
+func handlePostDeltaNode(c echo.Context, dldm *core.DeltaDM) error {
+	var body DeltaNodePostBody
+	if err := c.Bind(&body); err != nil {
+		return fmt.Errorf("failed to parse request body: %s", err.Error())
+	}
+
+	badRequest := func(details string) error {
+		return &HttpError{Code: http.StatusBadRequest, Reason: http.StatusText(http.StatusBadRequest), Details: details}
+	}
+	if body.Name == "" || body.URL == "" || body.AuthToken == "" {
+		return badRequest("name, url and auth_token are required")
+	}
+	if _, exists := dldm.Nodes.Lookup(body.Name); exists {
+		return badRequest(fmt.Sprintf("delta node %s already exists", body.Name))
+	}
+
+	dapi, err := dldm.Nodes.Connect(strings.TrimSuffix(body.URL, "/"), body.AuthToken)
+	if err != nil {
+		return badRequest(fmt.Sprintf("could not connect to delta node: %s", err))
+	}
+
+	node := db.DeltaNode{Name: body.Name, URL: strings.TrimSuffix(body.URL, "/"), AuthToken: body.AuthToken}
+	if res := dldm.DB.Create(&node); res.Error != nil {
+		return fmt.Errorf("could not save delta node: %s", res.Error)
+	}
+
+	dldm.Nodes.Add(node, dapi)
+	dldm.Nodes.CheckNode(node.ID)
+
+	return c.JSON(http.StatusOK, node)
+}
+
+// DELETE /api/v1/delta-nodes/:name
+// @description remove a delta node. nodes with deals still pending on them, or with datasets or providers pinned to them, can't be removed
+func handleDeleteDeltaNode(c echo.Context, dldm *core.DeltaDM) error {
+	name := c.Param("name")
+
+	id, ok := dldm.Nodes.Lookup(name)
+	if !ok {
+		return fmt.Errorf("delta node %s not found", name)
+	}
+	if id == db.DEFAULT_DELTA_NODE_ID {
+		return &HttpError{Code: http.StatusBadRequest, Reason: http.StatusText(http.StatusBadRequest), Details: "the daemon's own delta node can't be removed"}
+	}
+
+	var pending, pinned int64
+	if res := dldm.DB.Model(&db.Replication{}).Where("delta_node_id = ? AND on_chain_deal_id = ? AND status NOT IN ?", id, 0, db.InactiveStatuses).Count(&pending); res.Error != nil {
+		return fmt.Errorf("could not count pending replications: %s", res.Error)
+	}
+	if pending > 0 {
+		return &HttpError{Code: http.StatusConflict, Reason: http.StatusText(http.StatusConflict), Details: fmt.Sprintf("delta node %s has %d deals pending, which must land on chain or fail before it is removed", name, pending)}
+	}
+	for _, model := range []interface{}{&db.Dataset{}, &db.Provider{}} {
+		var n int64
+		if res := dldm.DB.Model(model).Where("delta_node_id = ?", id).Count(&n); res.Error != nil {
+			return fmt.Errorf("could not count pinned datasets and providers: %s", res.Error)
+		}
+		pinned += n
+	}
+	if pinned > 0 {
+		return &HttpError{Code: http.StatusConflict, Reason: http.StatusText(http.StatusConflict), Details: fmt.Sprintf("%d datasets or providers are pinned to delta node %s, unpin them before removing it", pinned, name)}
+	}
+
+	if res := dldm.DB.Delete(&db.DeltaNode{}, id); res.Error != nil {
+		return fmt.Errorf("could not delete delta node: %s", res.Error)
+	}
+	dldm.Nodes.Remove(id)
+
+	return c.JSON(http.StatusOK, "delta node successfully deleted")
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"github.com/application-research/delta-dm/core"
+	db "github.com/application-research/delta-dm/db"
 	"github.com/labstack/echo/v4"
 	"net/http"
 )
@@ -14,14 +15,19 @@ func ConfigureHealthRouter(e *echo.Group, dldm *core.DeltaDM) {
 
 	health.GET("", func(c echo.Context) error {
 
+		// The daemon's own node may not have been reachable at startup, so its details are taken from its latest health check
+		node, _ := dldm.Nodes.StatusOf(db.DEFAULT_DELTA_NODE_ID)
+
 		resp := struct {
-			UUID      string              `json:"uuid"`
-			DDMInfo   core.DeploymentInfo `json:"ddm_info"`
-			DeltaInfo core.DeploymentInfo `json:"delta_info"`
+			UUID       string                 `json:"uuid"`
+			DDMInfo    core.DeploymentInfo    `json:"ddm_info"`
+			DeltaInfo  core.DeploymentInfo    `json:"delta_info"`
+			DeltaNodes []core.DeltaNodeStatus `json:"delta_nodes"`
 		}{
-			UUID:      dldm.DAPI.NodeUUID,
-			DDMInfo:   dldm.Info,
-			DeltaInfo: dldm.DAPI.DeltaDeploymentInfo,
+			UUID:       node.UUID,
+			DDMInfo:    dldm.Info,
+			DeltaInfo:  node.DeltaInfo,
+			DeltaNodes: dldm.Nodes.Status(),
 		}
 
 		return c.JSON(http.StatusOK, resp)
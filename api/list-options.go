@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Header set on paginated list responses, with the number of items across all pages
+const HEADER_TOTAL_COUNT = "X-Total-Count"
+
+// Pagination and field selection for list endpoints
+type ListOptions struct {
+	Limit  int // -1 for no limit
+	Offset int
+	Fields map[string]bool // json names of the fields to return. empty for all of them
+}
+
+// Whether a field was requested. Lets handlers skip computing fields that will not be returned
+func (lo ListOptions) Wants(field string) bool {
+	return len(lo.Fields) == 0 || lo.Fields[field]
+}
+
+func (lo ListOptions) Paginate(tx *gorm.DB) *gorm.DB {
+	return tx.Limit(lo.Limit).Offset(lo.Offset)
+}
+
+// Parse ?limit=, ?offset= and ?fields= (comma-separated). Fields are checked against the json names of model's fields
+func extractListOptions(c echo.Context, model interface{}) (ListOptions, error) {
+	lo := ListOptions{Limit: -1, Fields: make(map[string]bool)}
+
+	if limit := c.QueryParam("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return lo, fmt.Errorf("invalid limit '%s', must be a positive integer", limit)
+		}
+		lo.Limit = n
+	}
+
+	if offset := c.QueryParam("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return lo, fmt.Errorf("invalid offset '%s', must be a non-negative integer", offset)
+		}
+		lo.Offset = n
+	}
+
+	if fields := c.QueryParam("fields"); fields != "" {
+		valid := jsonFieldNames(reflect.TypeOf(model))
+		for _, f := range strings.Split(fields, ",") {
+			if !valid[f] {
+				return lo, fmt.Errorf("invalid field '%s'", f)
+			}
+			lo.Fields[f] = true
+		}
+	}
+
+	return lo, nil
+}
+
+// The names a struct's fields are marshalled to json with, including those of embedded structs
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for n := range jsonFieldNames(f.Type) {
+				names[n] = true
+			}
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// Trim each item in a list down to the requested fields
+func selectFields[T any](items []T, lo ListOptions) (interface{}, error) {
+	if len(lo.Fields) == 0 {
+		return items, nil
+	}
+
+	b, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+
+	var objs []map[string]json.RawMessage
+	if err := json.Unmarshal(b, &objs); err != nil {
+		return nil, err
+	}
+
+	for _, o := range objs {
+		for k := range o {
+			if !lo.Fields[k] {
+				delete(o, k)
+			}
+		}
+	}
+
+	return objs, nil
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/application-research/delta-dm/core"
 	db "github.com/application-research/delta-dm/db"
@@ -12,8 +13,10 @@ import (
 )
 
 type ProviderPutBody struct {
-	ActorName        string `json:"actor_name"`
-	AllowSelfService string `json:"allow_self_service"`
+	ActorName        string  `json:"actor_name"`
+	AllowSelfService string  `json:"allow_self_service"`
+	Region           string  `json:"region"`
+	DeltaNode        *string `json:"delta_node"` // name of the delta node to pin the provider to, or empty to unpin it
 }
 
 func ConfigureProvidersRouter(e *echo.Group, dldm *core.DeltaDM) {
@@ -22,23 +25,29 @@ func ConfigureProvidersRouter(e *echo.Group, dldm *core.DeltaDM) {
 	providers.Use(dldm.AS.AuthMiddleware)
 
 	providers.GET("", func(c echo.Context) error {
-		var p []db.Provider
+		return handleGetProviders(c, dldm)
+	})
 
-		dldm.DB.Preload("ReplicationProfiles").Find(&p)
+	providers.GET("/:provider_id/stats", func(c echo.Context) error {
+		pid := c.Param("provider_id")
 
-		for i, sp := range p {
-			var rb [2]uint64
-			dldm.DB.Raw("select SUM(size) s, SUM(padded_size) ps FROM contents c inner join replications r on r.content_comm_p = c.comm_p where r.status NOT IN ? AND r.provider_actor_id = ?", db.FailedStatuses, sp.ActorID).Row().Scan(&rb[0], &rb[1])
+		rep, err := core.ProviderReputation(dldm.DB, pid)
+		if err != nil {
+			return err
+		}
 
-			p[i].BytesReplicated = db.ByteSizes{Raw: rb[0], Padded: rb[1]}
+		return c.JSON(http.StatusOK, rep)
+	})
 
-			var countReplicated uint64 = 0
-			dldm.DB.Raw("select count(*) cr from replications r where r.status NOT IN ? AND  r.provider_actor_id = ?", db.FailedStatuses, sp.ActorID).Row().Scan(&countReplicated)
+	providers.GET("/:provider_id/telemetry", func(c echo.Context) error {
+		pid := c.Param("provider_id")
 
-			p[i].CountReplicated = countReplicated
+		stats, err := core.ProviderTimeInState(dldm.DB, pid)
+		if err != nil {
+			return err
 		}
 
-		return c.JSON(http.StatusOK, p)
+		return c.JSON(http.StatusOK, stats)
 	})
 
 	providers.POST("", func(c echo.Context) error {
@@ -54,6 +63,10 @@ func ConfigureProvidersRouter(e *echo.Group, dldm *core.DeltaDM) {
 			return fmt.Errorf("invalid actor id %s: %s", p.ActorID, err)
 		}
 
+		if err := dldm.Nodes.CheckPin(p.DeltaNodeID); err != nil {
+			return err
+		}
+
 		p.Key = uuid.New()
 
 		res := dldm.DB.Create(&p)
@@ -87,12 +100,24 @@ func ConfigureProvidersRouter(e *echo.Group, dldm *core.DeltaDM) {
 			existing.ActorName = p.ActorName
 		}
 
+		if p.Region != "" {
+			existing.Region = p.Region
+		}
+
 		if p.AllowSelfService == "on" {
 			existing.AllowSelfService = true
 		} else if p.AllowSelfService == "off" {
 			existing.AllowSelfService = false
 		}
 
+		if p.DeltaNode != nil {
+			pin, err := dldm.Nodes.Pin(*p.DeltaNode)
+			if err != nil {
+				return err
+			}
+			existing.DeltaNodeID = pin
+		}
+
 		res = dldm.DB.Save(&existing)
 		if res.Error != nil {
 			return fmt.Errorf("error saving provider %s", res.Error)
@@ -102,3 +127,66 @@ func ConfigureProvidersRouter(e *echo.Group, dldm *core.DeltaDM) {
 	})
 
 }
+
+// GET /api/providers
+// @description list providers, with the size and count of their replications and their reputation
+// @queryparam limit max number of providers to return. the total is returned in the X-Total-Count header
+// @queryparam offset number of providers to skip
+// @queryparam fields comma-separated fields to return, i.e actor_id,bytes_replicated. associations and aggregates that are not requested are not loaded
+func handleGetProviders(c echo.Context, dldm *core.DeltaDM) error {
+	lo, err := extractListOptions(c, db.Provider{})
+	if err != nil {
+		return &HttpError{Code: http.StatusBadRequest, Reason: http.StatusText(http.StatusBadRequest), Details: err.Error()}
+	}
+
+	var total int64
+	if res := dldm.DB.Model(&db.Provider{}).Count(&total); res.Error != nil {
+		return fmt.Errorf("unable to count providers: %s", res.Error)
+	}
+
+	tx := lo.Paginate(dldm.DB.Model(&db.Provider{}).Order("actor_id ASC"))
+	if lo.Wants("replication_profiles") {
+		tx = tx.Preload("ReplicationProfiles")
+	}
+
+	var p []db.Provider
+	if res := tx.Find(&p); res.Error != nil {
+		return fmt.Errorf("unable to find providers: %s", res.Error)
+	}
+
+	ids := make([]string, len(p))
+	for i, sp := range p {
+		ids[i] = sp.ActorID
+	}
+
+	if lo.Wants("bytes_replicated") || lo.Wants("count_replicated") {
+		aggs, err := core.ProviderAggregates(dldm.DB, ids)
+		if err != nil {
+			return err
+		}
+		for i, sp := range p {
+			if a, ok := aggs[sp.ActorID]; ok {
+				p[i].BytesReplicated = a.BytesReplicated
+				p[i].CountReplicated = a.CountReplicated
+			}
+		}
+	}
+
+	if lo.Wants("reputation") {
+		reputations, err := core.ProviderReputations(dldm.DB)
+		if err != nil {
+			return err
+		}
+		for i, sp := range p {
+			p[i].Reputation = reputations[sp.ActorID]
+		}
+	}
+
+	res, err := selectFields(p, lo)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(HEADER_TOTAL_COUNT, strconv.FormatInt(total, 10))
+	return c.JSON(http.StatusOK, res)
+}
@@ -9,6 +9,9 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
+// Set as a replication profile's connection mode to use the dataset's connection mode
+const CONNECTION_MODE_INHERIT = "inherit"
+
 type ReplicationProfile struct {
 	DatasetName string `json:"dataset_name"`
 	Unsealed    bool   `json:"unsealed"`
@@ -38,6 +41,19 @@ func ConfigureReplicationProfilesRouter(e *echo.Group, dldm *core.DeltaDM) {
 			return fmt.Errorf("failed to parse request body: %s", err.Error())
 		}
 
+		if err := normalizePrice(&p); err != nil {
+			return err
+		}
+
+		if p.ConnectionMode == CONNECTION_MODE_INHERIT {
+			p.ConnectionMode = ""
+		}
+		cm, err := db.ParseConnectionMode(string(p.ConnectionMode))
+		if err != nil {
+			return err
+		}
+		p.ConnectionMode = cm
+
 		// Check if the dataset and provider exist
 		var ds db.Dataset
 		var provider db.Provider
@@ -112,6 +128,29 @@ func ConfigureReplicationProfilesRouter(e *echo.Group, dldm *core.DeltaDM) {
 			"indexed":  updatedProfile.Indexed,
 		}
 
+		if updatedProfile.Verified != nil {
+			updateData["verified"] = *updatedProfile.Verified
+		}
+
+		// Price is only updated when specified. Setting it to 0 makes deals free
+		if updatedProfile.PricePerGiBEpoch != "" {
+			if err := normalizePrice(&updatedProfile); err != nil {
+				return err
+			}
+			updateData["price_per_gib_epoch"] = updatedProfile.PricePerGiBEpoch
+		}
+
+		// Connection mode is only updated when specified. Setting it to "inherit" uses the dataset's connection mode
+		if updatedProfile.ConnectionMode == CONNECTION_MODE_INHERIT {
+			updateData["connection_mode"] = ""
+		} else if updatedProfile.ConnectionMode != "" {
+			cm, err := db.ParseConnectionMode(string(updatedProfile.ConnectionMode))
+			if err != nil {
+				return err
+			}
+			updateData["connection_mode"] = cm
+		}
+
 		updateRes := dldm.DB.Model(&existingProfile).Updates(updateData)
 		if updateRes.Error != nil {
 			return fmt.Errorf("failed to update replication profile: %s", updateRes.Error.Error())
@@ -121,3 +160,19 @@ func ConfigureReplicationProfilesRouter(e *echo.Group, dldm *core.DeltaDM) {
 	})
 
 }
+
+// Validate the profile's price, clearing it if it is zero
+func normalizePrice(rp *db.ReplicationProfile) error {
+	price, err := core.ParseAttoFil(rp.PricePerGiBEpoch)
+	if err != nil {
+		return fmt.Errorf("invalid price_per_gib_epoch: %s", err)
+	}
+
+	if price.Sign() == 0 {
+		rp.PricePerGiBEpoch = ""
+	} else {
+		rp.PricePerGiBEpoch = price.String()
+	}
+
+	return nil
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -14,15 +16,13 @@ import (
 	"gorm.io/gorm"
 )
 
-const DEFAULT_DELAY_DAYS = 3
-
 type PostReplicationBody struct {
 	Provider       string  `json:"provider"`
 	DatasetID      *uint   `json:"dataset_id,omitempty"`
 	NumDeals       *uint   `json:"num_deals,omitempty"`
 	DelayStartDays *uint64 `json:"delay_start_days,omitempty"`
+	Strategy       string  `json:"strategy,omitempty"`
 	// NumTib       *int    `json:"num_tib,omitempty"`
-	// PricePerDeal float64 `json:"price_per_deal,omitempty"`
 }
 
 func ConfigureReplicationsRouter(e *echo.Group, dldm *core.DeltaDM) {
@@ -38,28 +38,133 @@ func ConfigureReplicationsRouter(e *echo.Group, dldm *core.DeltaDM) {
 		return handlePostReplications(c, dldm)
 	})
 
+	replications.POST("/preview", func(c echo.Context) error {
+		return handlePostReplicationsPreview(c, dldm)
+	})
+
+	replications.DELETE("/:id", func(c echo.Context) error {
+		return handleCancelReplication(c, dldm)
+	})
+
 }
 
 type GetReplicationsQueryParams struct {
-	Statuses      []string
-	DatasetNames  []string
-	Providers     []string
-	SelfService   *bool
-	DealTimeStart *time.Time
-	DealTimeEnd   *time.Time
-	ProposalCid   *string
-	PieceCid      *string
-	Message       *string
-	Limit         int
-	Offset        int
+	Statuses       []string
+	DatasetNames   []string
+	Providers      []string
+	SelfService    *bool
+	DealTimeStart  *time.Time
+	DealTimeEnd    *time.Time
+	ProposalCid    *string
+	PieceCids      []string
+	OnChainDealIDs []uint64
+	Message        *string
+	Limit          int
+	Offset         int
+	Sort           string
+	Descending     bool
+	Cursor         *replicationCursor
+	GroupBy        string
+}
+
+// A field replications can be sorted on
+type replicationSortField struct {
+	column string
+	// The value of the field for a replication, as stored in a cursor
+	value func(r db.Replication) interface{}
+	// Decode a cursor value back into a query parameter
+	decode func(raw json.RawMessage) (interface{}, error)
+}
+
+var replicationSortFields = map[string]replicationSortField{
+	"id": {
+		column: "replications.id",
+		value:  func(r db.Replication) interface{} { return r.ID },
+		decode: decodeCursorValue[uint64],
+	},
+	"deal_time": {
+		column: "replications.deal_time",
+		value:  func(r db.Replication) interface{} { return r.DealTime },
+		decode: decodeCursorValue[time.Time],
+	},
+	"status": {
+		column: "replications.status",
+		value:  func(r db.Replication) interface{} { return r.Status },
+		decode: decodeCursorValue[string],
+	},
+	"provider": {
+		column: "replications.provider_actor_id",
+		value:  func(r db.Replication) interface{} { return r.ProviderActorID },
+		decode: decodeCursorValue[string],
+	},
+	"on_chain_deal_id": {
+		column: "replications.on_chain_deal_id",
+		value:  func(r db.Replication) interface{} { return r.OnChainDealID },
+		decode: decodeCursorValue[uint64],
+	},
+	"padded_size": {
+		column: `"Content".padded_size`,
+		value:  func(r db.Replication) interface{} { return r.Content.PaddedSize },
+		decode: decodeCursorValue[uint64],
+	},
+}
+
+// Columns replications can be grouped by, for aggregation
+var replicationGroupColumns = map[string]string{
+	"status":   "replications.status",
+	"provider": "replications.provider_actor_id",
+	"dataset":  "d.name",
+	"day":      "CAST(DATE(replications.deal_time) AS TEXT)",
+}
+
+// Position after the last replication of a page, for keyset pagination. Encoded as base64 JSON
+type replicationCursor struct {
+	Sort  string          `json:"s"`
+	Value json.RawMessage `json:"v"`
+	ID    uint            `json:"id"`
+}
+
+func decodeCursorValue[T any](raw json.RawMessage) (interface{}, error) {
+	var v T
+	err := json.Unmarshal(raw, &v)
+	return v, err
+}
+
+func encodeReplicationCursor(sort string, r db.Replication) (string, error) {
+	value, err := json.Marshal(replicationSortFields[sort].value(r))
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(replicationCursor{Sort: sort, Value: value, ID: r.ID})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeReplicationCursor(s string) (*replicationCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var cursor replicationCursor
+	if err := json.Unmarshal(b, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	return &cursor, nil
 }
 
 // Extract all the replications query parameters from the request
-func extractGetReplicationsQueryParams(c echo.Context) GetReplicationsQueryParams {
+func extractGetReplicationsQueryParams(c echo.Context) (GetReplicationsQueryParams, error) {
 	var gqp GetReplicationsQueryParams
 
 	proposalCid := c.QueryParam("proposal_cid")
-	pieceCid := c.QueryParam("piece_cid")
+	pieceCids := c.QueryParam("piece_cid")
+	onChainDealIDs := c.QueryParam("on_chain_deal_id")
 	statuses := c.QueryParam("statuses")
 	datasetNames := c.QueryParam("datasets")
 	providers := c.QueryParam("providers")
@@ -69,6 +174,10 @@ func extractGetReplicationsQueryParams(c echo.Context) GetReplicationsQueryParam
 	message := c.QueryParam("message")
 	limit := c.QueryParam("limit")
 	offset := c.QueryParam("offset")
+	sort := c.QueryParam("sort")
+	order := c.QueryParam("order")
+	cursor := c.QueryParam("cursor")
+	groupBy := c.QueryParam("group_by")
 
 	var err error
 	gqp.Limit, err = strconv.Atoi(limit)
@@ -81,14 +190,22 @@ func extractGetReplicationsQueryParams(c echo.Context) GetReplicationsQueryParam
 		gqp.Offset = 0
 	}
 
-	// PieceCID and ProposalCID will result in a specific search, so can return them right away
-	if pieceCid != "" {
-		gqp.PieceCid = &pieceCid
-		return gqp
-	}
 	if proposalCid != "" {
 		gqp.ProposalCid = &proposalCid
-		return gqp
+	}
+
+	if pieceCids != "" {
+		gqp.PieceCids = strings.Split(pieceCids, ",")
+	}
+
+	if onChainDealIDs != "" {
+		for _, id := range strings.Split(onChainDealIDs, ",") {
+			n, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				return gqp, fmt.Errorf("invalid on_chain_deal_id '%s': %s", id, err)
+			}
+			gqp.OnChainDealIDs = append(gqp.OnChainDealIDs, n)
+		}
 	}
 
 	if statuses != "" {
@@ -122,12 +239,61 @@ func extractGetReplicationsQueryParams(c echo.Context) GetReplicationsQueryParam
 		gqp.DealTimeEnd = &dte
 	}
 
-	return gqp
+	gqp.Sort = "id"
+	if sort != "" {
+		if _, ok := replicationSortFields[sort]; !ok {
+			return gqp, fmt.Errorf("invalid sort '%s', must be one of id, deal_time, status, provider, on_chain_deal_id, padded_size", sort)
+		}
+		gqp.Sort = sort
+	}
+
+	switch order {
+	case "", "desc":
+		gqp.Descending = true
+	case "asc":
+		gqp.Descending = false
+	default:
+		return gqp, fmt.Errorf("invalid order '%s', must be asc or desc", order)
+	}
+
+	if cursor != "" {
+		gqp.Cursor, err = decodeReplicationCursor(cursor)
+		if err != nil {
+			return gqp, err
+		}
+		if gqp.Cursor.Sort != gqp.Sort {
+			return gqp, fmt.Errorf("cursor was created for sort '%s', not '%s'", gqp.Cursor.Sort, gqp.Sort)
+		}
+	}
+
+	if groupBy != "" {
+		if _, ok := replicationGroupColumns[groupBy]; !ok {
+			return gqp, fmt.Errorf("invalid group_by '%s', must be one of status, provider, dataset, day", groupBy)
+		}
+		gqp.GroupBy = groupBy
+	}
+
+	return gqp, nil
 }
 
 type ReplicationResponse struct {
 	Data       []db.Replication `json:"data"`
 	TotalCount int64            `json:"totalCount"`
+	// Pass as the cursor param to get the next page. Empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Count and size of the replications in a group
+type ReplicationGroup struct {
+	Key         string `json:"key"`
+	Count       uint64 `json:"count"`
+	OnChain     uint64 `json:"on_chain"`
+	PaddedBytes uint64 `json:"padded_bytes"`
+}
+
+type ReplicationGroupsResponse struct {
+	GroupBy string             `json:"group_by"`
+	Groups  []ReplicationGroup `json:"groups"`
 }
 
 // handleGetReplications handles the request to get replications
@@ -135,16 +301,47 @@ type ReplicationResponse struct {
 // @Tags replications
 // @Produce  json
 func handleGetReplications(c echo.Context, dldm *core.DeltaDM) error {
-	rqp := extractGetReplicationsQueryParams(c)
+	rqp, err := extractGetReplicationsQueryParams(c)
+	if err != nil {
+		return &HttpError{Code: http.StatusBadRequest, Reason: http.StatusText(http.StatusBadRequest), Details: err.Error()}
+	}
 
+	return replicationsResponse(c, dldm, rqp)
+}
+
+// Respond with the replications matching the given parameters, or their aggregates if grouped
+func replicationsResponse(c echo.Context, dldm *core.DeltaDM, rqp GetReplicationsQueryParams) error {
+	if rqp.GroupBy != "" {
+		groups, err := groupReplications(dldm, rqp)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, ReplicationGroupsResponse{GroupBy: rqp.GroupBy, Groups: groups})
+	}
+
+	res, err := queryReplications(dldm, rqp)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// Build the query for replications matching the filters in the given parameters
+func filterReplications(dldm *core.DeltaDM, rqp GetReplicationsQueryParams) *gorm.DB {
 	tx := dldm.DB.Model(&db.Replication{}).Joins("Content")
 
-	if rqp.PieceCid != nil {
-		tx.Where("replications.piece_cid = ?", rqp.PieceCid)
-	} else if rqp.ProposalCid != nil {
+	if len(rqp.PieceCids) > 0 {
+		tx.Where("replications.content_comm_p IN ?", rqp.PieceCids)
+	}
+
+	if rqp.ProposalCid != nil {
 		tx.Where("replications.proposal_cid = ?", rqp.ProposalCid)
 	}
 
+	if len(rqp.OnChainDealIDs) > 0 {
+		tx.Where("replications.on_chain_deal_id IN ?", rqp.OnChainDealIDs)
+	}
+
 	if len(rqp.Statuses) > 0 {
 		tx.Where("replications.status IN ?", rqp.Statuses)
 	}
@@ -154,7 +351,7 @@ func handleGetReplications(c echo.Context, dldm *core.DeltaDM) error {
 
 		// Get dataset IDs from names
 		dldm.DB.Model(&db.Dataset{}).Where("name IN ?", rqp.DatasetNames).Pluck("id", &datasetIds)
-		tx.Where("Content.dataset_id IN ?", datasetIds)
+		tx.Where(`"Content".dataset_id IN ?`, datasetIds)
 	}
 
 	if len(rqp.Providers) > 0 {
@@ -177,6 +374,13 @@ func handleGetReplications(c echo.Context, dldm *core.DeltaDM) error {
 		tx.Where("replications.delta_message LIKE ?", "%"+*rqp.Message+"%")
 	}
 
+	return tx
+}
+
+// Query replications matching the given parameters
+func queryReplications(dldm *core.DeltaDM, rqp GetReplicationsQueryParams) (*ReplicationResponse, error) {
+	tx := filterReplications(dldm, rqp)
+
 	var r []db.Replication
 	var totalCount int64
 
@@ -186,14 +390,71 @@ func handleGetReplications(c echo.Context, dldm *core.DeltaDM) error {
 	countTx := tx.Session(&gorm.Session{NewDB: false})
 	countTx.Count(&totalCount)
 
-	tx.Limit(rqp.Limit).Offset(rqp.Offset).Order("replications.id DESC").Scan(&r)
+	sort := replicationSortFields[rqp.Sort]
+	direction, comparison := "DESC", "<"
+	if !rqp.Descending {
+		direction, comparison = "ASC", ">"
+	}
 
-	response := ReplicationResponse{
+	// With a cursor, continue from the last replication of the previous page rather than using the offset
+	// Replication ID breaks ties between replications with the same sort value
+	if rqp.Cursor != nil {
+		value, err := sort.decode(rqp.Cursor.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor: %s", err)
+		}
+		tx.Where(fmt.Sprintf("(%s %s ? OR (%s = ? AND replications.id %s ?))", sort.column, comparison, sort.column, comparison), value, value, rqp.Cursor.ID)
+	} else {
+		tx.Offset(rqp.Offset)
+	}
+
+	order := fmt.Sprintf("%s %s", sort.column, direction)
+	if rqp.Sort != "id" {
+		order += fmt.Sprintf(", replications.id %s", direction)
+	}
+
+	res := tx.Limit(rqp.Limit).Order(order).Scan(&r)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to query replications: %s", res.Error)
+	}
+
+	response := &ReplicationResponse{
 		Data:       r,
 		TotalCount: totalCount,
 	}
 
-	return c.JSON(http.StatusOK, response)
+	if len(r) > 0 && len(r) == rqp.Limit {
+		cursor, err := encodeReplicationCursor(rqp.Sort, r[len(r)-1])
+		if err != nil {
+			return nil, fmt.Errorf("unable to create cursor: %s", err)
+		}
+		response.NextCursor = cursor
+	}
+
+	return response, nil
+}
+
+// Aggregate replications matching the given parameters by the group_by column
+func groupReplications(dldm *core.DeltaDM, rqp GetReplicationsQueryParams) ([]ReplicationGroup, error) {
+	tx := filterReplications(dldm, rqp)
+
+	if rqp.GroupBy == "dataset" {
+		tx.Joins(`LEFT JOIN datasets d ON d.id = "Content".dataset_id`)
+	}
+
+	key := replicationGroupColumns[rqp.GroupBy]
+	groups := []ReplicationGroup{}
+	res := tx.Select(key + ` AS key, COUNT(*) AS count,
+		SUM(CASE WHEN replications.on_chain_deal_id <> 0 THEN 1 ELSE 0 END) AS on_chain,
+		COALESCE(SUM("Content".padded_size), 0) AS padded_bytes`).
+		Group(key).
+		Order("count DESC").
+		Scan(&groups)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to group replications: %s", res.Error)
+	}
+
+	return groups, nil
 }
 
 // POST /api/replication
@@ -208,173 +469,91 @@ func handlePostReplications(c echo.Context, dldm *core.DeltaDM) error {
 		return err
 	}
 
-	if d.NumDeals == nil {
-		return fmt.Errorf("must specify num_deals")
-	}
-
-	var providerExists bool
-	err := dldm.DB.Model(db.Provider{}).
-		Select("count(*) > 0").
-		Where("actor_id = ?", d.Provider).
-		Find(&providerExists).
-		Error
-
-	if err != nil {
-		return fmt.Errorf("could not check if provider %s exists: %s", d.Provider, err)
-	}
-
-	if !providerExists {
-		return fmt.Errorf("provider %s does not exist in ddm. please add it first", d.Provider)
-	}
-
-	var delayStartEpoch uint64 = DEFAULT_DELAY_DAYS
-	if d.DelayStartDays != nil {
-		if *d.DelayStartDays < 1 || *d.DelayStartDays > 14 {
-			return fmt.Errorf("delay_start_epoch must be between 1 and 14")
-		}
-		delayStartEpoch = *d.DelayStartDays
-	}
-
-	if d.DatasetID != nil {
-		var datasetExists bool
-		err = dldm.DB.Model(db.Dataset{}).
-			Select("count(*) > 0").
-			Where("id = ?", d.DatasetID).
-			Find(&datasetExists).
-			Error
+	plan, recorded, err := dldm.AllocateDeals(func() (*core.DealPlan, error) {
+		plan, err := planReplications(dldm, d)
 		if err != nil {
-			return fmt.Errorf("could not check if dataset with id %d exists: %s", *d.DatasetID, err)
+			return nil, err
 		}
-		if !datasetExists {
-			return fmt.Errorf("dataset id %d does not exist in ddm.", *d.DatasetID)
+
+		if len(plan.Skipped) > 0 {
+			return nil, fmt.Errorf("%s. no deals were made. please fix this and try again. alternatively, explicitly specify a dataset in the request to only replicate content from it", plan.Skipped[0].Reason)
 		}
-	}
 
-	// TODO: Support num_tib to allow specifying the amount of data to replicate
+		if len(plan.Deals) == 0 {
+			return nil, fmt.Errorf("no content to replicate to this provider was found. check dataset-provider allowances, replication quota")
+		}
 
-	toReplicate, err := findUnreplicatedContentForProvider(dldm.DB, d.Provider, d.DatasetID, d.NumDeals, false)
+		return plan, nil
+	}, authKey)
 	if err != nil {
 		return err
 	}
 
-	if len(toReplicate) == 0 {
-		return fmt.Errorf("no content to replicate to this provider was found. check dataset-provider allowances, replication quota")
+	log.Debugf("calling DELTA api for %+v deals\n\n", len(plan.Deals))
+
+	deltaResp, err := dldm.SendDeals(recorded)
+	if err != nil {
+		return fmt.Errorf("unable to make deals: %w", err)
 	}
 
-	var dealsToMake core.OfflineDealRequest
-	log.Debugf("calling DELTA api for %+v deals\n\n", len(toReplicate))
+	return c.JSON(http.StatusOK, deltaResp)
+}
 
-	for _, c := range toReplicate {
-		wallet, err := walletSelection(dldm.DB, &c.DatasetID)
+// POST /api/replications/preview
+// @description plan replications as POST /api/replications would, without making any deals
+// @returns the deals that would be made, and the pieces that would be skipped
+func handlePostReplicationsPreview(c echo.Context, dldm *core.DeltaDM) error {
+	var d PostReplicationBody
 
-		if err != nil || wallet.Addr == "" {
-			return fmt.Errorf("dataset '%s' does not have a wallet. no deals were made. please add a wallet for this dataset and try again. alternatively, explicitly specify a dataset in the request to force replication of one with an existing wallet", c.Dataset.Name)
-		}
+	if err := c.Bind(&d); err != nil {
+		return err
+	}
 
-		dealsToMake = append(dealsToMake, core.Deal{
-			PayloadCID: c.PayloadCID,
-			Wallet: db.Wallet{
-				Addr: wallet.Addr,
-			},
-			ConnectionMode:     "import",
-			Miner:              d.Provider,
-			Size:               c.Size,
-			SkipIpniAnnounce:   !c.Indexed,
-			RemoveUnsealedCopy: !c.Unsealed,
-			DurationInDays:     c.DealDuration,
-			StartEpochInDays:   delayStartEpoch,
-			PieceCommitment: core.PieceCommitment{
-				PieceCid:        c.CommP,
-				PaddedPieceSize: c.PaddedSize,
-			},
-		})
-	}
-
-	deltaResp, err := dldm.MakeDeals(dealsToMake, authKey, false)
+	plan, err := planReplications(dldm, d)
 	if err != nil {
-		return fmt.Errorf("unable to make deals: %s", err)
+		return err
 	}
 
-	return c.JSON(http.StatusOK, deltaResp)
+	return c.JSON(http.StatusOK, dldm.PreviewPlan(plan, time.Now()))
 }
 
-type replicatedContentQueryResponse struct {
-	db.Content
-	db.Dataset
-	// Note: We can't use `db.ReplicationProfile` here because it has a `DatasetID` field which conflicts with the `Dataset` field above
-	// Thus, Unsealed and Indexed are added manually
-	Unsealed bool
-	Indexed  bool
-}
+func planReplications(dldm *core.DeltaDM, d PostReplicationBody) (*core.DealPlan, error) {
+	if d.NumDeals == nil {
+		return nil, fmt.Errorf("must specify num_deals")
+	}
 
-// Query the database for all contant that does not have replications to this actor yet
-// Arguments: providerID - the actor ID of the provider
-//
-//	datasetID (optional) - the ID of the dataset to replicate
-//	numDeals (optional) - the number of replications (deals) to return. If nil, return all
-//  filterOnlyContentLocations - if true, only return content where the content_location is present (i.e, downloadable)
-func findUnreplicatedContentForProvider(db *gorm.DB, providerID string, datasetId *uint, numDeals *uint, filterOnlyContentLocations bool) ([]replicatedContentQueryResponse, error) {
-	rawQuery := `
-  SELECT *
-  FROM datasets d
-  INNER JOIN contents c ON d.id = c.dataset_id
-  INNER JOIN replication_profiles rp ON rp.dataset_id = d.id
-	-- Only select content that does not have a non-failed replication to this provider
-  WHERE c.comm_p NOT IN (
-    SELECT r.content_comm_p 
-    FROM replications r 
-    WHERE r.status != 'FAILURE' 
-    AND r.provider_actor_id NOT IN (
-      SELECT p.actor_id 
-      FROM providers p 
-      WHERE p.actor_id <> ?
-    )
-  )
-  -- Only select content from datasets that this provider is allowed to replicate
-  AND rp.provider_actor_id = ?
-  AND c.num_replications < d.replication_quota 
-	`
-
-	if filterOnlyContentLocations {
-		rawQuery += " AND c.content_location IS NOT NULL"
-	}
-	var rawValues = []interface{}{providerID, providerID}
-
-	if datasetId != nil && *datasetId != 0 {
-		rawQuery += " AND d.id = ?"
-		rawValues = append(rawValues, datasetId)
-	}
-
-	if numDeals != nil {
-		rawQuery += " LIMIT ?"
-		rawValues = append(rawValues, numDeals)
-	}
-	var contents []replicatedContentQueryResponse
-	tx := db.Raw(rawQuery, rawValues...).Scan(&contents)
-
-	if tx.Error != nil {
-		return nil, tx.Error
-	}
-
-	return contents, nil
-}
+	strategy, err := core.ParseSelectionStrategy(d.Strategy)
+	if err != nil {
+		return nil, err
+	}
 
-// Find which wallet to use when making deals for a given dataset
-func walletSelection(dbi *gorm.DB, datasetId *uint) (*db.Wallet, error) {
-	var w []db.Wallet
+	// TODO: Support num_tib to allow specifying the amount of data to replicate
 
-	res := dbi.Raw("select * from wallets w inner join wallet_datasets wd on w.addr = wd.wallet_addr inner join datasets d on wd.dataset_id = d.id where d.id = ?", datasetId).Scan(&w)
+	return dldm.PlanDeals(core.DealPlanOptions{
+		ProviderActorID: d.Provider,
+		DatasetID:       d.DatasetID,
+		Count:           d.NumDeals,
+		StartDelayDays:  d.DelayStartDays,
+		Strategy:        strategy,
+	})
+}
 
-	if res.Error != nil {
-		return nil, res.Error
+// DELETE /api/replications/:id
+// @description cancel a replication whose deal has not landed on chain yet
+// @returns the cancelled replication
+func handleCancelReplication(c echo.Context, dldm *core.DeltaDM) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("replication id must be numeric %s", err)
 	}
 
-	if len(w) == 0 {
-		return nil, fmt.Errorf("no wallet found for dataset '%d'", *datasetId)
+	dldm.AllocationLock.Lock()
+	defer dldm.AllocationLock.Unlock()
 
+	r, err := core.CancelReplication(dldm.DB, uint(id))
+	if err != nil {
+		return err
 	}
 
-	// TODO: Wallet selection algorithm
-	// Just choose the first wallet for now
-	return &w[0], nil
+	return c.JSON(http.StatusOK, r)
 }
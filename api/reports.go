@@ -0,0 +1,98 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/application-research/delta-dm/core"
+	"github.com/labstack/echo/v4"
+)
+
+func ConfigureReportsRouter(e *echo.Group, dldm *core.DeltaDM) {
+	reports := e.Group("/reports")
+
+	reports.Use(dldm.AS.AuthMiddleware)
+
+	reports.GET("/spend", func(c echo.Context) error {
+		groupBy := c.QueryParam("group_by")
+		if groupBy == "" {
+			groupBy = "wallet"
+		}
+
+		report, err := core.SpendReport(dldm.DB, groupBy)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, report)
+	})
+
+	reports.GET("/replications", func(c echo.Context) error {
+		return handleGetReplicationsReport(c, dldm)
+	})
+
+	reports.GET("/compliance", func(c echo.Context) error {
+		return handleGetComplianceReport(c, dldm)
+	})
+}
+
+// GET /api/reports/replications
+// @description export replications, joined with their content, dataset and provider. accepts the same filters as GET /replications
+// @queryparam format csv (default), ndjson or parquet
+func handleGetReplicationsReport(c echo.Context, dldm *core.DeltaDM) error {
+	format, err := core.ParseExportFormat(c.QueryParam("format"))
+	if err != nil {
+		return &HttpError{Code: http.StatusBadRequest, Reason: http.StatusText(http.StatusBadRequest), Details: err.Error()}
+	}
+
+	rqp, err := extractGetReplicationsQueryParams(c)
+	if err != nil {
+		return &HttpError{Code: http.StatusBadRequest, Reason: http.StatusText(http.StatusBadRequest), Details: err.Error()}
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, format.ContentType())
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=replications.%s", format))
+
+	// The 200 is only sent with the first bytes of the report, so an error running the query can still be returned
+	err = core.ExportReplications(filterReplications(dldm, rqp), format, c.Response())
+	if err != nil && !c.Response().Committed {
+		c.Response().Header().Del(echo.HeaderContentType)
+		c.Response().Header().Del(echo.HeaderContentDisposition)
+		return &HttpError{Code: http.StatusInternalServerError, Reason: http.StatusText(http.StatusInternalServerError), Details: err.Error()}
+	}
+
+	// The report is streamed, so once it has started an error can only be logged
+	if err != nil {
+		log.Errorf("failed exporting replications: %s", err)
+	}
+
+	return nil
+}
+
+// GET /api/reports/compliance
+// @description summarize how a dataset is distributed across providers and regions, for FIL+ allocators and notaries
+// @queryparam dataset name of the dataset (required)
+// @queryparam format json (default) or md
+// @queryparam on_chain_only only count deals that are on chain
+func handleGetComplianceReport(c echo.Context, dldm *core.DeltaDM) error {
+	dataset := c.QueryParam("dataset")
+	if dataset == "" {
+		return &HttpError{Code: http.StatusBadRequest, Reason: http.StatusText(http.StatusBadRequest), Details: "dataset must be specified"}
+	}
+
+	format := c.QueryParam("format")
+	if format != "" && format != "json" && format != "md" {
+		return &HttpError{Code: http.StatusBadRequest, Reason: http.StatusText(http.StatusBadRequest), Details: fmt.Sprintf("invalid format '%s', must be one of json, md", format)}
+	}
+
+	report, err := core.GenerateComplianceReport(dldm.DB, dataset, c.QueryParam("on_chain_only") == "true")
+	if err != nil {
+		return err
+	}
+
+	if format == "md" {
+		return c.Blob(http.StatusOK, "text/markdown; charset=utf-8", []byte(report.Markdown()))
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
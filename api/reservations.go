@@ -0,0 +1,163 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/delta-dm/core"
+	db "github.com/application-research/delta-dm/db"
+	"github.com/labstack/echo/v4"
+)
+
+type PostReservationBody struct {
+	Dataset       string `json:"dataset"`
+	Count         uint   `json:"count"`
+	DurationHours *uint  `json:"duration_hours,omitempty"`
+	Strategy      string `json:"strategy,omitempty"`
+}
+
+type PutReservationBody struct {
+	DurationHours uint `json:"duration_hours"`
+}
+
+// GET /api/self-service/reservations
+// @returns the provider's active reservations
+func handleGetReservations(c echo.Context, dldm *core.DeltaDM) error {
+	p := c.Get(PROVIDER).(db.Provider)
+
+	reservations, err := core.ActiveReservations(dldm.DB, p.ActorID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, reservations)
+}
+
+// POST /api/self-service/reservations
+// @description reserve content from a dataset, so it is not handed out to other providers until the reservation expires
+// @returns the new reservations
+func handlePostReservations(c echo.Context, dldm *core.DeltaDM) error {
+	var b PostReservationBody
+	if err := c.Bind(&b); err != nil {
+		return fmt.Errorf("unable to bind request: %s", err)
+	}
+
+	if b.Count < 1 || b.Count > MAX_SELF_SERVICE_BATCH_SIZE {
+		return fmt.Errorf("count must be between 1 and %d", MAX_SELF_SERVICE_BATCH_SIZE)
+	}
+
+	strategy, err := core.ParseSelectionStrategy(b.Strategy)
+	if err != nil {
+		return err
+	}
+
+	duration := core.DEFAULT_RESERVATION_DURATION
+	if b.DurationHours != nil {
+		duration = time.Duration(*b.DurationHours) * time.Hour
+	}
+
+	var ds db.Dataset
+	dsRes := dldm.DB.Where("name = ?", b.Dataset).First(&ds)
+	if dsRes.Error != nil || ds.ID == 0 {
+		return fmt.Errorf("invalid dataset: %s", dsRes.Error)
+	}
+
+	p := c.Get(PROVIDER).(db.Provider)
+
+	isAllowed := false
+	for _, rp := range p.ReplicationProfiles {
+		if rp.DatasetID == ds.ID {
+			isAllowed = true
+			break
+		}
+	}
+
+	if !isAllowed {
+		return fmt.Errorf("provider '%s' is not allowed to replicate dataset '%s'", p.ActorID, ds.Name)
+	}
+
+	dldm.AllocationLock.Lock()
+	defer dldm.AllocationLock.Unlock()
+
+	existing, err := core.ActiveReservations(dldm.DB, p.ActorID)
+	if err != nil {
+		return err
+	}
+
+	alreadyReserved := make(map[string]bool)
+	for _, r := range existing {
+		alreadyReserved[r.ContentCommP] = true
+	}
+
+	// Content the provider has already reserved is still eligible for it, so look past it
+	numDeals := b.Count + uint(len(existing))
+	cnt, err := core.FindUnreplicatedContent(dldm.DB, p.ActorID, &ds.ID, &numDeals, strategy, false)
+	if err != nil {
+		return fmt.Errorf("unable to find content for dataset: %s", err)
+	}
+
+	var toReserve []string
+	for _, cn := range cnt {
+		if alreadyReserved[cn.CommP] {
+			continue
+		}
+		toReserve = append(toReserve, cn.CommP)
+		if uint(len(toReserve)) == b.Count {
+			break
+		}
+	}
+
+	if len(toReserve) == 0 {
+		return fmt.Errorf("no content available to reserve for dataset")
+	}
+
+	reservations, err := core.CreateReservations(dldm.DB, p.ActorID, toReserve, duration)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, reservations)
+}
+
+// PUT /api/self-service/reservations/:id
+// @description extend an active reservation, so it expires duration_hours from now
+func handleExtendReservation(c echo.Context, dldm *core.DeltaDM) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("reservation id must be numeric %s", err)
+	}
+
+	var b PutReservationBody
+	if err := c.Bind(&b); err != nil {
+		return fmt.Errorf("unable to bind request: %s", err)
+	}
+
+	p := c.Get(PROVIDER).(db.Provider)
+
+	r, err := core.ExtendReservation(dldm.DB, p.ActorID, uint(id), time.Duration(b.DurationHours)*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, r)
+}
+
+// DELETE /api/self-service/reservations/:id
+// @description release an active reservation
+func handleReleaseReservation(c echo.Context, dldm *core.DeltaDM) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("reservation id must be numeric %s", err)
+	}
+
+	p := c.Get(PROVIDER).(db.Provider)
+
+	err = core.ReleaseReservation(dldm.DB, p.ActorID, uint(id))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, fmt.Sprintf("reservation %d released", id))
+}
@@ -65,6 +65,11 @@ func InitializeEchoRouterConfig(dldm *core.DeltaDM, port uint) {
 	ConfigureHealthRouter(apiGroup, dldm)
 	ConfigureSelfServiceRouter(apiGroup, dldm)
 	ConfigureReplicationProfilesRouter(apiGroup, dldm)
+	ConfigureSignedUrlsRouter(apiGroup, dldm)
+	ConfigureCarRouter(apiGroup, dldm)
+	ConfigureReportsRouter(apiGroup, dldm)
+	ConfigureStatsRouter(apiGroup, dldm)
+	ConfigureDeltaNodesRouter(apiGroup, dldm)
 	// Start server
 	e.Logger.Fatal(e.Start(fmt.Sprintf("0.0.0.0:%d", (port)))) // configuration
 }
@@ -80,6 +85,21 @@ func ErrorHandler(err error, c echo.Context) {
 		return
 	}
 
+	// Delta being down is not DDM's fault, and the caller may try again later
+	if xerrors.Is(err, core.ErrDeltaUnavailable) {
+		log.Errorf("handler error: %s", err)
+		if err := c.JSON(http.StatusServiceUnavailable, HttpErrorResponse{
+			Error: HttpError{
+				Code:    http.StatusServiceUnavailable,
+				Reason:  "Delta unavailable",
+				Details: err.Error(),
+			},
+		}); err != nil {
+			log.Errorf("handler error: %s", err)
+		}
+		return
+	}
+
 	var echoErr *echo.HTTPError
 	if xerrors.As(err, &echoErr) {
 		if err := c.JSON(echoErr.Code, HttpErrorResponse{
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/application-research/delta-dm/core"
+	db "github.com/application-research/delta-dm/db"
+	"github.com/labstack/echo/v4"
+)
+
+// A dataset the provider is allowed to replicate, and its progress replicating it
+type SelfServiceDataset struct {
+	ID               uint         `json:"id"`
+	Name             string       `json:"name"`
+	ReplicationQuota uint64       `json:"replication_quota"`
+	DealDuration     uint64       `json:"deal_duration"`
+	Unsealed         bool         `json:"unsealed"`
+	Indexed          bool         `json:"indexed"`
+	BytesReplicated  db.ByteSizes `json:"bytes_replicated"`
+	CountReplicated  uint64       `json:"count_replicated"`
+	CountAvailable   uint64       `json:"count_available"`
+}
+
+type SelfServiceLimits struct {
+	AllowSelfService      bool        `json:"allow_self_service"`
+	MaxBatchSize          uint        `json:"max_batch_size"`
+	MaxActiveReservations uint        `json:"max_active_reservations"`
+	ActiveReservations    uint        `json:"active_reservations"`
+	MaxReservationHours   uint        `json:"max_reservation_hours"`
+	StartEpochDelay       EpochBounds `json:"start_epoch_delay"`
+	EndEpochAdvance       EpochBounds `json:"end_epoch_advance"`
+	// Number of pieces currently available to the provider across all of its datasets, including those it has reserved
+	// Each request is still bound by MaxBatchSize
+	AvailableContent uint64 `json:"available_content"`
+}
+
+type EpochBounds struct {
+	Min     uint64 `json:"min"`
+	Max     uint64 `json:"max"`
+	Default uint64 `json:"default"`
+}
+
+// GET /api/self-service/replications
+// @description the provider's own replications. accepts the same query params as GET /replications, except `providers`
+func handleSelfServiceReplications(c echo.Context, dldm *core.DeltaDM) error {
+	p := c.Get(PROVIDER).(db.Provider)
+
+	rqp, err := extractGetReplicationsQueryParams(c)
+	if err != nil {
+		return &HttpError{Code: http.StatusBadRequest, Reason: http.StatusText(http.StatusBadRequest), Details: err.Error()}
+	}
+	rqp.Providers = []string{p.ActorID}
+
+	return replicationsResponse(c, dldm, rqp)
+}
+
+// GET /api/self-service/datasets
+// @description the datasets the provider is allowed to replicate, with bytes replicated by the provider and content remaining for it
+func handleSelfServiceDatasets(c echo.Context, dldm *core.DeltaDM) error {
+	p := c.Get(PROVIDER).(db.Provider)
+
+	result := []SelfServiceDataset{}
+	if len(p.ReplicationProfiles) == 0 {
+		return c.JSON(http.StatusOK, result)
+	}
+
+	var datasetIds []uint
+	for _, rp := range p.ReplicationProfiles {
+		datasetIds = append(datasetIds, rp.DatasetID)
+	}
+
+	var ds []db.Dataset
+	res := dldm.DB.Model(&db.Dataset{}).Where("id IN ?", datasetIds).Find(&ds)
+	if res.Error != nil {
+		return fmt.Errorf("unable to find datasets: %s", res.Error)
+	}
+
+	replicated, err := providerReplicatedByDataset(dldm, p.ActorID)
+	if err != nil {
+		return err
+	}
+
+	available, err := core.CountUnreplicatedContentByDataset(dldm.DB, p.ActorID, false)
+	if err != nil {
+		return fmt.Errorf("unable to count available content: %s", err)
+	}
+
+	for _, d := range ds {
+		sd := SelfServiceDataset{
+			ID:               d.ID,
+			Name:             d.Name,
+			ReplicationQuota: d.ReplicationQuota,
+			DealDuration:     d.DealDuration,
+		}
+
+		for _, rp := range p.ReplicationProfiles {
+			if rp.DatasetID == d.ID {
+				sd.Unsealed = rp.Unsealed
+				sd.Indexed = rp.Indexed
+			}
+		}
+
+		if r, ok := replicated[d.ID]; ok {
+			sd.BytesReplicated = r.bytes
+			sd.CountReplicated = r.count
+		}
+		sd.CountAvailable = available[d.ID]
+
+		result = append(result, sd)
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// GET /api/self-service/limits
+// @description the provider's self-service limits, and how many pieces are available to it
+func handleSelfServiceLimits(c echo.Context, dldm *core.DeltaDM) error {
+	p := c.Get(PROVIDER).(db.Provider)
+
+	var activeReservations int64
+	res := dldm.DB.Model(&db.Reservation{}).Where("provider_actor_id = ? AND expires_at > ?", p.ActorID, time.Now()).Count(&activeReservations)
+	if res.Error != nil {
+		return fmt.Errorf("unable to count active reservations: %s", res.Error)
+	}
+
+	available, err := core.CountUnreplicatedContent(dldm.DB, p.ActorID, nil, false)
+	if err != nil {
+		return fmt.Errorf("unable to count available content: %s", err)
+	}
+
+	return c.JSON(http.StatusOK, SelfServiceLimits{
+		AllowSelfService:      p.AllowSelfService,
+		MaxBatchSize:          MAX_SELF_SERVICE_BATCH_SIZE,
+		MaxActiveReservations: core.MAX_ACTIVE_RESERVATIONS,
+		ActiveReservations:    uint(activeReservations),
+		MaxReservationHours:   uint(core.MAX_RESERVATION_DURATION.Hours()),
+		StartEpochDelay:       EpochBounds{Min: core.MIN_START_DELAY_DAYS, Max: core.MAX_START_DELAY_DAYS, Default: core.DEFAULT_START_DELAY_DAYS},
+		EndEpochAdvance:       EpochBounds{Min: 0, Max: core.MAX_END_ADVANCE_DAYS, Default: 0},
+		AvailableContent:      available,
+	})
+}
+
+type replicatedTotals struct {
+	bytes db.ByteSizes
+	count uint64
+}
+
+// Bytes and count of active (not failed or cancelled) replications to a provider, grouped by dataset
+func providerReplicatedByDataset(dldm *core.DeltaDM, providerActorID string) (map[uint]replicatedTotals, error) {
+	rows, err := dldm.DB.Raw(`
+  SELECT c.dataset_id, COALESCE(SUM(c.size), 0), COALESCE(SUM(c.padded_size), 0), COUNT(*)
+  FROM replications r
+  INNER JOIN contents c ON r.content_comm_p = c.comm_p
+  WHERE r.provider_actor_id = ? AND r.status NOT IN ? AND r.deleted_at IS NULL
+  GROUP BY c.dataset_id`, providerActorID, db.InactiveStatuses).Rows()
+	if err != nil {
+		return nil, fmt.Errorf("unable to compute replicated bytes: %s", err)
+	}
+	defer rows.Close()
+
+	result := make(map[uint]replicatedTotals)
+	for rows.Next() {
+		var datasetId uint
+		var t replicatedTotals
+		if err := rows.Scan(&datasetId, &t.bytes.Raw, &t.bytes.Padded, &t.count); err != nil {
+			return nil, fmt.Errorf("unable to compute replicated bytes: %s", err)
+		}
+		result[datasetId] = t
+	}
+
+	return result, nil
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/application-research/delta-dm/core"
 	db "github.com/application-research/delta-dm/db"
@@ -13,6 +12,11 @@ import (
 
 const PROVIDER = "PROVIDER"
 
+// Max number of deals that may be requested in a single self-service batch
+const MAX_SELF_SERVICE_BATCH_SIZE = 100
+
+const TIB = 1 << 40
+
 type SelfServiceResponse struct {
 	Cid             string `json:"cid"`
 	ContentLocation string `json:"content_location"`
@@ -25,10 +29,50 @@ func ConfigureSelfServiceRouter(e *echo.Group, dldm *core.DeltaDM) {
 
 	selfService.GET("/by-cid/:piece", func(c echo.Context) error {
 		return handleSelfServiceByCid(c, dldm)
-	})
+	}, reputationMiddleware(dldm))
 
 	selfService.GET("/by-dataset/:dataset", func(c echo.Context) error {
 		return handleSelfServiceByDataset(c, dldm)
+	}, reputationMiddleware(dldm))
+
+	selfService.POST("/batch", func(c echo.Context) error {
+		return handleSelfServiceBatch(c, dldm)
+	}, reputationMiddleware(dldm))
+
+	selfService.GET("/replications", func(c echo.Context) error {
+		return handleSelfServiceReplications(c, dldm)
+	})
+
+	selfService.GET("/datasets", func(c echo.Context) error {
+		return handleSelfServiceDatasets(c, dldm)
+	})
+
+	selfService.GET("/limits", func(c echo.Context) error {
+		return handleSelfServiceLimits(c, dldm)
+	})
+
+	selfService.GET("/reservations", func(c echo.Context) error {
+		return handleGetReservations(c, dldm)
+	})
+
+	selfService.POST("/reservations", func(c echo.Context) error {
+		return handlePostReservations(c, dldm)
+	}, reputationMiddleware(dldm))
+
+	selfService.PUT("/reservations/:id", func(c echo.Context) error {
+		return handleExtendReservation(c, dldm)
+	})
+
+	selfService.DELETE("/reservations/:id", func(c echo.Context) error {
+		return handleReleaseReservation(c, dldm)
+	})
+
+	selfService.GET("/telemetry/events", func(c echo.Context) error {
+		return handleSelfServiceTelemetryEvents(c, dldm)
+	})
+
+	selfService.GET("/telemetry/stats", func(c echo.Context) error {
+		return handleSelfServiceTelemetryStats(c, dldm)
 	})
 
 	selfService.PUT("/telemetry/:cid", func(c echo.Context) error {
@@ -41,6 +85,12 @@ func ConfigureSelfServiceRouter(e *echo.Group, dldm *core.DeltaDM) {
 }
 
 func selfServiceTokenMiddleware(dldm *core.DeltaDM) echo.MiddlewareFunc {
+	return providerTokenMiddleware(dldm, true)
+}
+
+// Authenticates a provider by its `X-DELTA-AUTH` key, and sets it on the context
+// If requireSelfService is true, only providers that are allowed to self-serve are let through
+func providerTokenMiddleware(dldm *core.DeltaDM, requireSelfService bool) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			providerToken := c.Request().Header.Get("X-DELTA-AUTH")
@@ -58,10 +108,9 @@ func selfServiceTokenMiddleware(dldm *core.DeltaDM) echo.MiddlewareFunc {
 			if p.ActorID == "" {
 				return c.String(401, "invalid provider self-service token")
 			}
-			if !p.AllowSelfService {
+			if requireSelfService && !p.AllowSelfService {
 				return c.String(401, "provider is not allowed to self-serve, please contact administrator to enable it")
 			}
-
 			c.Set(PROVIDER, p)
 
 			return next(c)
@@ -69,124 +118,105 @@ func selfServiceTokenMiddleware(dldm *core.DeltaDM) echo.MiddlewareFunc {
 	}
 }
 
+// Refuses providers whose reputation is below the policy, if one is set. Only routes that allocate content are gated,
+// so a provider can still report telemetry and release reservations, and its score can recover
+func reputationMiddleware(dldm *core.DeltaDM) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if dldm.ReputationPolicy == nil {
+				return next(c)
+			}
+
+			p := c.Get(PROVIDER).(db.Provider)
+			if err := dldm.ReputationPolicy.Check(dldm.DB, p.ActorID); err != nil {
+				return c.String(401, fmt.Sprintf("provider is not allowed to self-serve: %s", err))
+			}
+
+			return next(c)
+		}
+	}
+}
+
 // POST /api/self-service/by-cid/:piece
 // @param :piece Piece CID of content to replicate
 // @queryparam
 // @returns a slice of the CIDs
 func handleSelfServiceByCid(c echo.Context, dldm *core.DeltaDM) error {
 	piece := c.Param("piece")
-	startEpochDelay := c.QueryParam("start_epoch_delay")
-	endEpochAdvance := c.QueryParam("end_epoch_advance")
-
-	var delayDays uint64 = DEFAULT_DELAY_DAYS
-	var advanceDays uint64 = 0
 
-	if startEpochDelay != "" {
-		var err error
-		delayDays, err = strconv.ParseUint(startEpochDelay, 10, 64)
-		if err != nil {
-			return fmt.Errorf("unable to parse start_epoch_delay: %s", err)
-		}
+	delayDays, advanceDays, err := parseEpochQueryParams(c)
+	if err != nil {
+		return err
+	}
 
-		if delayDays < 1 || delayDays > 14 {
-			return fmt.Errorf("start_epoch_delay must be between 1 and 14 days")
-		}
+	if piece == "" {
+		return fmt.Errorf("must provide a piece CID")
 	}
 
-	if endEpochAdvance != "" {
-		var err error
-		advanceDays, err = strconv.ParseUint(endEpochAdvance, 10, 64)
+	p := c.Get(PROVIDER).(db.Provider)
+
+	plan, recorded, err := dldm.AllocateDeals(func() (*core.DealPlan, error) {
+		plan, err := dldm.PlanDeals(core.DealPlanOptions{
+			ProviderActorID: p.ActorID,
+			Pieces:          []string{piece},
+			StartDelayDays:  delayDays,
+			EndAdvanceDays:  advanceDays,
+			SelfService:     true,
+		})
 		if err != nil {
-			return fmt.Errorf("unable to parse end_epoch_advance: %s", err)
+			return nil, err
 		}
 
-		if advanceDays < 0 || advanceDays > 20 {
-			return fmt.Errorf("end_epoch_advance must be between 0 and 20 days")
+		if len(plan.Skipped) > 0 {
+			return nil, fmt.Errorf("%s. no deals were made", plan.Skipped[0].Reason)
 		}
-	}
 
-	if piece == "" {
-		return fmt.Errorf("must provide a piece CID")
+		return plan, nil
+	}, dldm.DAPI.ServiceAuthToken)
+	if err != nil {
+		return err
 	}
 
-	p := c.Get(PROVIDER).(db.Provider)
-
-	var cnt db.Content
-	res := dldm.DB.Model(&db.Content{}).Preload("Replications").Where("comm_p = ?", piece).Find(&cnt)
-	if res.Error != nil {
-		return fmt.Errorf("unable to make deal for this CID")
-	}
+	log.Debugf("calling DELTA api for deal\n\n")
 
-	var ds db.Dataset
-	res = dldm.DB.Model(&db.Dataset{}).Where("id = ?", cnt.DatasetID).Find(&ds)
-	if res.Error != nil {
-		return fmt.Errorf("unable to find dataset %d associated with requested CID", cnt.DatasetID)
+	_, err = dldm.SendDeals(recorded)
+	if err != nil {
+		return fmt.Errorf("unable to make deal for this CID: %w", err)
 	}
 
-	var rp db.ReplicationProfile
-	isAllowed := false
-	for _, thisRp := range p.ReplicationProfiles {
-		if thisRp.DatasetID == ds.ID {
-			isAllowed = true
-			rp = thisRp
-			break
-		}
+	location, err := dldm.ContentLocationFor(plan.Contents[piece], p.ActorID)
+	if err != nil {
+		return fmt.Errorf("deal was made, but unable to sign content location: %s", err)
 	}
 
-	if !isAllowed {
-		return fmt.Errorf("provider '%s' is not allowed to replicate dataset '%s'", p.ActorID, ds.Name)
-	}
+	return c.JSON(http.StatusOK, SelfServiceResponse{Cid: piece, ContentLocation: location})
+}
 
-	if cnt.NumReplications >= ds.ReplicationQuota {
-		return fmt.Errorf("content '%s' has reached its replication quota of %d", piece, ds.ReplicationQuota)
-	}
+// Parse the optional start_epoch_delay and end_epoch_advance query params, in days
+func parseEpochQueryParams(c echo.Context) (*uint64, *uint64, error) {
+	var delayDays, advanceDays *uint64
 
-	// Ensure no pending/successful replications have been made for this content to this provider
-	for _, repl := range cnt.Replications {
-		if repl.ProviderActorID == p.ActorID && !repl.Status.HasFailed() {
-			return fmt.Errorf("content '%s' is already replicated to provider '%s'", piece, p.ActorID)
+	if startEpochDelay := c.QueryParam("start_epoch_delay"); startEpochDelay != "" {
+		n, err := strconv.ParseUint(startEpochDelay, 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse start_epoch_delay: %s", err)
 		}
+		delayDays = &n
 	}
 
-	var dealsToMake core.OfflineDealRequest
-	log.Debugf("calling DELTA api for deal\n\n")
-
-	wallet, err := walletSelection(dldm.DB, &cnt.DatasetID)
-
-	if err != nil || wallet.Addr == "" {
-		return fmt.Errorf("dataset '%s' does not have a wallet. no deals were made. please contact administrator", ds.Name)
-	}
-
-	dealsToMake = append(dealsToMake, core.Deal{
-		PayloadCID: cnt.PayloadCID,
-		Wallet: db.Wallet{
-			Addr: wallet.Addr,
-		},
-		ConnectionMode:     "import",
-		Miner:              p.ActorID,
-		Size:               cnt.Size,
-		SkipIpniAnnounce:   !rp.Indexed,
-		RemoveUnsealedCopy: !rp.Unsealed,
-		DurationInDays:     ds.DealDuration - advanceDays,
-		StartEpochInDays:   delayDays,
-		PieceCommitment: core.PieceCommitment{
-			PieceCid:        cnt.CommP,
-			PaddedPieceSize: cnt.PaddedSize,
-		},
-	})
-
-	_, err = dldm.MakeDeals(dealsToMake, dldm.DAPI.ServiceAuthToken, true)
-	if err != nil {
-		return fmt.Errorf("unable to make deal for this CID: %s", err)
+	if endEpochAdvance := c.QueryParam("end_epoch_advance"); endEpochAdvance != "" {
+		n, err := strconv.ParseUint(endEpochAdvance, 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse end_epoch_advance: %s", err)
+		}
+		advanceDays = &n
 	}
 
-	return c.JSON(http.StatusOK, SelfServiceResponse{Cid: cnt.CommP, ContentLocation: cnt.ContentLocation})
+	return delayDays, advanceDays, nil
 }
 
 func handleSelfServiceByDataset(c echo.Context, dldm *core.DeltaDM) error {
 	dataset := c.Param("dataset")
-	startEpochDelay := c.QueryParam("start_epoch_delay")
-	endEpochAdvance := c.QueryParam("end_epoch_advance")
 
 	if dataset == "" {
 		return fmt.Errorf("must provide a dataset name")
@@ -198,92 +228,193 @@ func handleSelfServiceByDataset(c echo.Context, dldm *core.DeltaDM) error {
 		return fmt.Errorf("invalid dataset: %s", dsRes.Error)
 	}
 
-	var advanceDays uint64 = 0
-	var delayDays uint64 = DEFAULT_DELAY_DAYS
+	delayDays, advanceDays, err := parseEpochQueryParams(c)
+	if err != nil {
+		return err
+	}
+
+	strategy, err := core.ParseSelectionStrategy(c.QueryParam("strategy"))
+	if err != nil {
+		return err
+	}
 
-	if startEpochDelay != "" {
-		var err error
-		delayDays, err = strconv.ParseUint(startEpochDelay, 10, 64)
+	p := c.Get(PROVIDER).(db.Provider)
+
+	plan, recorded, err := dldm.AllocateDeals(func() (*core.DealPlan, error) {
+		// give one deal at a time
+		numDeals := uint(1)
+		plan, err := dldm.PlanDeals(core.DealPlanOptions{
+			ProviderActorID: p.ActorID,
+			DatasetID:       &ds.ID,
+			Count:           &numDeals,
+			StartDelayDays:  delayDays,
+			EndAdvanceDays:  advanceDays,
+			SelfService:     true,
+			Strategy:        strategy,
+		})
 		if err != nil {
-			return fmt.Errorf("unable to parse start_epoch_delay: %s", err)
+			return nil, err
 		}
 
-		if delayDays < 1 || delayDays > 14 {
-			return fmt.Errorf("start_epoch_delay must be between 1 and 14 days")
+		if len(plan.Skipped) > 0 {
+			return nil, fmt.Errorf("%s. no deals were made. please contact administrator", plan.Skipped[0].Reason)
 		}
-	}
 
-	if endEpochAdvance != "" {
-		var err error
-		advanceDays, err = strconv.ParseUint(endEpochAdvance, 10, 64)
-		if err != nil {
-			return fmt.Errorf("unable to parse end_epoch_advance: %s", err)
+		if len(plan.Deals) == 0 {
+			return nil, fmt.Errorf("no deals available for dataset")
 		}
 
-		if advanceDays < 0 || advanceDays > 20 {
-			return fmt.Errorf("end_epoch_advance must be between 0 and 20 days")
-		}
+		return plan, nil
+	}, dldm.DAPI.ServiceAuthToken)
+	if err != nil {
+		return err
 	}
 
-	p := c.Get(PROVIDER).(db.Provider)
+	piece := plan.Deals[0].PieceCommitment.PieceCid
 
-	isAllowed := false
-	for _, rp := range p.ReplicationProfiles {
-		if rp.DatasetID == ds.ID {
-			isAllowed = true
-			break
-		}
+	_, err = dldm.SendDeals(recorded)
+	if err != nil {
+		return fmt.Errorf("unable to make deal for this CID: %w", err)
 	}
 
-	if !isAllowed {
-		return fmt.Errorf("provider '%s' is not allowed to replicate dataset '%s'", p.ActorID, dataset)
+	location, err := dldm.ContentLocationFor(plan.Contents[piece], p.ActorID)
+	if err != nil {
+		return fmt.Errorf("deal was made, but unable to sign content location: %s", err)
 	}
 
-	// give one deal at a time
-	numDeals := uint(1)
-	cnt, err := findUnreplicatedContentForProvider(dldm.DB, p.ActorID, &ds.ID, &numDeals, false)
+	return c.JSON(http.StatusOK, SelfServiceResponse{Cid: piece, ContentLocation: location})
+}
+
+type SelfServiceBatchBody struct {
+	// Either a list of pieces...
+	Pieces []string `json:"pieces,omitempty"`
+	// ...or a dataset, with a count or amount of data (TiB) to replicate from it
+	Dataset         string   `json:"dataset,omitempty"`
+	Count           *uint    `json:"count,omitempty"`
+	NumTib          *float64 `json:"num_tib,omitempty"`
+	StartEpochDelay *uint64  `json:"start_epoch_delay,omitempty"`
+	EndEpochAdvance *uint64  `json:"end_epoch_advance,omitempty"`
+	Strategy        string   `json:"strategy,omitempty"` // order content is selected from the dataset in
+}
+
+type SelfServiceBatchResult struct {
+	Cid             string `json:"cid"`
+	Success         bool   `json:"success"`
+	ContentLocation string `json:"content_location,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// POST /api/self-service/batch
+// @description request deals for multiple pieces at once. all valid pieces are dealt in one call to delta
+// @returns the result for each piece
+func handleSelfServiceBatch(c echo.Context, dldm *core.DeltaDM) error {
+	var b SelfServiceBatchBody
+	if err := c.Bind(&b); err != nil {
+		return fmt.Errorf("unable to bind request: %s", err)
+	}
+
+	if len(b.Pieces) > 0 && b.Dataset != "" {
+		return fmt.Errorf("must provide either pieces or a dataset, not both")
+	}
+
+	p := c.Get(PROVIDER).(db.Provider)
+
+	strategy, err := core.ParseSelectionStrategy(b.Strategy)
 	if err != nil {
-		return fmt.Errorf("unable to find content for dataset: %s", err)
+		return err
 	}
 
-	if len(cnt) == 0 {
-		return fmt.Errorf("no deals available for dataset")
+	opts := core.DealPlanOptions{
+		ProviderActorID: p.ActorID,
+		StartDelayDays:  b.StartEpochDelay,
+		EndAdvanceDays:  b.EndEpochAdvance,
+		SelfService:     true,
+		Strategy:        strategy,
 	}
 
-	deal := cnt[0]
+	if len(b.Pieces) > 0 {
+		if len(b.Pieces) > MAX_SELF_SERVICE_BATCH_SIZE {
+			return fmt.Errorf("at most %d pieces may be requested in a batch", MAX_SELF_SERVICE_BATCH_SIZE)
+		}
+		opts.Pieces = b.Pieces
+	} else if b.Dataset != "" {
+		if b.Count == nil && b.NumTib == nil {
+			return fmt.Errorf("must provide a count or num_tib with a dataset")
+		}
+
+		var ds db.Dataset
+		dsRes := dldm.DB.Where("name = ?", b.Dataset).First(&ds)
+		if dsRes.Error != nil || ds.ID == 0 {
+			return fmt.Errorf("invalid dataset: %s", dsRes.Error)
+		}
+		opts.DatasetID = &ds.ID
 
-	wallet, err := walletSelection(dldm.DB, &ds.ID)
+		numDeals := uint(MAX_SELF_SERVICE_BATCH_SIZE)
+		if b.Count != nil {
+			if *b.Count < 1 || *b.Count > MAX_SELF_SERVICE_BATCH_SIZE {
+				return fmt.Errorf("count must be between 1 and %d", MAX_SELF_SERVICE_BATCH_SIZE)
+			}
+			numDeals = *b.Count
+		}
+		opts.Count = &numDeals
 
-	if err != nil || wallet.Addr == "" {
-		return fmt.Errorf("dataset '%s' does not have a wallet associated. no deals were made. please contact administrator", ds.Name)
+		// Take content until the requested amount of data is reached
+		if b.NumTib != nil {
+			if *b.NumTib <= 0 {
+				return fmt.Errorf("num_tib must be greater than 0")
+			}
+			opts.MaxBytes = uint64(*b.NumTib * TIB)
+		}
+	} else {
+		return fmt.Errorf("must provide either pieces or a dataset")
 	}
 
-	var dealsToMake []core.Deal
+	plan, recorded, err := dldm.AllocateDeals(func() (*core.DealPlan, error) {
+		plan, err := dldm.PlanDeals(opts)
+		if err != nil {
+			return nil, err
+		}
 
-	dealsToMake = append(dealsToMake, core.Deal{
-		PayloadCID: deal.PayloadCID,
-		Wallet: db.Wallet{
-			Addr: wallet.Addr,
-		},
-		ConnectionMode:     "import",
-		Miner:              p.ActorID,
-		Size:               deal.Size,
-		SkipIpniAnnounce:   !deal.Indexed,
-		RemoveUnsealedCopy: !deal.Unsealed,
-		DurationInDays:     deal.DealDuration - advanceDays,
-		StartEpochInDays:   delayDays,
-		PieceCommitment: core.PieceCommitment{
-			PieceCid:        deal.CommP,
-			PaddedPieceSize: deal.PaddedSize,
-		},
-	})
+		if opts.DatasetID != nil && len(plan.Deals) == 0 && len(plan.Skipped) == 0 {
+			return nil, fmt.Errorf("no deals available for dataset")
+		}
 
-	_, err = dldm.MakeDeals(dealsToMake, dldm.DAPI.ServiceAuthToken, true)
+		return plan, nil
+	}, dldm.DAPI.ServiceAuthToken)
 	if err != nil {
-		return fmt.Errorf("unable to make deal for this CID: %s", err)
+		return err
 	}
 
-	return c.JSON(http.StatusOK, SelfServiceResponse{Cid: deal.CommP, ContentLocation: deal.ContentLocation})
+	var results []SelfServiceBatchResult
+	for _, s := range plan.Skipped {
+		results = append(results, SelfServiceBatchResult{Cid: s.Cid, Error: s.Reason})
+	}
+
+	if recorded != nil {
+		deltaResp, err := dldm.SendDeals(recorded)
+		if err != nil {
+			return fmt.Errorf("unable to make deals: %w", err)
+		}
+
+		for _, dr := range *deltaResp {
+			piece := dr.DealRequestMeta.PieceCommitment.PieceCid
+
+			if dr.Status != "success" {
+				results = append(results, SelfServiceBatchResult{Cid: piece, Error: dr.Message})
+				continue
+			}
+
+			location, err := dldm.ContentLocationFor(plan.Contents[piece], p.ActorID)
+			if err != nil {
+				results = append(results, SelfServiceBatchResult{Cid: piece, Success: true, Error: fmt.Sprintf("deal was made, but unable to sign content location: %s", err)})
+				continue
+			}
+
+			results = append(results, SelfServiceBatchResult{Cid: piece, Success: true, ContentLocation: location})
+		}
+	}
+
+	return c.JSON(http.StatusOK, results)
 }
 
 type SelfServiceStatusUpdate struct {
@@ -302,28 +433,75 @@ func handleSelfServiceTelemetry(c echo.Context, dldm *core.DeltaDM) error {
 		return fmt.Errorf("must provide a deal_uuid")
 	}
 
-	var repl db.Replication
-	err := dldm.DB.Model(&repl).Where("deal_uuid = ?", update.DealUuid).First(&repl).Error
+	state, err := db.ParseSelfServiceStatus(update.State)
+	if err != nil {
+		return err
+	}
 
+	repl, err := findProviderReplicationByDealUuid(c, dldm, update.DealUuid)
 	if err != nil {
-		return fmt.Errorf("unable to find content for CID: %s", err)
+		return err
+	}
+
+	err = core.UpdateSelfServiceState(dldm.DB, repl, state, update.Message)
+	if err != nil {
+		return fmt.Errorf("unable to update deal status: %s", err)
+	}
+
+	return nil
+}
+
+// GET /api/self-service/telemetry/events
+// @queryparam deal_uuid the deal to get the state history of
+// @returns the state changes reported for the deal, in order
+func handleSelfServiceTelemetryEvents(c echo.Context, dldm *core.DeltaDM) error {
+	dealUuid := c.QueryParam("deal_uuid")
+	if dealUuid == "" {
+		return fmt.Errorf("must provide a deal_uuid")
+	}
+
+	repl, err := findProviderReplicationByDealUuid(c, dldm, dealUuid)
+	if err != nil {
+		return err
+	}
+
+	var events []db.SelfServiceEvent
+	res := dldm.DB.Model(&db.SelfServiceEvent{}).Where("replication_id = ?", repl.ID).Order("timestamp ASC, id ASC").Find(&events)
+	if res.Error != nil {
+		return fmt.Errorf("unable to find telemetry events: %s", res.Error)
 	}
 
+	return c.JSON(http.StatusOK, events)
+}
+
+// GET /api/self-service/telemetry/stats
+// @returns the median time the provider's deals spend in each state
+func handleSelfServiceTelemetryStats(c echo.Context, dldm *core.DeltaDM) error {
 	p := c.Get(PROVIDER).(db.Provider)
-	if repl.ProviderActorID != p.ActorID {
-		return fmt.Errorf("deal '%s' does not belong to provider '%s'", update.DealUuid, p.ActorID)
+
+	stats, err := core.ProviderTimeInState(dldm.DB, p.ActorID)
+	if err != nil {
+		return err
 	}
 
-	repl.SelfService.LastUpdate = time.Now()
-	repl.SelfService.Status = update.State
-	repl.SelfService.Message = update.Message
+	return c.JSON(http.StatusOK, stats)
+}
+
+// Find a replication by deal UUID, ensuring it belongs to the requesting provider
+func findProviderReplicationByDealUuid(c echo.Context, dldm *core.DeltaDM, dealUuid string) (*db.Replication, error) {
+	var repl db.Replication
+	err := dldm.DB.Model(&repl).Where("deal_uuid = ?", dealUuid).First(&repl).Error
 
-	err = dldm.DB.Save(&repl).Error
 	if err != nil {
-		return fmt.Errorf("unable to update deal status: %s", err)
+		return nil, fmt.Errorf("unable to find deal %s: %s", dealUuid, err)
 	}
 
-	return nil
+	p := c.Get(PROVIDER).(db.Provider)
+	if repl.ProviderActorID != p.ActorID {
+		return nil, fmt.Errorf("deal '%s' does not belong to provider '%s'", dealUuid, p.ActorID)
+	}
+
+	return &repl, nil
 }
 
 type AvailableContent struct {
@@ -346,8 +524,8 @@ func handleSelfServiceAvailableContents(c echo.Context, dldm *core.DeltaDM) erro
 			return fmt.Errorf("unable to parse limit: %s", err)
 		}
 
-		if numDeals > 2000 {
-			return fmt.Errorf("limit must be less than 2000")
+		if n > 2000 {
+			return &HttpError{Code: http.StatusBadRequest, Reason: http.StatusText(http.StatusBadRequest), Details: "limit must be at most 2000"}
 		}
 
 		numDeals = uint(n)
@@ -355,7 +533,12 @@ func handleSelfServiceAvailableContents(c echo.Context, dldm *core.DeltaDM) erro
 		numDeals = uint(500)
 	}
 
-	cnt, err := findUnreplicatedContentForProvider(dldm.DB, p.ActorID, nil, &numDeals, true)
+	strategy, err := core.ParseSelectionStrategy(c.QueryParam("strategy"))
+	if err != nil {
+		return err
+	}
+
+	cnt, err := core.FindUnreplicatedContent(dldm.DB, p.ActorID, nil, &numDeals, strategy, true)
 
 	if err != nil {
 		return fmt.Errorf("unable to find content for dataset: %s", err)
@@ -364,12 +547,17 @@ func handleSelfServiceAvailableContents(c echo.Context, dldm *core.DeltaDM) erro
 	var result []AvailableContent
 
 	for _, deal := range cnt {
+		location, err := dldm.ContentLocationFor(deal.Content, p.ActorID)
+		if err != nil {
+			return fmt.Errorf("unable to sign content location for %s: %s", deal.CommP, err)
+		}
+
 		result = append(result, AvailableContent{
 			PayloadCID:      deal.PayloadCID,
 			PieceCID:        deal.CommP,
 			Size:            deal.Size,
 			PaddedSize:      deal.PaddedSize,
-			ContentLocation: deal.ContentLocation,
+			ContentLocation: location,
 		})
 	}
 
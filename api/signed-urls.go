@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/application-research/delta-dm/core"
+	"github.com/labstack/echo/v4"
+)
+
+// Verification routes for signed content URLs. These are intentionally unauthenticated, so that
+// CAR file hosts can validate a download request before serving it
+func ConfigureSignedUrlsRouter(e *echo.Group, dldm *core.DeltaDM) {
+	signedUrls := e.Group("/signed-urls")
+
+	signedUrls.GET("/verify", func(c echo.Context) error {
+		return handleVerifySignedUrl(c, dldm)
+	})
+}
+
+// GET /api/v1/signed-urls/verify
+// @queryparam url the full signed URL that was requested from the CAR host
+// @returns the claims of the URL if it is valid, otherwise 403
+func handleVerifySignedUrl(c echo.Context, dldm *core.DeltaDM) error {
+	if dldm.Signer == nil {
+		return &HttpError{
+			Code:   http.StatusNotFound,
+			Reason: "url signing is not enabled on this ddm instance",
+		}
+	}
+
+	signedUrl := c.QueryParam("url")
+	if signedUrl == "" {
+		return &HttpError{
+			Code:   http.StatusBadRequest,
+			Reason: "must provide a url",
+		}
+	}
+
+	claims, err := dldm.Signer.Verify(signedUrl)
+	if err != nil {
+		return &HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  "invalid signed url",
+			Details: err.Error(),
+		}
+	}
+
+	return c.JSON(http.StatusOK, claims)
+}
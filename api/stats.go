@@ -0,0 +1,110 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/application-research/delta-dm/core"
+	db "github.com/application-research/delta-dm/db"
+	"github.com/labstack/echo/v4"
+)
+
+// How far back the timeseries goes if `from` is not specified
+const DEFAULT_STATS_RANGE = 30 * 24 * time.Hour
+
+func ConfigureStatsRouter(e *echo.Group, dldm *core.DeltaDM) {
+	stats := e.Group("/stats")
+
+	stats.Use(dldm.AS.AuthMiddleware)
+
+	stats.GET("/timeseries", func(c echo.Context) error {
+		return handleGetStatsTimeseries(c, dldm)
+	})
+}
+
+// GET /api/stats/timeseries
+// @description get snapshots of dataset or provider stats over time, for charting
+// @queryparam entity dataset or provider for all of them, or dataset:<name> / provider:<actor id> for one (required)
+// @queryparam from start of the range, RFC3339. defaults to 30 days before `to`
+// @queryparam to end of the range, RFC3339. defaults to now
+// @queryparam interval only return the last snapshot in each interval, i.e 1h or 1d
+func handleGetStatsTimeseries(c echo.Context, dldm *core.DeltaDM) error {
+	q, err := extractStatsTimeseriesQuery(c)
+	if err != nil {
+		return &HttpError{Code: http.StatusBadRequest, Reason: http.StatusText(http.StatusBadRequest), Details: err.Error()}
+	}
+
+	series, err := core.StatsTimeseries(dldm.DB, q)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, series)
+}
+
+func extractStatsTimeseriesQuery(c echo.Context) (core.StatsTimeseriesQuery, error) {
+	var q core.StatsTimeseriesQuery
+
+	entityType, entityID, _ := strings.Cut(c.QueryParam("entity"), ":")
+	switch db.StatsEntityType(entityType) {
+	case db.StatsEntityDataset, db.StatsEntityProvider:
+		q.EntityType = db.StatsEntityType(entityType)
+		q.EntityID = entityID
+	default:
+		return q, fmt.Errorf("invalid entity '%s', must be dataset, provider, dataset:<name> or provider:<actor id>", c.QueryParam("entity"))
+	}
+
+	q.To = time.Now().UTC()
+	if to := c.QueryParam("to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return q, fmt.Errorf("invalid to '%s', must be an RFC3339 time", to)
+		}
+		q.To = t
+	}
+
+	q.From = q.To.Add(-DEFAULT_STATS_RANGE)
+	if from := c.QueryParam("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return q, fmt.Errorf("invalid from '%s', must be an RFC3339 time", from)
+		}
+		q.From = t
+	}
+
+	if q.From.After(q.To) {
+		return q, fmt.Errorf("from must be before to")
+	}
+
+	if interval := c.QueryParam("interval"); interval != "" {
+		d, err := parseStatsInterval(interval)
+		if err != nil {
+			return q, err
+		}
+		q.Interval = d
+	}
+
+	return q, nil
+}
+
+// Parse an interval as a Go duration (i.e 90m, 6h), or a number of days (i.e 1d, 7d)
+func parseStatsInterval(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if strings.HasSuffix(s, "d") {
+		var n uint64
+		n, err = strconv.ParseUint(strings.TrimSuffix(s, "d"), 10, 32)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid interval '%s', must be a positive duration such as 1h or 1d", s)
+	}
+
+	return d, nil
+}
@@ -82,12 +82,27 @@ type PostWalletBodyHex struct {
 
 // POST /api/wallet
 // @description add/import a wallet
+// @queryparam delta_node name of the delta node to register the wallet with, if not the daemon's own. a wallet must be registered with every node that makes deals with it
 // @returns newly added wallet info
 func handleAddWallet(c echo.Context, dldm *core.DeltaDM) error {
 	authKey := c.Get(core.AUTH_KEY).(string)
 
 	isHex := c.QueryParam("hex")
 
+	dapi := dldm.DAPI
+	nodeName := c.QueryParam("delta_node")
+	if nodeName != "" && nodeName != core.DEFAULT_DELTA_NODE_NAME {
+		id, ok := dldm.Nodes.Lookup(nodeName)
+		if !ok {
+			return &HttpError{Code: http.StatusBadRequest, Reason: http.StatusText(http.StatusBadRequest), Details: fmt.Sprintf("no delta node named %s", nodeName)}
+		}
+		var err error
+		if dapi, err = dldm.Nodes.Get(id); err != nil {
+			return err
+		}
+		authKey = dapi.ServiceAuthToken
+	}
+
 	var deltaResp *core.RegisterWalletResponse
 
 	if isHex == "true" {
@@ -97,9 +112,9 @@ func handleAddWallet(c echo.Context, dldm *core.DeltaDM) error {
 			return fmt.Errorf("failed to bind hex input")
 		}
 
-		deltaResp, err = dldm.DAPI.AddWalletByHexKey(core.RegisterWalletHexRequest(w), authKey)
+		deltaResp, err = dapi.AddWalletByHexKey(core.RegisterWalletHexRequest(w), authKey)
 		if err != nil {
-			return fmt.Errorf("could not add wallet %s", err)
+			return fmt.Errorf("could not add wallet %w", err)
 		}
 		if deltaResp.WalletAddr == "" {
 			return fmt.Errorf("could not add wallet, got no address back from delta. check wallet hex. delta response: %s", deltaResp.Message)
@@ -112,12 +127,12 @@ func handleAddWallet(c echo.Context, dldm *core.DeltaDM) error {
 			return fmt.Errorf("failed to bind wallet input")
 		}
 
-		deltaResp, err = dldm.DAPI.AddWalletByPrivateKey(core.RegisterWalletRequest{
+		deltaResp, err = dapi.AddWalletByPrivateKey(core.RegisterWalletRequest{
 			Type:       w.Type,
 			PrivateKey: w.PrivateKey,
 		}, authKey)
 		if err != nil {
-			return fmt.Errorf("could not add wallet %s", err)
+			return fmt.Errorf("could not add wallet %w", err)
 		}
 		if deltaResp.WalletAddr == "" {
 			return fmt.Errorf("could not add wallet, got no address back from delta. check key format and type. delta response: %s", deltaResp.Message)
@@ -128,6 +143,15 @@ func handleAddWallet(c echo.Context, dldm *core.DeltaDM) error {
 		Addr: deltaResp.WalletAddr,
 	}
 
+	// A wallet already registered with another node is only registered with this one
+	if nodeName != "" {
+		res := dldm.DB.Model(db.Wallet{}).Where("addr = ?", newWallet.Addr).FirstOrCreate(&newWallet)
+		if res.Error != nil {
+			return res.Error
+		}
+		return c.JSON(http.StatusOK, newWallet)
+	}
+
 	res := dldm.DB.Model(db.Wallet{}).Create(&newWallet)
 	if res.Error != nil {
 		if res.Error.Error() == "UNIQUE constraint failed: wallets.addr" {
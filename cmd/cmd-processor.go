@@ -3,9 +3,12 @@ package cmd
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 
 	"github.com/urfave/cli/v2"
 )
@@ -113,3 +116,64 @@ func (c *CmdProcessor) MakeRequest(method string, url string, raw []byte) ([]byt
 
 	return body, resp.Body.Close, nil
 }
+
+// Make a request, copying the response body to w as it is received. Used for large responses, such as reports
+func (c *CmdProcessor) DownloadRequest(method string, url string, w io.Writer) error {
+	req, err := http.NewRequest(method, c.ddmUrl+url, nil)
+	if err != nil {
+		return fmt.Errorf("could not construct http request %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.ddmAuthKey)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not make http request %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%s", string(body))
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Flags for pagination and field selection on list commands
+func listFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "max number of results to return",
+		},
+		&cli.IntFlag{
+			Name:  "offset",
+			Usage: "number of results to skip",
+		},
+		&cli.StringFlag{
+			Name:  "fields",
+			Usage: "comma-separated fields to return",
+		},
+	}
+}
+
+// Query params for the flags from listFlags
+func listParams(c *cli.Context) url.Values {
+	params := url.Values{}
+	if c.IsSet("limit") {
+		params.Set("limit", strconv.Itoa(c.Int("limit")))
+	}
+	if c.IsSet("offset") {
+		params.Set("offset", strconv.Itoa(c.Int("offset")))
+	}
+	if fields := c.String("fields"); fields != "" {
+		params.Set("fields", fields)
+	}
+	return params
+}
@@ -2,9 +2,12 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/application-research/delta-dm/api"
 	"github.com/application-research/delta-dm/core"
+	"github.com/application-research/delta-dm/db"
 	"github.com/application-research/delta-dm/util"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -14,23 +17,40 @@ func DaemonCmd(di core.DeploymentInfo) []*cli.Command {
 	var debug bool = false
 	var dryRun bool = false
 	var dbConnStr string
+	var dbPool db.PoolOptions
+	var noAutoMigrate bool
 	var deltaApi string
 	var deltaAuthToken string
+	var deltaOpts core.DeltaClientOptions
 	var authServer string
 	var port uint
+	var urlSigningKey string
+	var urlSigningTtl time.Duration
+	var carDir string
+	var carStoreUrl string
+	var carStoreAuth string
+	var carPublicUrl string
+	var carBandwidthLimit uint64
+	var minProviderScore float64
+	var minProviderScoreSamples uint64
+	var reportDir string
+	var reportInterval time.Duration
+	var reportFormat string
+	var statsInterval time.Duration
+	var backupDir string
+	var backupInterval time.Duration
+	var backupKeep int
 
 	var daemonCommands []*cli.Command
 	daemonCmd := &cli.Command{
 		Name:  "daemon",
 		Usage: "A server-side application for orchestrating dataset dealmaking to Filecoin SPs",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:        "db",
-				Usage:       "connection string for postgres db or sqlite db filename",
-				EnvVars:     []string{"DB_DSN"},
-				DefaultText: "delta-dm.db",
-				Value:       "delta-dm.db",
-				Destination: &dbConnStr,
+		Flags: append(databaseFlags(&dbConnStr, &dbPool),
+			&cli.BoolFlag{
+				Name:        "no-auto-migrate",
+				Usage:       "refuse to start if the database has pending migrations, instead of applying them. apply them with `ddm db migrate up`",
+				EnvVars:     []string{"DB_NO_AUTO_MIGRATE"},
+				Destination: &noAutoMigrate,
 			},
 			&cli.UintFlag{
 				Name:        "port",
@@ -55,6 +75,41 @@ func DaemonCmd(di core.DeploymentInfo) []*cli.Command {
 				Required:    true,
 				Destination: &deltaAuthToken,
 			},
+			&cli.DurationFlag{
+				Name:        "delta-timeout",
+				Usage:       "max time for a request to delta, except e2e deal uploads",
+				EnvVars:     []string{"DELTA_TIMEOUT"},
+				Value:       core.DefaultDeltaClientOptions.Timeout,
+				Destination: &deltaOpts.Timeout,
+			},
+			&cli.DurationFlag{
+				Name:        "delta-connect-timeout",
+				Usage:       "max time to connect to delta",
+				EnvVars:     []string{"DELTA_CONNECT_TIMEOUT"},
+				Value:       core.DefaultDeltaClientOptions.ConnectTimeout,
+				Destination: &deltaOpts.ConnectTimeout,
+			},
+			&cli.IntFlag{
+				Name:        "delta-retries",
+				Usage:       "times to retry idempotent requests to delta (reads and deal status lookups) if it can't be reached",
+				EnvVars:     []string{"DELTA_RETRIES"},
+				Value:       core.DefaultDeltaClientOptions.Retries,
+				Destination: &deltaOpts.Retries,
+			},
+			&cli.IntFlag{
+				Name:        "delta-breaker-threshold",
+				Usage:       "pause requests to a delta node after this many in a row fail to reach it, failing them with 503 Delta unavailable. 0 to disable",
+				EnvVars:     []string{"DELTA_BREAKER_THRESHOLD"},
+				Value:       core.DefaultDeltaClientOptions.BreakerThreshold,
+				Destination: &deltaOpts.BreakerThreshold,
+			},
+			&cli.DurationFlag{
+				Name:        "delta-breaker-cooldown",
+				Usage:       "how long requests to a delta node are paused for, before one is let through to try it again",
+				EnvVars:     []string{"DELTA_BREAKER_COOLDOWN"},
+				Value:       core.DefaultDeltaClientOptions.BreakerCooldown,
+				Destination: &deltaOpts.BreakerCooldown,
+			},
 			&cli.StringFlag{
 				Name:        "auth-server",
 				Usage:       "auth server URL. defaults to official Estuary auth service. specify to use custom auth server",
@@ -63,6 +118,115 @@ func DaemonCmd(di core.DeploymentInfo) []*cli.Command {
 				Value:       "https://auth.estuary.tech",
 				Destination: &authServer,
 			},
+			&cli.StringFlag{
+				Name:        "url-signing-key",
+				Usage:       "secret key used to sign content locations handed out to providers. if unset, content locations are returned as-is",
+				EnvVars:     []string{"URL_SIGNING_KEY"},
+				Destination: &urlSigningKey,
+			},
+			&cli.DurationFlag{
+				Name:        "url-signing-ttl",
+				Usage:       "how long signed content locations remain valid",
+				EnvVars:     []string{"URL_SIGNING_TTL"},
+				DefaultText: "24h",
+				Value:       24 * time.Hour,
+				Destination: &urlSigningTtl,
+			},
+			&cli.StringFlag{
+				Name:        "car-dir",
+				Usage:       "enables the built-in car server, serving <piece>.car files from this local directory",
+				EnvVars:     []string{"CAR_DIR"},
+				Destination: &carDir,
+			},
+			&cli.StringFlag{
+				Name:        "car-store-url",
+				Usage:       "enables the built-in car server, serving <piece>.car files from this object store (s3-compatible) or http base url",
+				EnvVars:     []string{"CAR_STORE_URL"},
+				Destination: &carStoreUrl,
+			},
+			&cli.StringFlag{
+				Name:        "car-store-auth",
+				Usage:       "value of the Authorization header sent to the car store url, if it requires one",
+				EnvVars:     []string{"CAR_STORE_AUTH"},
+				Destination: &carStoreAuth,
+			},
+			&cli.StringFlag{
+				Name:        "car-public-url",
+				Usage:       "public base url of this ddm instance. if set, content with no content_location is handed out with a location on the built-in car server",
+				EnvVars:     []string{"CAR_PUBLIC_URL"},
+				Destination: &carPublicUrl,
+			},
+			&cli.Uint64Flag{
+				Name:        "car-bandwidth-limit",
+				Usage:       "max bytes per second the built-in car server will send to each provider. 0 for unlimited",
+				EnvVars:     []string{"CAR_BANDWIDTH_LIMIT"},
+				DefaultText: "0",
+				Destination: &carBandwidthLimit,
+			},
+			&cli.Float64Flag{
+				Name:        "min-provider-score",
+				Usage:       "reputation score (0-100) a provider must have to self-serve. 0 to disable",
+				EnvVars:     []string{"MIN_PROVIDER_SCORE"},
+				DefaultText: "0",
+				Destination: &minProviderScore,
+			},
+			&cli.Uint64Flag{
+				Name:        "min-provider-score-samples",
+				Usage:       "number of finished deals a provider must have in the scoring window before --min-provider-score applies to it",
+				EnvVars:     []string{"MIN_PROVIDER_SCORE_SAMPLES"},
+				Value:       core.DEFAULT_REPUTATION_MIN_SAMPLES,
+				Destination: &minProviderScoreSamples,
+			},
+			&cli.StringFlag{
+				Name:        "report-dir",
+				Usage:       "enables scheduled replications reports, written to this local directory",
+				EnvVars:     []string{"REPORT_DIR"},
+				Destination: &reportDir,
+			},
+			&cli.DurationFlag{
+				Name:        "report-interval",
+				Usage:       "how often scheduled replications reports are written",
+				EnvVars:     []string{"REPORT_INTERVAL"},
+				DefaultText: "24h",
+				Value:       24 * time.Hour,
+				Destination: &reportInterval,
+			},
+			&cli.StringFlag{
+				Name:        "report-format",
+				Usage:       "format of scheduled replications reports: csv, ndjson or parquet",
+				EnvVars:     []string{"REPORT_FORMAT"},
+				Value:       "csv",
+				Destination: &reportFormat,
+			},
+			&cli.DurationFlag{
+				Name:        "stats-interval",
+				Usage:       "how often dataset and provider stats are snapshotted, for GET /stats/timeseries. 0 to disable",
+				EnvVars:     []string{"STATS_INTERVAL"},
+				DefaultText: "1h",
+				Value:       time.Hour,
+				Destination: &statsInterval,
+			},
+			&cli.StringFlag{
+				Name:        "backup-dir",
+				Usage:       "enables scheduled database backups, written to this local directory",
+				EnvVars:     []string{"BACKUP_DIR"},
+				Destination: &backupDir,
+			},
+			&cli.DurationFlag{
+				Name:        "backup-interval",
+				Usage:       "how often scheduled database backups are taken",
+				EnvVars:     []string{"BACKUP_INTERVAL"},
+				DefaultText: "24h",
+				Value:       24 * time.Hour,
+				Destination: &backupInterval,
+			},
+			&cli.IntFlag{
+				Name:        "backup-keep",
+				Usage:       "number of scheduled backups to keep in --backup-dir, removing older ones. 0 to keep all",
+				EnvVars:     []string{"BACKUP_KEEP"},
+				Value:       7,
+				Destination: &backupKeep,
+			},
 			&cli.BoolFlag{
 				Name:        "debug",
 				Usage:       "set to enable debug logging output",
@@ -74,7 +238,7 @@ func DaemonCmd(di core.DeploymentInfo) []*cli.Command {
 				Usage:       "don't actually make deals (for development and testing)",
 				Destination: &dryRun,
 			},
-		},
+		),
 
 		Action: func(cctx *cli.Context) error {
 			if debug {
@@ -89,8 +253,50 @@ func DaemonCmd(di core.DeploymentInfo) []*cli.Command {
 				fmt.Println(util.Yellow + "Running in dry-run mode. No deals will be made." + util.Reset)
 			}
 
-			dldm := core.NewDeltaDM(dbConnStr, deltaApi, deltaAuthToken, authServer, di, debug, dryRun)
+			deltaOpts.RetryBackoff = core.DefaultDeltaClientOptions.RetryBackoff
+			dldm := core.NewDeltaDM(dbConnStr, dbPool, !noAutoMigrate, deltaApi, deltaAuthToken, deltaOpts, authServer, di, debug, dryRun)
+			if urlSigningKey != "" {
+				dldm.Signer = core.NewURLSigner(urlSigningKey, urlSigningTtl)
+			}
+
+			if carDir != "" && carStoreUrl != "" {
+				return fmt.Errorf("only one of --car-dir or --car-store-url may be specified")
+			}
+			if carDir != "" {
+				store, err := core.NewLocalCarStore(carDir)
+				if err != nil {
+					return err
+				}
+				dldm.CarServer = core.NewCarServer(store, strings.TrimSuffix(carPublicUrl, "/"), carBandwidthLimit)
+			} else if carStoreUrl != "" {
+				store := core.NewHttpCarStore(carStoreUrl, carStoreAuth)
+				dldm.CarServer = core.NewCarServer(store, strings.TrimSuffix(carPublicUrl, "/"), carBandwidthLimit)
+			}
+			if minProviderScore > 0 {
+				dldm.ReputationPolicy = core.NewReputationPolicy(minProviderScore, minProviderScoreSamples)
+			}
+			if reportDir != "" {
+				format, err := core.ParseExportFormat(reportFormat)
+				if err != nil {
+					return err
+				}
+				if err := dldm.ScheduleReports(reportDir, format, reportInterval); err != nil {
+					return err
+				}
+			}
+			if statsInterval > 0 {
+				dldm.ScheduleStatsSnapshots(statsInterval)
+			}
+			if backupDir != "" {
+				if err := dldm.ScheduleBackups(backupDir, backupInterval, backupKeep); err != nil {
+					return err
+				}
+			}
+			if err := dldm.RunE2ETransfers(); err != nil {
+				return err
+			}
 			dldm.WatchReplications()
+			dldm.WatchDeltaNodes()
 			api.InitializeEchoRouterConfig(dldm, port)
 			api.LoopForever()
 
@@ -14,6 +14,8 @@ func DatasetCmd() []*cli.Command {
 	var datasetName string
 	var replicationQuota uint64
 	var dealDuration uint64
+	var budget string
+	var connectionMode string
 
 	var datasetCmds []*cli.Command
 	datasetCmd := &cli.Command{
@@ -47,6 +49,17 @@ func DatasetCmd() []*cli.Command {
 						Value:       540,
 						Destination: &dealDuration,
 					},
+					&cli.StringFlag{
+						Name:        "budget",
+						Usage:       "max total spend on deals for the dataset, in attoFIL. unlimited if not set",
+						Destination: &budget,
+					},
+					&cli.StringFlag{
+						Name:        "connection-mode",
+						Usage:       "import (offline) or e2e (online) deals",
+						Value:       "import",
+						Destination: &connectionMode,
+					},
 				},
 				Action: func(c *cli.Context) error {
 					cmd, err := NewCmdProcessor(c)
@@ -62,6 +75,8 @@ func DatasetCmd() []*cli.Command {
 						Name:             datasetName,
 						ReplicationQuota: replicationQuota,
 						DealDuration:     dealDuration,
+						Budget:           budget,
+						ConnectionMode:   db.ConnectionMode(connectionMode),
 					}
 
 					b, err := json.Marshal(body)
@@ -83,13 +98,14 @@ func DatasetCmd() []*cli.Command {
 			{
 				Name:  "list",
 				Usage: "list datasets",
+				Flags: listFlags(),
 				Action: func(c *cli.Context) error {
 					cmd, err := NewCmdProcessor(c)
 					if err != nil {
 						return err
 					}
 
-					res, closer, err := cmd.MakeRequest(http.MethodGet, "/api/v1/datasets", nil)
+					res, closer, err := cmd.MakeRequest(http.MethodGet, "/api/v1/datasets?"+listParams(c).Encode(), nil)
 					if err != nil {
 						return fmt.Errorf("unable to make request %s", err)
 					}
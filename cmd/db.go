@@ -0,0 +1,383 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/application-research/delta-dm/core"
+	"github.com/application-research/delta-dm/db"
+	"github.com/urfave/cli/v2"
+	"gorm.io/gorm"
+)
+
+// Flags for connecting to the database, shared by the daemon and the db commands
+func databaseFlags(dsn *string, pool *db.PoolOptions) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "db",
+			Usage:       "database connection string: postgres://..., postgresql://..., sqlite://<file>, file:<file> or a sqlite db filename",
+			EnvVars:     []string{"DB_DSN"},
+			DefaultText: "delta-dm.db",
+			Value:       "delta-dm.db",
+			Destination: dsn,
+		},
+		&cli.IntFlag{
+			Name:        "db-max-open-conns",
+			Usage:       "max open connections to the database. 0 for unlimited",
+			EnvVars:     []string{"DB_MAX_OPEN_CONNS"},
+			Destination: &pool.MaxOpenConns,
+		},
+		&cli.IntFlag{
+			Name:        "db-max-idle-conns",
+			Usage:       "max idle connections kept open to the database. 0 for the driver default (2)",
+			EnvVars:     []string{"DB_MAX_IDLE_CONNS"},
+			Destination: &pool.MaxIdleConns,
+		},
+		&cli.DurationFlag{
+			Name:        "db-conn-max-lifetime",
+			Usage:       "close database connections after they have been open this long. 0 to keep them open",
+			EnvVars:     []string{"DB_CONN_MAX_LIFETIME"},
+			Destination: &pool.ConnMaxLifetime,
+		},
+		&cli.DurationFlag{
+			Name:        "db-conn-max-idle-time",
+			Usage:       "close database connections after they have been idle this long. 0 to keep them open",
+			EnvVars:     []string{"DB_CONN_MAX_IDLE_TIME"},
+			Destination: &pool.ConnMaxIdleTime,
+		},
+		&cli.DurationFlag{
+			Name:        "db-connect-timeout",
+			Usage:       "how long to wait for the database to respond when connecting",
+			EnvVars:     []string{"DB_CONNECT_TIMEOUT"},
+			DefaultText: "10s",
+			Value:       10 * time.Second,
+			Destination: &pool.ConnectTimeout,
+		},
+	}
+}
+
+// Connect to a database that must already exist, without migrating it
+func connectExisting(dbConnStr string, pool db.PoolOptions) (*gorm.DB, db.DSN, error) {
+	dsn, err := db.ParseDSN(dbConnStr)
+	if err != nil {
+		return nil, dsn, err
+	}
+
+	// Opening a sqlite database creates the file if it is missing
+	if dsn.Driver == db.DriverSqlite && !strings.HasPrefix(dsn.Conn, "file:") {
+		if _, err := os.Stat(dsn.Conn); err != nil {
+			return nil, dsn, fmt.Errorf("unable to open sqlite database: %s", err)
+		}
+	}
+
+	dbi, err := db.Connect(dbConnStr, pool, false)
+	return dbi, dsn, err
+}
+
+func closeDatabase(dbi *gorm.DB) {
+	if sqlDB, err := dbi.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+func printMigrationVersion(dbi *gorm.DB) error {
+	version, pending, err := db.MigrationVersion(dbi)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("migration version: %s\n", version)
+	if len(pending) > 0 {
+		fmt.Printf("pending migrations: %s\n", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+func DbCmd() []*cli.Command {
+	var dbConnStr string
+	var dbPool db.PoolOptions
+
+	var dbCmds []*cli.Command
+	dbCmd := &cli.Command{
+		Name:  "db",
+		Usage: "Database Commands (these connect to the database directly, not through the daemon)",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "check",
+				Usage: "check the database is reachable and report its migration version",
+				Flags: databaseFlags(&dbConnStr, &dbPool),
+				Action: func(c *cli.Context) error {
+					dbi, dsn, err := connectExisting(dbConnStr, dbPool)
+					if err != nil {
+						return err
+					}
+					defer closeDatabase(dbi)
+
+					version, pending, err := db.MigrationVersion(dbi)
+					if err != nil {
+						return err
+					}
+
+					fmt.Printf("driver: %s\n", dsn.Driver)
+					fmt.Printf("connection: ok\n")
+					if version == "" {
+						fmt.Printf("migration version: none (database not initialized)\n")
+					} else {
+						fmt.Printf("migration version: %s\n", version)
+					}
+					if len(pending) > 0 {
+						fmt.Printf("pending migrations: %s\n", strings.Join(pending, ", "))
+					} else {
+						fmt.Printf("pending migrations: none\n")
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:  "migrate",
+				Usage: "show, apply or roll back schema migrations",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "status",
+						Usage: "list migrations, and whether each has been applied",
+						Flags: databaseFlags(&dbConnStr, &dbPool),
+						Action: func(c *cli.Context) error {
+							dbi, _, err := connectExisting(dbConnStr, dbPool)
+							if err != nil {
+								return err
+							}
+							defer closeDatabase(dbi)
+
+							states, unknown, err := db.MigrationStatus(dbi)
+							if err != nil {
+								return err
+							}
+
+							for _, s := range states {
+								state := "pending"
+								if s.Applied {
+									state = "applied"
+								}
+								fmt.Printf("%s  %s\n", s.ID, state)
+							}
+							for _, id := range unknown {
+								fmt.Printf("%s  applied, unknown to this version of ddm\n", id)
+							}
+
+							return nil
+						},
+					},
+					{
+						Name:  "up",
+						Usage: "apply pending migrations, initializing the database if it is empty",
+						Flags: append(databaseFlags(&dbConnStr, &dbPool),
+							&cli.StringFlag{
+								Name:  "to",
+								Usage: "only apply migrations up to and including this migration id. defaults to all",
+							},
+						),
+						Action: func(c *cli.Context) error {
+							dbi, err := db.Connect(dbConnStr, dbPool, false)
+							if err != nil {
+								return err
+							}
+							defer closeDatabase(dbi)
+
+							if err := db.Migrate(dbi, c.String("to")); err != nil {
+								return err
+							}
+
+							return printMigrationVersion(dbi)
+						},
+					},
+					{
+						Name:  "down",
+						Usage: "roll back migrations applied after a migration",
+						Flags: append(databaseFlags(&dbConnStr, &dbPool),
+							&cli.StringFlag{
+								Name:     "to",
+								Usage:    "migration id to roll back to. migrations after it are rolled back, latest first",
+								Required: true,
+							},
+						),
+						Action: func(c *cli.Context) error {
+							dbi, _, err := connectExisting(dbConnStr, dbPool)
+							if err != nil {
+								return err
+							}
+							defer closeDatabase(dbi)
+
+							if err := db.Rollback(dbi, c.String("to")); err != nil {
+								return err
+							}
+
+							return printMigrationVersion(dbi)
+						},
+					},
+				},
+			},
+			{
+				Name:      "migrate-data",
+				Usage:     "copy all data from one database to another, ex. from sqlite to postgres",
+				UsageText: "ddm db migrate-data --from sqlite:delta-dm.db --to postgres://...",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "from",
+						Usage:    "connection string of the database to copy from",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "to",
+						Usage:    "connection string of the database to copy to. it is created or migrated to the current schema first",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "batch-size",
+						Usage: "number of rows copied per insert",
+						Value: db.DEFAULT_COPY_BATCH_SIZE,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					pool := db.PoolOptions{ConnectTimeout: 10 * time.Second}
+
+					src, _, err := connectExisting(c.String("from"), pool)
+					if err != nil {
+						return fmt.Errorf("unable to open source database: %s", err)
+					}
+					defer closeDatabase(src)
+
+					// The source is not migrated here, as it should be left untouched
+					_, pending, err := db.MigrationVersion(src)
+					if err != nil {
+						return err
+					}
+					if len(pending) > 0 {
+						return fmt.Errorf("source database has pending migrations (%s). start the daemon against it once to apply them before copying", strings.Join(pending, ", "))
+					}
+
+					dst, err := db.OpenDatabase(c.String("to"), pool, false)
+					if err != nil {
+						return fmt.Errorf("unable to open destination database: %s", err)
+					}
+					defer closeDatabase(dst)
+
+					err = db.CopyData(src, dst, db.CopyOptions{
+						BatchSize: c.Int("batch-size"),
+						Progress: func(p db.TableCopyProgress) {
+							if p.Source == 0 {
+								fmt.Printf("%s: empty\n", p.Table)
+							} else if p.Skipped {
+								fmt.Printf("%s: %d rows already copied\n", p.Table, p.Source)
+							} else {
+								fmt.Printf("%s: copied %d/%d rows\n", p.Table, p.Copied, p.Source)
+							}
+						},
+					})
+					if err != nil {
+						return fmt.Errorf("copy failed, run the command again to resume: %s", err)
+					}
+
+					counts, err := db.VerifyCopy(src, dst)
+					if err != nil {
+						return err
+					}
+					for _, tc := range counts {
+						fmt.Printf("verified %s: %d rows\n", tc.Table, tc.Destination)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:  "backup",
+				Usage: "back up all ddm data to a portable archive",
+				Flags: append(databaseFlags(&dbConnStr, &dbPool),
+					&cli.StringFlag{
+						Name:        "out",
+						Aliases:     []string{"o"},
+						Usage:       "file to write the backup to",
+						DefaultText: "ddm-backup-<timestamp>.tar.gz",
+					},
+				),
+				Action: func(c *cli.Context) error {
+					dbi, _, err := connectExisting(dbConnStr, dbPool)
+					if err != nil {
+						return err
+					}
+					defer closeDatabase(dbi)
+
+					out := c.String("out")
+					if out == "" {
+						out = core.BackupFileName(time.Now())
+					}
+
+					manifest, err := core.WriteBackupFile(dbi, out)
+					if err != nil {
+						return err
+					}
+
+					var rows int64
+					for _, t := range manifest.Tables {
+						rows += t.Rows
+					}
+					fmt.Printf("wrote backup of %d rows at schema version %s to %s\n", rows, manifest.MigrationID, out)
+
+					return nil
+				},
+			},
+			{
+				Name:  "restore",
+				Usage: "restore a backup into an empty database",
+				Flags: append(databaseFlags(&dbConnStr, &dbPool),
+					&cli.StringFlag{
+						Name:     "in",
+						Aliases:  []string{"i"},
+						Usage:    "backup file to restore",
+						Required: true,
+					},
+				),
+				Action: func(c *cli.Context) error {
+					f, err := os.Open(c.String("in"))
+					if err != nil {
+						return fmt.Errorf("unable to open backup: %s", err)
+					}
+					defer f.Close()
+
+					// Check the backup can be read before creating or migrating the database
+					if _, err := db.ReadBackupManifest(f); err != nil {
+						return err
+					}
+					if _, err := f.Seek(0, io.SeekStart); err != nil {
+						return err
+					}
+
+					dbi, err := db.OpenDatabase(dbConnStr, dbPool, false)
+					if err != nil {
+						return err
+					}
+					defer closeDatabase(dbi)
+
+					manifest, err := db.RestoreBackup(dbi, f)
+					if err != nil {
+						return fmt.Errorf("restore failed: %s", err)
+					}
+
+					for _, t := range manifest.Tables {
+						fmt.Printf("restored %s: %d rows\n", t.Name, t.Rows)
+					}
+					fmt.Printf("restored backup taken %s at schema version %s\n", manifest.CreatedAt.Format(time.RFC3339), manifest.MigrationID)
+
+					return nil
+				},
+			},
+		},
+	}
+
+	dbCmds = append(dbCmds, dbCmd)
+
+	return dbCmds
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/application-research/delta-dm/api"
+	"github.com/urfave/cli/v2"
+)
+
+func DeltaNodeCmd() []*cli.Command {
+	var name string
+	var nodeUrl string
+	var authToken string
+
+	var deltaNodeCmds []*cli.Command
+	deltaNodeCmd := &cli.Command{
+		Name:  "delta-node",
+		Usage: "Delta Node Commands",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "add",
+				Usage: "register a delta node to make deals through",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "name",
+						Usage:       "name of the node, used to pin datasets and providers to it",
+						Destination: &name,
+						Required:    true,
+					},
+					&cli.StringFlag{
+						Name:        "url",
+						Usage:       "url of the node's api (i.e, http://delta-2:1414)",
+						Destination: &nodeUrl,
+						Required:    true,
+					},
+					&cli.StringFlag{
+						Name:        "auth-token",
+						Usage:       "service token for the node",
+						Destination: &authToken,
+						Required:    true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cmd, err := NewCmdProcessor(c)
+					if err != nil {
+						return err
+					}
+
+					body := api.DeltaNodePostBody{
+						Name:      name,
+						URL:       nodeUrl,
+						AuthToken: authToken,
+					}
+
+					b, err := json.Marshal(body)
+					if err != nil {
+						return fmt.Errorf("unable to construct request body %s", err)
+					}
+
+					res, closer, err := cmd.MakeRequest(http.MethodPost, "/api/v1/delta-nodes", b)
+					if err != nil {
+						return fmt.Errorf("unable to make request %s", err)
+					}
+					defer closer()
+
+					fmt.Printf("%s", string(res))
+
+					return nil
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "list delta nodes, with their health",
+				Action: func(c *cli.Context) error {
+					cmd, err := NewCmdProcessor(c)
+					if err != nil {
+						return err
+					}
+
+					res, closer, err := cmd.MakeRequest(http.MethodGet, "/api/v1/delta-nodes", nil)
+					if err != nil {
+						return fmt.Errorf("unable to make request %s", err)
+					}
+					defer closer()
+
+					fmt.Printf("%s", string(res))
+
+					return nil
+				},
+			},
+			{
+				Name:  "delete",
+				Usage: "remove a delta node",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "name",
+						Usage:       "name of the node to remove",
+						Destination: &name,
+						Required:    true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cmd, err := NewCmdProcessor(c)
+					if err != nil {
+						return err
+					}
+
+					res, closer, err := cmd.MakeRequest(http.MethodDelete, "/api/v1/delta-nodes/"+url.PathEscape(name), nil)
+					if err != nil {
+						return fmt.Errorf("unable to make request %s", err)
+					}
+					defer closer()
+
+					fmt.Printf("%s", string(res))
+
+					return nil
+				},
+			},
+		},
+	}
+
+	deltaNodeCmds = append(deltaNodeCmds, deltaNodeCmd)
+
+	return deltaNodeCmds
+}
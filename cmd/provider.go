@@ -14,6 +14,8 @@ func ProviderCmd() []*cli.Command {
 	var spId string
 	var spName string
 	var allowSelfService string
+	var region string
+	var deltaNode string
 
 	var providerCmds []*cli.Command
 	providerCmd := &cli.Command{
@@ -35,6 +37,11 @@ func ProviderCmd() []*cli.Command {
 						Usage:       "friendly name of storage provider",
 						Destination: &spName,
 					},
+					&cli.StringFlag{
+						Name:        "region",
+						Usage:       "region the storage provider is located in (i.e. north-america), used in compliance reports",
+						Destination: &region,
+					},
 				},
 				Action: func(c *cli.Context) error {
 					cmd, err := NewCmdProcessor(c)
@@ -44,6 +51,7 @@ func ProviderCmd() []*cli.Command {
 
 					body := db.Provider{
 						ActorID: spId,
+						Region:  region,
 					}
 
 					if spName != "" {
@@ -88,6 +96,16 @@ func ProviderCmd() []*cli.Command {
 						Usage:       "enable self-service for provider (on|off)",
 						Destination: &allowSelfService,
 					},
+					&cli.StringFlag{
+						Name:        "region",
+						Usage:       "update region the storage provider is located in",
+						Destination: &region,
+					},
+					&cli.StringFlag{
+						Name:        "delta-node",
+						Usage:       "make all deals with the provider through this delta node. use '' to unpin",
+						Destination: &deltaNode,
+					},
 				},
 				Action: func(c *cli.Context) error {
 					cmd, err := NewCmdProcessor(c)
@@ -104,6 +122,10 @@ func ProviderCmd() []*cli.Command {
 					body := api.ProviderPutBody{
 						ActorName:        spName,
 						AllowSelfService: allowSelfService,
+						Region:           region,
+					}
+					if c.IsSet("delta-node") {
+						body.DeltaNode = &deltaNode
 					}
 
 					b, err := json.Marshal(body)
@@ -122,16 +144,45 @@ func ProviderCmd() []*cli.Command {
 					return nil
 				},
 			},
+			{
+				Name:  "stats",
+				Usage: "show storage provider reputation stats",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "id",
+						Usage:       "storage provider id to show stats for (i.e. f012345)",
+						Destination: &spId,
+						Required:    true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cmd, err := NewCmdProcessor(c)
+					if err != nil {
+						return err
+					}
+
+					res, closer, err := cmd.MakeRequest(http.MethodGet, "/api/v1/providers/"+spId+"/stats", nil)
+					if err != nil {
+						return fmt.Errorf("unable to make request %s", err)
+					}
+					defer closer()
+
+					fmt.Printf("%s", string(res))
+
+					return nil
+				},
+			},
 			{
 				Name:  "list",
 				Usage: "list storage providers",
+				Flags: listFlags(),
 				Action: func(c *cli.Context) error {
 					cmd, err := NewCmdProcessor(c)
 					if err != nil {
 						return err
 					}
 
-					res, closer, err := cmd.MakeRequest(http.MethodGet, "/api/v1/providers/", nil)
+					res, closer, err := cmd.MakeRequest(http.MethodGet, "/api/v1/providers?"+listParams(c).Encode(), nil)
 					if err != nil {
 						return fmt.Errorf("unable to make request %s", err)
 					}
@@ -14,6 +14,9 @@ func ReplicationProfilesCmd() []*cli.Command {
 	var datasetId uint
 	var unsealed bool
 	var indexed bool
+	var verified bool
+	var price string
+	var connectionMode string
 
 	var providerCmds []*cli.Command
 	providerCmd := &cli.Command{
@@ -48,6 +51,22 @@ func ReplicationProfilesCmd() []*cli.Command {
 						Usage:       "keep unsealed copy",
 						Destination: &unsealed,
 					},
+					&cli.BoolFlag{
+						Name:        "verified",
+						Usage:       "make verified (FIL+) deals. use --verified=false for non-verified deals",
+						Value:       true,
+						Destination: &verified,
+					},
+					&cli.StringFlag{
+						Name:        "price",
+						Usage:       "price to pay the provider, in attoFIL per GiB per epoch",
+						Destination: &price,
+					},
+					&cli.StringFlag{
+						Name:        "connection-mode",
+						Usage:       "import (offline) or e2e (online) deals. overrides the dataset's connection mode. use 'inherit' to clear",
+						Destination: &connectionMode,
+					},
 				},
 				Action: func(c *cli.Context) error {
 					cmd, err := NewCmdProcessor(c)
@@ -56,10 +75,13 @@ func ReplicationProfilesCmd() []*cli.Command {
 					}
 
 					body := db.ReplicationProfile{
-						ProviderActorID: spId,
-						DatasetID:       datasetId,
-						Unsealed:        unsealed,
-						Indexed:         indexed,
+						ProviderActorID:  spId,
+						DatasetID:        datasetId,
+						Unsealed:         unsealed,
+						Indexed:          indexed,
+						Verified:         &verified,
+						PricePerGiBEpoch: price,
+						ConnectionMode:   db.ConnectionMode(connectionMode),
 					}
 
 					b, err := json.Marshal(body)
@@ -105,6 +127,22 @@ func ReplicationProfilesCmd() []*cli.Command {
 						Usage:       "keep unsealed copy",
 						Destination: &unsealed,
 					},
+					&cli.BoolFlag{
+						Name:        "verified",
+						Usage:       "make verified (FIL+) deals. use --verified=false for non-verified deals",
+						Value:       true,
+						Destination: &verified,
+					},
+					&cli.StringFlag{
+						Name:        "price",
+						Usage:       "price to pay the provider, in attoFIL per GiB per epoch",
+						Destination: &price,
+					},
+					&cli.StringFlag{
+						Name:        "connection-mode",
+						Usage:       "import (offline) or e2e (online) deals. overrides the dataset's connection mode. use 'inherit' to clear",
+						Destination: &connectionMode,
+					},
 				},
 				Action: func(c *cli.Context) error {
 					cmd, err := NewCmdProcessor(c)
@@ -113,10 +151,16 @@ func ReplicationProfilesCmd() []*cli.Command {
 					}
 
 					body := db.ReplicationProfile{
-						ProviderActorID: spId,
-						DatasetID:       datasetId,
-						Unsealed:        unsealed,
-						Indexed:         indexed,
+						ProviderActorID:  spId,
+						DatasetID:        datasetId,
+						Unsealed:         unsealed,
+						Indexed:          indexed,
+						PricePerGiBEpoch: price,
+						ConnectionMode:   db.ConnectionMode(connectionMode),
+					}
+
+					if c.IsSet("verified") {
+						body.Verified = &verified
 					}
 
 					b, err := json.Marshal(body)
@@ -1,9 +1,15 @@
 package cmd
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/application-research/delta-dm/api"
 	"github.com/urfave/cli/v2"
@@ -14,6 +20,9 @@ func ReplicationCmd() []*cli.Command {
 	var provider string
 	var datasetID uint
 	var delayStartDays uint64
+	var strategy string
+	var plan bool
+	var replicationID uint
 
 	var replicationCmds []*cli.Command
 	replicationCmd := &cli.Command{
@@ -49,6 +58,16 @@ func ReplicationCmd() []*cli.Command {
 						Usage:       "number of days to delay start of deal",
 						Destination: &delayStartDays,
 					},
+					&cli.StringFlag{
+						Name:        "strategy",
+						Usage:       "order to select content in: fewest_replicas (default), oldest, random, largest or smallest",
+						Destination: &strategy,
+					},
+					&cli.BoolFlag{
+						Name:        "plan",
+						Usage:       "preview the deals that would be made, without making them",
+						Destination: &plan,
+					},
 				},
 				Action: func(c *cli.Context) error {
 					cmd, err := NewCmdProcessor(c)
@@ -59,6 +78,7 @@ func ReplicationCmd() []*cli.Command {
 					body := api.PostReplicationBody{
 						NumDeals: &num,
 						Provider: provider,
+						Strategy: strategy,
 					}
 
 					if datasetID != 0 {
@@ -74,7 +94,89 @@ func ReplicationCmd() []*cli.Command {
 						return fmt.Errorf("unable to construct request body %s", err)
 					}
 
-					res, closer, err := cmd.MakeRequest(http.MethodPost, "/api/v1/replications", b)
+					endpoint := "/api/v1/replications"
+					if plan {
+						endpoint += "/preview"
+					}
+
+					res, closer, err := cmd.MakeRequest(http.MethodPost, endpoint, b)
+					if err != nil {
+						return fmt.Errorf("unable to make request %s", err)
+					}
+					defer closer()
+
+					fmt.Printf("%s", string(res))
+
+					return nil
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "list replications, or aggregates of them",
+				Flags: append(replicationFilterFlags(),
+					&cli.StringFlag{Name: "sort", Usage: "sort by id, deal_time, status, provider, on_chain_deal_id or padded_size", Value: "id"},
+					&cli.StringFlag{Name: "order", Usage: "sort order, asc or desc", Value: "desc"},
+					&cli.IntFlag{Name: "limit", Usage: "max number of replications to list", Value: 100},
+					&cli.StringFlag{Name: "cursor", Usage: "continue from the cursor returned with a previous page"},
+					&cli.StringFlag{Name: "group-by", Usage: "aggregate replications by status, provider, dataset or day"},
+					&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Usage: "output format: table, json or csv", Value: "table"},
+				),
+				Action: func(c *cli.Context) error {
+					cmd, err := NewCmdProcessor(c)
+					if err != nil {
+						return err
+					}
+
+					output := c.String("output")
+					if output != "table" && output != "json" && output != "csv" {
+						return fmt.Errorf("invalid output '%s', must be one of table, json, csv", output)
+					}
+
+					params := replicationFilterParams(c)
+					for flag, param := range map[string]string{
+						"sort":     "sort",
+						"order":    "order",
+						"cursor":   "cursor",
+						"group-by": "group_by",
+					} {
+						if v := c.String(flag); v != "" {
+							params.Set(param, v)
+						}
+					}
+					params.Set("limit", fmt.Sprint(c.Int("limit")))
+
+					res, closer, err := cmd.MakeRequest(http.MethodGet, "/api/v1/replications?"+params.Encode(), nil)
+					if err != nil {
+						return fmt.Errorf("unable to make request %s", err)
+					}
+					defer closer()
+
+					if output == "json" {
+						fmt.Printf("%s", string(res))
+						return nil
+					}
+
+					return printReplications(res, c.String("group-by") != "", output == "csv")
+				},
+			},
+			{
+				Name:  "cancel",
+				Usage: "cancel a replication that has not landed on chain yet",
+				Flags: []cli.Flag{
+					&cli.UintFlag{
+						Name:        "id",
+						Usage:       "id of the replication to cancel",
+						Destination: &replicationID,
+						Required:    true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cmd, err := NewCmdProcessor(c)
+					if err != nil {
+						return err
+					}
+
+					res, closer, err := cmd.MakeRequest(http.MethodDelete, fmt.Sprintf("/api/v1/replications/%d", replicationID), nil)
 					if err != nil {
 						return fmt.Errorf("unable to make request %s", err)
 					}
@@ -92,3 +194,107 @@ func ReplicationCmd() []*cli.Command {
 
 	return replicationCmds
 }
+
+// Flags for the filters of GET /replications
+func replicationFilterFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "statuses", Usage: "only replications with these statuses (comma separated)"},
+		&cli.StringFlag{Name: "datasets", Usage: "only replications of these datasets (comma separated names)"},
+		&cli.StringFlag{Name: "providers", Usage: "only replications to these providers (comma separated)"},
+		&cli.StringFlag{Name: "piece-cid", Usage: "only replications of these pieces (comma separated)"},
+		&cli.StringFlag{Name: "proposal-cid", Usage: "only the replication with this proposal CID"},
+		&cli.StringFlag{Name: "on-chain-deal-id", Usage: "only replications with these on-chain deal IDs (comma separated)"},
+		&cli.StringFlag{Name: "self-service", Usage: "only self-service (true) or admin (false) replications"},
+		&cli.StringFlag{Name: "message", Usage: "only replications whose message contains this text"},
+	}
+}
+
+// Query params for the filter flags that are set
+func replicationFilterParams(c *cli.Context) url.Values {
+	params := url.Values{}
+	for flag, param := range map[string]string{
+		"statuses":         "statuses",
+		"datasets":         "datasets",
+		"providers":        "providers",
+		"piece-cid":        "piece_cid",
+		"proposal-cid":     "proposal_cid",
+		"on-chain-deal-id": "on_chain_deal_id",
+		"self-service":     "self_service",
+		"message":          "message",
+	} {
+		if v := c.String(flag); v != "" {
+			params.Set(param, v)
+		}
+	}
+	return params
+}
+
+// Print a replications response as a table or CSV
+func printReplications(res []byte, grouped bool, asCsv bool) error {
+	var errResp struct {
+		Error *api.HttpError `json:"error"`
+	}
+	if err := json.Unmarshal(res, &errResp); err != nil || errResp.Error != nil {
+		return fmt.Errorf("%s", string(res))
+	}
+
+	var header []string
+	var rows [][]string
+	var footer string
+
+	if grouped {
+		var gr api.ReplicationGroupsResponse
+		if err := json.Unmarshal(res, &gr); err != nil {
+			return fmt.Errorf("unable to parse response: %s", err)
+		}
+
+		header = []string{gr.GroupBy, "count", "on_chain", "padded_bytes"}
+		for _, g := range gr.Groups {
+			rows = append(rows, []string{g.Key, fmt.Sprint(g.Count), fmt.Sprint(g.OnChain), fmt.Sprint(g.PaddedBytes)})
+		}
+	} else {
+		var rr api.ReplicationResponse
+		if err := json.Unmarshal(res, &rr); err != nil {
+			return fmt.Errorf("unable to parse response: %s", err)
+		}
+
+		header = []string{"id", "provider", "piece_cid", "status", "on_chain_deal_id", "deal_time", "padded_size", "self_service"}
+		for _, r := range rr.Data {
+			rows = append(rows, []string{
+				fmt.Sprint(r.ID),
+				r.ProviderActorID,
+				r.ContentCommP,
+				string(r.Status),
+				fmt.Sprint(r.OnChainDealID),
+				r.DealTime.Format(time.RFC3339),
+				fmt.Sprint(r.Content.PaddedSize),
+				fmt.Sprint(r.SelfService.IsSelfService),
+			})
+		}
+
+		footer = fmt.Sprintf("%d of %d replications", len(rr.Data), rr.TotalCount)
+		if rr.NextCursor != "" {
+			footer += fmt.Sprintf(". next page: --cursor %s", rr.NextCursor)
+		}
+	}
+
+	if asCsv {
+		w := csv.NewWriter(os.Stdout)
+		w.Write(header)
+		w.WriteAll(rows)
+		return w.Error()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(header, "\t")))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+
+	if footer != "" {
+		fmt.Fprintln(os.Stderr, footer)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+func ReportCmd() []*cli.Command {
+	var groupBy string
+
+	var reportCmds []*cli.Command
+	reportCmd := &cli.Command{
+		Name:  "report",
+		Usage: "Reporting Commands",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "spend",
+				Usage: "show total spend on paid deals",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "group-by",
+						Usage:       "group spend by wallet, provider or dataset",
+						Value:       "wallet",
+						Destination: &groupBy,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cmd, err := NewCmdProcessor(c)
+					if err != nil {
+						return err
+					}
+
+					res, closer, err := cmd.MakeRequest(http.MethodGet, "/api/v1/reports/spend?group_by="+groupBy, nil)
+					if err != nil {
+						return fmt.Errorf("unable to make request %s", err)
+					}
+					defer closer()
+
+					fmt.Printf("%s", string(res))
+
+					return nil
+				},
+			},
+			{
+				Name:  "replications",
+				Usage: "export replications, with their content, dataset and provider",
+				Flags: append(replicationFilterFlags(),
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "export format: csv, ndjson or parquet",
+						Value: "csv",
+					},
+					&cli.StringFlag{
+						Name:    "out",
+						Aliases: []string{"o"},
+						Usage:   "file to write the export to. defaults to stdout",
+					},
+				),
+				Action: func(c *cli.Context) error {
+					cmd, err := NewCmdProcessor(c)
+					if err != nil {
+						return err
+					}
+
+					params := replicationFilterParams(c)
+					params.Set("format", c.String("format"))
+
+					out := os.Stdout
+					if path := c.String("out"); path != "" {
+						out, err = os.Create(path)
+						if err != nil {
+							return fmt.Errorf("unable to create output file: %s", err)
+						}
+						defer out.Close()
+					}
+
+					return cmd.DownloadRequest(http.MethodGet, "/api/v1/reports/replications?"+params.Encode(), out)
+				},
+			},
+			{
+				Name:  "compliance",
+				Usage: "generate a FIL+ compliance report for a dataset",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "dataset",
+						Usage:    "name of the dataset to report on",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "report format: md or json",
+						Value: "md",
+					},
+					&cli.BoolFlag{
+						Name:  "on-chain-only",
+						Usage: "only count deals that are on chain",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cmd, err := NewCmdProcessor(c)
+					if err != nil {
+						return err
+					}
+
+					params := url.Values{}
+					params.Set("dataset", c.String("dataset"))
+					params.Set("format", c.String("format"))
+					if c.Bool("on-chain-only") {
+						params.Set("on_chain_only", "true")
+					}
+
+					res, closer, err := cmd.MakeRequest(http.MethodGet, "/api/v1/reports/compliance?"+params.Encode(), nil)
+					if err != nil {
+						return fmt.Errorf("unable to make request %s", err)
+					}
+					defer closer()
+
+					fmt.Printf("%s", string(res))
+
+					return nil
+				},
+			},
+		},
+	}
+
+	reportCmds = append(reportCmds, reportCmd)
+
+	return reportCmds
+}
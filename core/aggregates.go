@@ -0,0 +1,87 @@
+package core
+
+import (
+	"fmt"
+
+	db "github.com/application-research/delta-dm/db"
+	"gorm.io/gorm"
+)
+
+// Sizes and counts of a dataset's content, and of the replications of it that have not failed or been cancelled
+type DatasetAggregate struct {
+	BytesReplicated db.ByteSizes
+	BytesTotal      db.ByteSizes
+	CountReplicated uint64
+	CountTotal      uint64
+}
+
+// Size and count of the replications to a provider that have not failed or been cancelled
+type ProviderAggregate struct {
+	BytesReplicated db.ByteSizes
+	CountReplicated uint64
+}
+
+type sizeAggregate struct {
+	DatasetID       uint
+	ProviderActorID string
+	Raw             uint64
+	Padded          uint64
+	Count           uint64
+}
+
+// Compute the aggregates of several datasets at once, with one grouped query for the content and one for the replications
+// Datasets with no content are not included in the result
+func DatasetAggregates(dbi *gorm.DB, datasetIDs []uint) (map[uint]*DatasetAggregate, error) {
+	aggs := make(map[uint]*DatasetAggregate)
+	if len(datasetIDs) == 0 {
+		return aggs, nil
+	}
+
+	var totals []sizeAggregate
+	res := dbi.Raw("select dataset_id, SUM(size) raw, SUM(padded_size) padded, COUNT(*) count FROM contents where dataset_id IN ? GROUP BY dataset_id", datasetIDs).Scan(&totals)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to compute dataset totals: %s", res.Error)
+	}
+
+	var replicated []sizeAggregate
+	res = dbi.Raw("select c.dataset_id, SUM(size) raw, SUM(padded_size) padded, COUNT(*) count FROM contents c inner join replications r on r.content_comm_p = c.comm_p where r.deleted_at IS NULL AND r.status NOT IN ? AND c.dataset_id IN ? GROUP BY c.dataset_id", db.InactiveStatuses, datasetIDs).Scan(&replicated)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to compute dataset replications: %s", res.Error)
+	}
+
+	for _, t := range totals {
+		aggs[t.DatasetID] = &DatasetAggregate{BytesTotal: db.ByteSizes{Raw: t.Raw, Padded: t.Padded}, CountTotal: t.Count}
+	}
+	for _, r := range replicated {
+		a, ok := aggs[r.DatasetID]
+		if !ok {
+			a = &DatasetAggregate{}
+			aggs[r.DatasetID] = a
+		}
+		a.BytesReplicated = db.ByteSizes{Raw: r.Raw, Padded: r.Padded}
+		a.CountReplicated = r.Count
+	}
+
+	return aggs, nil
+}
+
+// Compute the aggregates of several providers at once, with one grouped query
+// Providers with no replications are not included in the result
+func ProviderAggregates(dbi *gorm.DB, actorIDs []string) (map[string]*ProviderAggregate, error) {
+	aggs := make(map[string]*ProviderAggregate)
+	if len(actorIDs) == 0 {
+		return aggs, nil
+	}
+
+	var replicated []sizeAggregate
+	res := dbi.Raw("select r.provider_actor_id, SUM(size) raw, SUM(padded_size) padded, COUNT(*) count FROM contents c inner join replications r on r.content_comm_p = c.comm_p where r.deleted_at IS NULL AND r.status NOT IN ? AND r.provider_actor_id IN ? GROUP BY r.provider_actor_id", db.InactiveStatuses, actorIDs).Scan(&replicated)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to compute provider replications: %s", res.Error)
+	}
+
+	for _, r := range replicated {
+		aggs[r.ProviderActorID] = &ProviderAggregate{BytesReplicated: db.ByteSizes{Raw: r.Raw, Padded: r.Padded}, CountReplicated: r.Count}
+	}
+
+	return aggs, nil
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+
+	db "github.com/application-research/delta-dm/db"
+)
+
+func TestAggregatesSkipDeletedReplications(t *testing.T) {
+	dbi, err := db.OpenDatabase(filepath.Join(t.TempDir(), "ddm.db"), db.PoolOptions{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := []interface{}{
+		&db.Dataset{Name: "ds"},
+		&db.Content{CommP: "a", DatasetID: 1, Size: 100, PaddedSize: 128},
+		&db.Replication{ContentCommP: "a", ProviderActorID: "f01000", DeltaContentID: 1, ProposalCid: "p1", Status: db.DDM_StorageDealStatusPending},
+		&db.Replication{ContentCommP: "a", ProviderActorID: "f01000", DeltaContentID: 2, ProposalCid: "p2", Status: db.DDM_StorageDealStatusPending},
+	}
+	for _, m := range seed {
+		if err := dbi.Omit("Content").Create(m).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dbi.Delete(&db.Replication{}, 2).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	datasets, err := DatasetAggregates(dbi, []uint{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := datasets[1].CountReplicated; got != 1 {
+		t.Errorf("dataset has %d replications, want 1", got)
+	}
+
+	providers, err := ProviderAggregates(dbi, []string{"f01000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := providers["f01000"].CountReplicated; got != 1 {
+		t.Errorf("provider has %d replications, want 1", got)
+	}
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+	"gorm.io/gorm"
+)
+
+const (
+	BACKUP_FILE_PREFIX = "ddm-backup-"
+	BACKUP_FILE_SUFFIX = ".tar.gz"
+)
+
+// Name of a backup file taken at t. Names sort in the order the backups were taken
+func BackupFileName(t time.Time) string {
+	return BACKUP_FILE_PREFIX + t.UTC().Format("20060102T150405Z") + BACKUP_FILE_SUFFIX
+}
+
+// Back up the database to path
+// The backup is written to a temporary file first, so a partially written backup is never left under the final name
+func WriteBackupFile(dbi *gorm.DB, path string) (*db.BackupManifest, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create backup file: %s", err)
+	}
+	defer os.Remove(f.Name())
+
+	manifest, err := db.WriteBackup(dbi, f)
+	if err == nil {
+		err = f.Chmod(0600)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return nil, fmt.Errorf("unable to write backup file: %s", err)
+	}
+
+	return manifest, nil
+}
+
+// Periodically back up the database to a file in dir, starting immediately, keeping only the latest `keep` backups (0 to keep all)
+func (dldm *DeltaDM) ScheduleBackups(dir string, interval time.Duration, keep int) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to create backup directory: %s", err)
+	}
+
+	go func() {
+		for {
+			path := filepath.Join(dir, BackupFileName(time.Now()))
+			if manifest, err := WriteBackupFile(dldm.DB, path); err != nil {
+				log.Errorf("failed writing scheduled backup: %s", err)
+			} else {
+				log.Infof("wrote backup at schema version %s to %s", manifest.MigrationID, path)
+
+				removed, err := PruneBackups(dir, keep)
+				if err != nil {
+					log.Errorf("failed removing old backups: %s", err)
+				}
+				for _, r := range removed {
+					log.Debugf("removed old backup %s", r)
+				}
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+
+	return nil
+}
+
+// Remove all but the latest `keep` backups in dir, returning the paths removed. Other files in dir are left alone
+func PruneBackups(dir string, keep int) ([]string, error) {
+	if keep <= 0 {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), BACKUP_FILE_PREFIX) && strings.HasSuffix(e.Name(), BACKUP_FILE_SUFFIX) {
+			backups = append(backups, e.Name())
+		}
+	}
+	if len(backups) <= keep {
+		return nil, nil
+	}
+	sort.Strings(backups)
+
+	var removed []string
+	for _, name := range backups[:len(backups)-keep] {
+		path := filepath.Join(dir, name)
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,235 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+	"gorm.io/gorm"
+)
+
+// Benchmarks for the queries that slow down on large replication tables, against a database seeded with synthetic data
+// They run against a temporary SQLite database, and also against Postgres if DDM_BENCH_POSTGRES_DSN is set
+// The Postgres database must be a scratch database: any DDM tables in it are dropped before seeding
+// The number of contents is set with DDM_BENCH_CONTENTS (default: 10000). Each content is replicated to 3 of 10 providers
+// The unindexed anti-join is quadratic, so expect it to take tens of seconds per run
+//
+//	go test ./core -run '^$' -bench . -benchtime 3x
+
+const BENCH_PROVIDERS = 10
+
+type benchDatabase struct {
+	name string
+	dbi  *gorm.DB
+}
+
+var (
+	benchOnce sync.Once
+	benchDBs  []benchDatabase
+	benchErr  error
+)
+
+// The seeded databases are shared by all benchmarks, as seeding takes much longer than the queries
+func benchDatabases(b *testing.B) []benchDatabase {
+	benchOnce.Do(func() {
+		contents := 10000
+		if s := os.Getenv("DDM_BENCH_CONTENTS"); s != "" {
+			if contents, benchErr = strconv.Atoi(s); benchErr != nil {
+				return
+			}
+		}
+
+		dir, err := os.MkdirTemp("", "ddm-bench")
+		if err != nil {
+			benchErr = err
+			return
+		}
+
+		dsns := []benchDatabase{{name: "sqlite"}}
+		if pg := os.Getenv("DDM_BENCH_POSTGRES_DSN"); pg != "" {
+			dsns = append(dsns, benchDatabase{name: "postgres"})
+		}
+
+		for _, bd := range dsns {
+			dsn := dir + "/bench.db"
+			if bd.name == "postgres" {
+				dsn = os.Getenv("DDM_BENCH_POSTGRES_DSN")
+				if benchErr = dropBenchTables(dsn); benchErr != nil {
+					return
+				}
+			}
+
+			if bd.dbi, benchErr = db.OpenDatabase(dsn, db.PoolOptions{}, false); benchErr != nil {
+				return
+			}
+			if benchErr = seedBenchDatabase(bd.dbi, contents); benchErr != nil {
+				return
+			}
+			benchDBs = append(benchDBs, bd)
+		}
+	})
+
+	if benchErr != nil {
+		b.Fatalf("unable to set up benchmark databases: %s", benchErr)
+	}
+
+	return benchDBs
+}
+
+func dropBenchTables(dsn string) error {
+	dbi, err := db.OpenDatabase(dsn, db.PoolOptions{}, false)
+	if err != nil {
+		return err
+	}
+	return dbi.Migrator().DropTable(&db.StatsSnapshot{}, &db.SelfServiceEvent{}, &db.Reservation{}, &db.Replication{}, &db.WalletDatasets{}, &db.Wallet{}, &db.ReplicationProfile{}, &db.Content{}, &db.Dataset{}, &db.Provider{}, &db.DeltaNode{}, "migrations")
+}
+
+func seedBenchDatabase(dbi *gorm.DB, numContents int) error {
+	ds := db.Dataset{Name: "bench", ReplicationQuota: 6, DealDuration: 540}
+	if err := dbi.Create(&ds).Error; err != nil {
+		return err
+	}
+
+	for p := 0; p < BENCH_PROVIDERS; p++ {
+		id := benchProvider(p)
+		if err := dbi.Create(&db.Provider{ActorID: id}).Error; err != nil {
+			return err
+		}
+		if err := dbi.Create(&db.ReplicationProfile{ProviderActorID: id, DatasetID: ds.ID}).Error; err != nil {
+			return err
+		}
+	}
+
+	contents := make([]db.Content, 0, numContents)
+	replications := make([]db.Replication, 0, numContents*3)
+	for i := 0; i < numContents; i++ {
+		commp := fmt.Sprintf("baga-bench-%d", i)
+		contents = append(contents, db.Content{CommP: commp, PaddedSize: 1 << 35, DatasetID: ds.ID, NumReplications: 3})
+
+		for j := 0; j < 3; j++ {
+			n := len(replications)
+			r := db.Replication{
+				ContentCommP:    commp,
+				ProviderActorID: benchProvider(i + j),
+				DealTime:        time.Now().Add(-time.Duration(n) * time.Second),
+				DeltaContentID:  int64(n + 1),
+				ProposalCid:     fmt.Sprintf("bafy-bench-%d", n),
+				Status:          "active",
+				OnChainDealID:   uint(n + 1),
+			}
+			switch n % 20 {
+			case 0:
+				r.Status = "transfer-failed"
+				r.OnChainDealID = 0
+			case 1:
+				r.Status = db.DDM_StorageDealStatusPending
+				r.OnChainDealID = 0
+			}
+			replications = append(replications, r)
+		}
+	}
+
+	if err := dbi.CreateInBatches(&contents, 1000).Error; err != nil {
+		return err
+	}
+	return dbi.CreateInBatches(&replications, 1000).Error
+}
+
+func benchProvider(i int) string {
+	return fmt.Sprintf("f0%d", 1000+i%BENCH_PROVIDERS)
+}
+
+// Run a benchmark with an index dropped, to compare against the indexed query
+func withoutIndex(dbi *gorm.DB, model interface{}, index string, bench func(b *testing.B)) func(b *testing.B) {
+	return func(b *testing.B) {
+		if err := dbi.Migrator().DropIndex(model, index); err != nil {
+			b.Fatalf("unable to drop index: %s", err)
+		}
+		defer func() {
+			if err := dbi.Migrator().CreateIndex(model, index); err != nil {
+				b.Fatalf("unable to recreate index: %s", err)
+			}
+		}()
+
+		b.ResetTimer()
+		bench(b)
+	}
+}
+
+// The selection query before it was rewritten as an anti-join, for comparison
+const legacyUnreplicatedContentQuery = `
+  SELECT COUNT(*)
+  FROM datasets d
+  INNER JOIN contents c ON d.id = c.dataset_id
+  INNER JOIN replication_profiles rp ON rp.dataset_id = d.id
+  WHERE c.comm_p NOT IN (
+    SELECT r.content_comm_p
+    FROM replications r
+    WHERE r.status != 'FAILURE'
+    AND r.provider_actor_id NOT IN (
+      SELECT p.actor_id
+      FROM providers p
+      WHERE p.actor_id <> ?
+    )
+  )
+  AND rp.provider_actor_id = ?
+  AND c.num_replications + (
+    SELECT COUNT(*)
+    FROM reservations rs
+    WHERE rs.content_comm_p = c.comm_p
+    AND rs.provider_actor_id <> ?
+    AND rs.expires_at > ?
+    AND rs.deleted_at IS NULL
+  ) < d.replication_quota`
+
+func BenchmarkUnreplicatedContent(b *testing.B) {
+	provider := benchProvider(0)
+
+	countAntiJoin := func(dbi *gorm.DB) func(b *testing.B) {
+		return func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := CountUnreplicatedContent(dbi, provider, nil, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+
+	for _, bd := range benchDatabases(b) {
+		dbi := bd.dbi
+
+		b.Run(bd.name+"/not-in", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var count uint64
+				if err := dbi.Raw(legacyUnreplicatedContentQuery, provider, provider, provider, time.Now()).Row().Scan(&count); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(bd.name+"/anti-join", countAntiJoin(dbi))
+		b.Run(bd.name+"/anti-join-unindexed", withoutIndex(dbi, &db.Replication{}, "idx_replications_content_provider", countAntiJoin(dbi)))
+	}
+}
+
+// The scan for pending replications that RunReconciliation does on every run
+func BenchmarkPendingReplications(b *testing.B) {
+	findPending := func(dbi *gorm.DB) func(b *testing.B) {
+		return func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var pending []db.Replication
+				if err := dbi.Model(&db.Replication{}).Where("on_chain_deal_id = ? AND status NOT IN ?", 0, db.InactiveStatuses).Select("delta_content_id").Find(&pending).Error; err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+
+	for _, bd := range benchDatabases(b) {
+		b.Run(bd.name+"/indexed", findPending(bd.dbi))
+		b.Run(bd.name+"/unindexed", withoutIndex(bd.dbi, &db.Replication{}, "idx_replications_on_chain_status", findPending(bd.dbi)))
+	}
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"fmt"
+
+	db "github.com/application-research/delta-dm/db"
+	"gorm.io/gorm"
+)
+
+// Cancel a replication whose deal has not landed on chain. It is marked cancelled, so it no longer counts against the content's
+// replication quota and is no longer reconciled with Delta
+// Note: Delta has no way to abandon a deal, so the provider may still seal it if it has already received the data
+func CancelReplication(dbi *gorm.DB, id uint) (*db.Replication, error) {
+	var r db.Replication
+
+	err := dbi.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&db.Replication{}).Where("id = ?", id).Find(&r)
+		if res.Error != nil {
+			return fmt.Errorf("unable to find replication %d: %s", id, res.Error)
+		}
+		if r.ID == 0 {
+			return fmt.Errorf("replication %d does not exist", id)
+		}
+		if r.OnChainDealID != 0 {
+			return fmt.Errorf("replication %d is already on chain with deal id %d, and cannot be cancelled", id, r.OnChainDealID)
+		}
+		if r.Status.IsInactive() {
+			return fmt.Errorf("replication %d has already ended with status '%s'", id, r.Status)
+		}
+
+		// Only update it if it is still pending, in case reconciliation has changed it since it was read
+		res = tx.Model(&db.Replication{}).
+			Where("id = ? AND on_chain_deal_id = ? AND status NOT IN ?", id, 0, db.InactiveStatuses).
+			Updates(db.Replication{Status: db.DDM_StorageDealStatusCancelled, DeltaMessage: "cancelled in ddm"})
+		if res.Error != nil {
+			return fmt.Errorf("unable to cancel replication %d: %s", id, res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("replication %d changed while it was being cancelled, please try again", id)
+		}
+
+		res = tx.Model(&db.Content{}).
+			Where("comm_p = ? AND num_replications > 0", r.ContentCommP).
+			Update("num_replications", gorm.Expr("num_replications - ?", 1))
+		if res.Error != nil {
+			return fmt.Errorf("unable to update content %s: %s", r.ContentCommP, res.Error)
+		}
+
+		r.Status = db.DDM_StorageDealStatusCancelled
+		r.DeltaMessage = "cancelled in ddm"
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
@@ -0,0 +1,175 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+)
+
+// Writes are split into chunks of at most this size, so they can be rate limited smoothly
+const carTransferChunkSize = 256 * 1024
+
+// Limiters of providers with no transfers in flight are dropped once idle for this long, so the server doesn't keep one for every provider it has seen
+// By then the limiter has refilled, so a new one for the provider allows no more than the old one would have
+const carLimiterIdleTimeout = time.Minute
+
+// Serves CAR files directly from DDM, for providers to download content for offline deals
+type CarServer struct {
+	Store CarStore
+	// Public base URL of this DDM instance, used to build content locations for content hosted by DDM
+	PublicUrl string
+	// Max bytes per second, per provider, across all of their transfers. 0 means unlimited
+	BandwidthLimit uint64
+
+	mu       sync.Mutex
+	limiters map[string]*providerLimiter
+}
+
+type providerLimiter struct {
+	limiter   *rate.Limiter
+	transfers int
+	lastUsed  time.Time
+}
+
+func NewCarServer(store CarStore, publicUrl string, bandwidthLimit uint64) *CarServer {
+	return &CarServer{
+		Store:          store,
+		PublicUrl:      publicUrl,
+		BandwidthLimit: bandwidthLimit,
+		limiters:       make(map[string]*providerLimiter),
+	}
+}
+
+// The location a provider can download a piece from, when it is hosted by DDM
+func (cs *CarServer) LocationFor(piece string) string {
+	return cs.PublicUrl + "/api/v1/car/" + piece
+}
+
+// Get the provider's limiter for a new transfer. release must be called when the transfer is done
+func (cs *CarServer) acquireLimiter(providerActorID string) (*rate.Limiter, func()) {
+	if cs.BandwidthLimit == 0 {
+		return nil, func() {}
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now()
+	for id, pl := range cs.limiters {
+		if pl.transfers == 0 && now.Sub(pl.lastUsed) > carLimiterIdleTimeout {
+			delete(cs.limiters, id)
+		}
+	}
+
+	pl, ok := cs.limiters[providerActorID]
+	if !ok {
+		burst := carTransferChunkSize
+		if cs.BandwidthLimit > uint64(burst) {
+			burst = int(cs.BandwidthLimit)
+		}
+		pl = &providerLimiter{limiter: rate.NewLimiter(rate.Limit(cs.BandwidthLimit), burst)}
+		cs.limiters[providerActorID] = pl
+	}
+	pl.transfers++
+
+	release := func() {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+
+		pl.transfers--
+		pl.lastUsed = time.Now()
+	}
+
+	return pl.limiter, release
+}
+
+// Wrap a response writer so the transfer is rate limited per provider, and the bytes sent are counted
+// Close must be called once the transfer is done
+func (cs *CarServer) NewTransferWriter(ctx context.Context, w http.ResponseWriter, providerActorID string) *CarTransferWriter {
+	limiter, release := cs.acquireLimiter(providerActorID)
+	return &CarTransferWriter{
+		ResponseWriter: w,
+		ctx:            ctx,
+		limiter:        limiter,
+		release:        release,
+	}
+}
+
+// Find the replication a provider is downloading a piece for. Only providers with an active (not failed or cancelled) replication may download it
+func FindTransferReplication(dbi *gorm.DB, providerActorID string, piece string) (*db.Replication, error) {
+	var repl db.Replication
+	res := dbi.Model(&db.Replication{}).
+		Where("provider_actor_id = ? AND content_comm_p = ? AND status NOT IN ?", providerActorID, piece, db.InactiveStatuses).
+		Order("id DESC").
+		Limit(1).
+		Find(&repl)
+
+	if res.Error != nil {
+		return nil, fmt.Errorf("could not look up replication: %s", res.Error)
+	}
+	if repl.ID == 0 {
+		return nil, fmt.Errorf("provider %s has no active replication for piece %s", providerActorID, piece)
+	}
+
+	return &repl, nil
+}
+
+// Add the bytes sent in a transfer to the replication's running total
+func RecordTransfer(dbi *gorm.DB, replicationID uint, bytes uint64) error {
+	if bytes == 0 {
+		return nil
+	}
+
+	return dbi.Model(&db.Replication{}).
+		Where("id = ?", replicationID).
+		Update("bytes_transferred", gorm.Expr("bytes_transferred + ?", bytes)).
+		Error
+}
+
+type CarTransferWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *rate.Limiter
+	release func()
+	once    sync.Once
+	Written uint64
+}
+
+// Release the provider's limiter
+func (tw *CarTransferWriter) Close() {
+	tw.once.Do(tw.release)
+}
+
+func (tw *CarTransferWriter) Write(b []byte) (int, error) {
+	total := 0
+
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > carTransferChunkSize {
+			chunk = chunk[:carTransferChunkSize]
+		}
+
+		if tw.limiter != nil {
+			if err := tw.limiter.WaitN(tw.ctx, len(chunk)); err != nil {
+				return total, err
+			}
+		}
+
+		n, err := tw.ResponseWriter.Write(chunk)
+		total += n
+		tw.Written += uint64(n)
+		if err != nil {
+			return total, err
+		}
+
+		b = b[n:]
+	}
+
+	return total, nil
+}
@@ -0,0 +1,33 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCarServerLimitersDropped(t *testing.T) {
+	cs := NewCarServer(nil, "", 1024*1024)
+
+	_, releaseA := cs.acquireLimiter("f01000")
+	_, releaseB := cs.acquireLimiter("f02000")
+	releaseB()
+
+	// f02000's limiter has been idle long enough to be dropped, f01000's transfer is still in flight
+	for _, pl := range cs.limiters {
+		pl.lastUsed = time.Now().Add(-2 * carLimiterIdleTimeout)
+	}
+	_, releaseC := cs.acquireLimiter("f03000")
+	defer releaseC()
+
+	if _, ok := cs.limiters["f02000"]; ok {
+		t.Error("idle limiter should have been dropped")
+	}
+	if _, ok := cs.limiters["f01000"]; !ok {
+		t.Error("limiter with a transfer in flight should be kept")
+	}
+
+	releaseA()
+	if l, _ := cs.acquireLimiter("f01000"); l != cs.limiters["f01000"].limiter {
+		t.Error("recently used limiter should be reused")
+	}
+}
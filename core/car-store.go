@@ -0,0 +1,231 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A source of CAR files, keyed by piece CID (CommP)
+type CarStore interface {
+	// Open the CAR file for a piece. The caller must close the returned file
+	Open(piece string) (CarFile, error)
+}
+
+type CarFile interface {
+	io.ReadSeekCloser
+	Name() string
+	ModTime() time.Time
+}
+
+// Serves CAR files named `<piece>.car` from a local directory
+type LocalCarStore struct {
+	dir string
+}
+
+func NewLocalCarStore(dir string) (*LocalCarStore, error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not open car directory %s: %s", dir, err)
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("car directory %s is not a directory", dir)
+	}
+
+	return &LocalCarStore{dir: dir}, nil
+}
+
+func (ls *LocalCarStore) Open(piece string) (CarFile, error) {
+	if err := validatePieceName(piece); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(ls.dir, piece+".car"))
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &localCarFile{File: f, modTime: st.ModTime()}, nil
+}
+
+type localCarFile struct {
+	*os.File
+	modTime time.Time
+}
+
+func (lf *localCarFile) ModTime() time.Time {
+	return lf.modTime
+}
+
+// Max time to connect to the object store and for it to start responding. Transfers themselves aren't bound, as CAR files can be large
+const carStoreTimeout = 30 * time.Second
+
+// Serves CAR files named `<piece>.car` from an object store (S3, R2, MinIO, etc.) or any other HTTP host that supports range requests
+type HttpCarStore struct {
+	baseUrl    string
+	authHeader string
+	client     *http.Client
+}
+
+func NewHttpCarStore(baseUrl string, authHeader string) *HttpCarStore {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: carStoreTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = carStoreTimeout
+	transport.ResponseHeaderTimeout = carStoreTimeout
+
+	return &HttpCarStore{
+		baseUrl:    strings.TrimSuffix(baseUrl, "/"),
+		authHeader: authHeader,
+		client:     &http.Client{Transport: transport},
+	}
+}
+
+func (hs *HttpCarStore) Open(piece string) (CarFile, error) {
+	if err := validatePieceName(piece); err != nil {
+		return nil, err
+	}
+
+	hf := &httpCarFile{store: hs, url: hs.baseUrl + "/" + piece + ".car", name: piece + ".car"}
+
+	req, err := hs.newRequest(http.MethodHead, hf.url)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach car store: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error in car store call %d", resp.StatusCode)
+	}
+
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("car store did not return a content length for %s", piece)
+	}
+	hf.size = resp.ContentLength
+
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		hf.modTime = lm
+	}
+
+	return hf, nil
+}
+
+func (hs *HttpCarStore) newRequest(method string, url string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not construct http request %v", err)
+	}
+
+	if hs.authHeader != "" {
+		req.Header.Set("Authorization", hs.authHeader)
+	}
+
+	return req, nil
+}
+
+// Lazily issues a ranged GET to the store from the current offset on the first read after each seek
+type httpCarFile struct {
+	store   *HttpCarStore
+	url     string
+	name    string
+	size    int64
+	modTime time.Time
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (hf *httpCarFile) Name() string {
+	return hf.name
+}
+
+func (hf *httpCarFile) ModTime() time.Time {
+	return hf.modTime
+}
+
+func (hf *httpCarFile) Read(p []byte) (int, error) {
+	if hf.offset >= hf.size {
+		return 0, io.EOF
+	}
+
+	if hf.body == nil {
+		req, err := hf.store.newRequest(http.MethodGet, hf.url)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(hf.offset, 10)+"-")
+
+		resp, err := hf.store.client.Do(req)
+		if err != nil {
+			return 0, fmt.Errorf("could not reach car store: %s", err)
+		}
+		if resp.StatusCode != http.StatusPartialContent && !(resp.StatusCode == http.StatusOK && hf.offset == 0) {
+			resp.Body.Close()
+			return 0, fmt.Errorf("error in car store range call %d", resp.StatusCode)
+		}
+		hf.body = resp.Body
+	}
+
+	n, err := hf.body.Read(p)
+	hf.offset += int64(n)
+	return n, err
+}
+
+func (hf *httpCarFile) Seek(offset int64, whence int) (int64, error) {
+	var next int64
+	switch whence {
+	case io.SeekStart:
+		next = offset
+	case io.SeekCurrent:
+		next = hf.offset + offset
+	case io.SeekEnd:
+		next = hf.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if next < 0 {
+		return 0, fmt.Errorf("negative seek position %d", next)
+	}
+
+	if next != hf.offset && hf.body != nil {
+		hf.body.Close()
+		hf.body = nil
+	}
+	hf.offset = next
+
+	return next, nil
+}
+
+func (hf *httpCarFile) Close() error {
+	if hf.body != nil {
+		return hf.body.Close()
+	}
+	return nil
+}
+
+// Piece CIDs are used to build file paths, so ensure they can't be used to escape the store
+func validatePieceName(piece string) error {
+	if piece == "" || strings.ContainsAny(piece, `/\.`) {
+		return fmt.Errorf("invalid piece cid %s", piece)
+	}
+	return nil
+}
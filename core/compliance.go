@@ -0,0 +1,355 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+	"gorm.io/gorm"
+)
+
+const UNKNOWN_REGION = "unknown"
+
+// Summary of how a dataset is distributed across storage providers, as evidence for a FIL+ allocator or notary
+type ComplianceReport struct {
+	Dataset               string                `json:"dataset"`
+	GeneratedAt           time.Time             `json:"generated_at"`
+	OnChainOnly           bool                  `json:"on_chain_only"`
+	ReplicationQuota      uint64                `json:"replication_quota"`
+	TotalPieces           uint64                `json:"total_pieces"`
+	TotalPaddedBytes      uint64                `json:"total_padded_bytes"`
+	ReplicatedPieces      uint64                `json:"replicated_pieces"`
+	ReplicatedPaddedBytes uint64                `json:"replicated_padded_bytes"`
+	UniqueProviders       int                   `json:"unique_providers"`
+	ReplicasPerPiece      []ReplicaHistogramBin `json:"replicas_per_piece"`
+	Providers             []ProviderShare       `json:"providers"`
+	Regions               []RegionShare         `json:"regions"`
+	DuplicateReplicas     []DuplicateReplica    `json:"duplicate_replicas"`
+	OverReplicatedPieces  []OverReplicatedPiece `json:"over_replicated_pieces"`
+	DuplicatePayloads     []DuplicatePayload    `json:"duplicate_payloads"`
+}
+
+type ReplicaHistogramBin struct {
+	Replicas uint64 `json:"replicas"`
+	Pieces   uint64 `json:"pieces"`
+}
+
+type ProviderShare struct {
+	ActorID     string  `json:"actor_id"`
+	ActorName   string  `json:"actor_name,omitempty"`
+	Region      string  `json:"region"`
+	Replicas    uint64  `json:"replicas"`
+	PaddedBytes uint64  `json:"padded_bytes"`
+	Percentage  float64 `json:"percentage"`
+}
+
+type RegionShare struct {
+	Region      string  `json:"region"`
+	Providers   int     `json:"providers"`
+	Replicas    uint64  `json:"replicas"`
+	PaddedBytes uint64  `json:"padded_bytes"`
+	Percentage  float64 `json:"percentage"`
+}
+
+// A piece stored more than once with the same provider
+type DuplicateReplica struct {
+	PieceCid        string `json:"piece_cid"`
+	ProviderActorID string `json:"provider_actor_id"`
+	Replicas        uint64 `json:"replicas"`
+}
+
+// A piece with more replicas than the dataset's replication quota
+type OverReplicatedPiece struct {
+	PieceCid string `json:"piece_cid"`
+	Replicas uint64 `json:"replicas"`
+}
+
+// The same payload packed into more than one piece in the dataset
+type DuplicatePayload struct {
+	PayloadCid string   `json:"payload_cid"`
+	PieceCids  []string `json:"piece_cids"`
+}
+
+type compliancePiece struct {
+	CommP      string
+	PayloadCid string `gorm:"column:payload_c_id"`
+	PaddedSize uint64
+}
+
+type complianceReplica struct {
+	ContentCommP    string
+	ProviderActorID string
+}
+
+// Build the compliance report for a dataset, counting replications that have not failed or been cancelled
+// If onChainOnly is set, only replications that have landed on chain are counted
+func GenerateComplianceReport(dbi *gorm.DB, datasetName string, onChainOnly bool) (*ComplianceReport, error) {
+	var ds db.Dataset
+	res := dbi.Model(&db.Dataset{}).Where("name = ?", datasetName).Find(&ds)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to find dataset: %s", res.Error)
+	}
+	if ds.ID == 0 {
+		return nil, fmt.Errorf("dataset '%s' does not exist", datasetName)
+	}
+
+	var pieces []compliancePiece
+	res = dbi.Model(&db.Content{}).Select("comm_p, payload_c_id, padded_size").Where("dataset_id = ?", ds.ID).Scan(&pieces)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to query contents: %s", res.Error)
+	}
+
+	var replicas []complianceReplica
+	q := dbi.Model(&db.Replication{}).
+		Select("replications.content_comm_p, replications.provider_actor_id").
+		Joins("inner join contents c on c.comm_p = replications.content_comm_p").
+		Where("c.dataset_id = ? AND replications.status NOT IN ?", ds.ID, db.InactiveStatuses)
+	if onChainOnly {
+		q = q.Where("replications.on_chain_deal_id <> 0")
+	}
+	if res := q.Scan(&replicas); res.Error != nil {
+		return nil, fmt.Errorf("unable to query replications: %s", res.Error)
+	}
+
+	var providers []db.Provider
+	res = dbi.Model(&db.Provider{}).Find(&providers)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to query providers: %s", res.Error)
+	}
+
+	report := computeCompliance(pieces, replicas, providers, ds.ReplicationQuota)
+	report.Dataset = ds.Name
+	report.GeneratedAt = time.Now().UTC()
+	report.OnChainOnly = onChainOnly
+
+	return report, nil
+}
+
+func computeCompliance(pieces []compliancePiece, replicas []complianceReplica, providers []db.Provider, quota uint64) *ComplianceReport {
+	report := &ComplianceReport{
+		ReplicationQuota:     quota,
+		ReplicasPerPiece:     []ReplicaHistogramBin{},
+		Providers:            []ProviderShare{},
+		Regions:              []RegionShare{},
+		DuplicateReplicas:    []DuplicateReplica{},
+		OverReplicatedPieces: []OverReplicatedPiece{},
+		DuplicatePayloads:    []DuplicatePayload{},
+	}
+
+	sizes := make(map[string]uint64)
+	payloads := make(map[string][]string)
+	for _, p := range pieces {
+		sizes[p.CommP] = p.PaddedSize
+		report.TotalPieces++
+		report.TotalPaddedBytes += p.PaddedSize
+		if p.PayloadCid != "" {
+			payloads[p.PayloadCid] = append(payloads[p.PayloadCid], p.CommP)
+		}
+	}
+
+	type pieceProvider struct{ piece, provider string }
+	perPiece := make(map[string]uint64)
+	perPieceProvider := make(map[pieceProvider]uint64)
+	shares := make(map[string]*ProviderShare)
+	for _, r := range replicas {
+		size := sizes[r.ContentCommP]
+		perPiece[r.ContentCommP]++
+		perPieceProvider[pieceProvider{r.ContentCommP, r.ProviderActorID}]++
+		report.ReplicatedPaddedBytes += size
+
+		s, ok := shares[r.ProviderActorID]
+		if !ok {
+			s = &ProviderShare{ActorID: r.ProviderActorID, Region: UNKNOWN_REGION}
+			shares[r.ProviderActorID] = s
+		}
+		s.Replicas++
+		s.PaddedBytes += size
+	}
+
+	percentage := func(b uint64) float64 {
+		if report.ReplicatedPaddedBytes == 0 {
+			return 0
+		}
+		return 100 * float64(b) / float64(report.ReplicatedPaddedBytes)
+	}
+
+	for _, p := range providers {
+		if s, ok := shares[p.ActorID]; ok {
+			s.ActorName = p.ActorName
+			if p.Region != "" {
+				s.Region = p.Region
+			}
+		}
+	}
+
+	regions := make(map[string]*RegionShare)
+	for _, s := range shares {
+		s.Percentage = percentage(s.PaddedBytes)
+		report.Providers = append(report.Providers, *s)
+
+		rs, ok := regions[s.Region]
+		if !ok {
+			rs = &RegionShare{Region: s.Region}
+			regions[s.Region] = rs
+		}
+		rs.Providers++
+		rs.Replicas += s.Replicas
+		rs.PaddedBytes += s.PaddedBytes
+	}
+	report.UniqueProviders = len(shares)
+	sort.Slice(report.Providers, func(i, j int) bool {
+		if report.Providers[i].PaddedBytes != report.Providers[j].PaddedBytes {
+			return report.Providers[i].PaddedBytes > report.Providers[j].PaddedBytes
+		}
+		return report.Providers[i].ActorID < report.Providers[j].ActorID
+	})
+
+	for _, rs := range regions {
+		rs.Percentage = percentage(rs.PaddedBytes)
+		report.Regions = append(report.Regions, *rs)
+	}
+	sort.Slice(report.Regions, func(i, j int) bool {
+		if report.Regions[i].PaddedBytes != report.Regions[j].PaddedBytes {
+			return report.Regions[i].PaddedBytes > report.Regions[j].PaddedBytes
+		}
+		return report.Regions[i].Region < report.Regions[j].Region
+	})
+
+	// Pieces with no replicas are counted in the histogram too
+	histogram := make(map[uint64]uint64)
+	for _, p := range pieces {
+		n := perPiece[p.CommP]
+		histogram[n]++
+		if n > 0 {
+			report.ReplicatedPieces++
+		}
+		if quota > 0 && n > quota {
+			report.OverReplicatedPieces = append(report.OverReplicatedPieces, OverReplicatedPiece{PieceCid: p.CommP, Replicas: n})
+		}
+	}
+	for n, count := range histogram {
+		report.ReplicasPerPiece = append(report.ReplicasPerPiece, ReplicaHistogramBin{Replicas: n, Pieces: count})
+	}
+	sort.Slice(report.ReplicasPerPiece, func(i, j int) bool {
+		return report.ReplicasPerPiece[i].Replicas < report.ReplicasPerPiece[j].Replicas
+	})
+	sort.Slice(report.OverReplicatedPieces, func(i, j int) bool {
+		return report.OverReplicatedPieces[i].PieceCid < report.OverReplicatedPieces[j].PieceCid
+	})
+
+	for pp, n := range perPieceProvider {
+		if n > 1 {
+			report.DuplicateReplicas = append(report.DuplicateReplicas, DuplicateReplica{PieceCid: pp.piece, ProviderActorID: pp.provider, Replicas: n})
+		}
+	}
+	sort.Slice(report.DuplicateReplicas, func(i, j int) bool {
+		a, b := report.DuplicateReplicas[i], report.DuplicateReplicas[j]
+		if a.PieceCid != b.PieceCid {
+			return a.PieceCid < b.PieceCid
+		}
+		return a.ProviderActorID < b.ProviderActorID
+	})
+
+	for payload, cids := range payloads {
+		if len(cids) > 1 {
+			sort.Strings(cids)
+			report.DuplicatePayloads = append(report.DuplicatePayloads, DuplicatePayload{PayloadCid: payload, PieceCids: cids})
+		}
+	}
+	sort.Slice(report.DuplicatePayloads, func(i, j int) bool {
+		return report.DuplicatePayloads[i].PayloadCid < report.DuplicatePayloads[j].PayloadCid
+	})
+
+	return report
+}
+
+// Render the report as Markdown, suitable for pasting into an allocator application
+func (r *ComplianceReport) Markdown() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Compliance report: %s\n\n", r.Dataset)
+	fmt.Fprintf(&b, "Generated at %s", r.GeneratedAt.Format(time.RFC3339))
+	if r.OnChainOnly {
+		b.WriteString(", counting only deals that are on chain")
+	}
+	b.WriteString(".\n\n")
+
+	b.WriteString("## Summary\n\n")
+	b.WriteString("| | |\n|---|---|\n")
+	fmt.Fprintf(&b, "| Pieces | %d |\n", r.TotalPieces)
+	fmt.Fprintf(&b, "| Dataset size (padded) | %s |\n", formatBytes(r.TotalPaddedBytes))
+	fmt.Fprintf(&b, "| Pieces with at least one replica | %d |\n", r.ReplicatedPieces)
+	fmt.Fprintf(&b, "| Total replicated (padded) | %s |\n", formatBytes(r.ReplicatedPaddedBytes))
+	fmt.Fprintf(&b, "| Replication quota | %d |\n", r.ReplicationQuota)
+	fmt.Fprintf(&b, "| Unique providers | %d |\n\n", r.UniqueProviders)
+
+	b.WriteString("## Replicas per piece\n\n")
+	b.WriteString("| Replicas | Pieces |\n|---|---|\n")
+	for _, bin := range r.ReplicasPerPiece {
+		fmt.Fprintf(&b, "| %d | %d |\n", bin.Replicas, bin.Pieces)
+	}
+	b.WriteString("\n")
+
+	b.WriteString("## Data per provider\n\n")
+	b.WriteString("| Provider | Name | Region | Replicas | Size (padded) | Share |\n|---|---|---|---|---|---|\n")
+	for _, p := range r.Providers {
+		fmt.Fprintf(&b, "| %s | %s | %s | %d | %s | %.2f%% |\n", p.ActorID, p.ActorName, p.Region, p.Replicas, formatBytes(p.PaddedBytes), p.Percentage)
+	}
+	b.WriteString("\n")
+
+	b.WriteString("## Regions\n\n")
+	b.WriteString("| Region | Providers | Replicas | Size (padded) | Share |\n|---|---|---|---|---|\n")
+	for _, rs := range r.Regions {
+		fmt.Fprintf(&b, "| %s | %d | %d | %s | %.2f%% |\n", rs.Region, rs.Providers, rs.Replicas, formatBytes(rs.PaddedBytes), rs.Percentage)
+	}
+	b.WriteString("\n")
+
+	b.WriteString("## Duplicates\n\n")
+	if len(r.DuplicateReplicas) == 0 && len(r.OverReplicatedPieces) == 0 && len(r.DuplicatePayloads) == 0 {
+		b.WriteString("No duplicates found.\n")
+		return b.String()
+	}
+	if len(r.DuplicateReplicas) > 0 {
+		b.WriteString("Pieces stored more than once with the same provider:\n\n")
+		b.WriteString("| Piece | Provider | Replicas |\n|---|---|---|\n")
+		for _, d := range r.DuplicateReplicas {
+			fmt.Fprintf(&b, "| %s | %s | %d |\n", d.PieceCid, d.ProviderActorID, d.Replicas)
+		}
+		b.WriteString("\n")
+	}
+	if len(r.OverReplicatedPieces) > 0 {
+		fmt.Fprintf(&b, "Pieces with more than %d replicas:\n\n", r.ReplicationQuota)
+		b.WriteString("| Piece | Replicas |\n|---|---|\n")
+		for _, p := range r.OverReplicatedPieces {
+			fmt.Fprintf(&b, "| %s | %d |\n", p.PieceCid, p.Replicas)
+		}
+		b.WriteString("\n")
+	}
+	if len(r.DuplicatePayloads) > 0 {
+		b.WriteString("Payloads packed into more than one piece:\n\n")
+		b.WriteString("| Payload | Pieces |\n|---|---|\n")
+		for _, d := range r.DuplicatePayloads {
+			fmt.Fprintf(&b, "| %s | %s |\n", d.PayloadCid, strings.Join(d.PieceCids, ", "))
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// Format a number of bytes in binary units, i.e 1.50 TiB
+func formatBytes(n uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.2f %s", f, units[i])
+}
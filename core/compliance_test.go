@@ -0,0 +1,72 @@
+package core
+
+import (
+	"testing"
+
+	db "github.com/application-research/delta-dm/db"
+)
+
+func TestComputeCompliance(t *testing.T) {
+	pieces := []compliancePiece{
+		{CommP: "baga1", PayloadCid: "bafy1", PaddedSize: 100},
+		{CommP: "baga2", PayloadCid: "bafy2", PaddedSize: 100},
+		{CommP: "baga3", PayloadCid: "bafy1", PaddedSize: 500},
+		{CommP: "baga4", PayloadCid: "bafy4", PaddedSize: 100},
+	}
+	replicas := []complianceReplica{
+		{ContentCommP: "baga1", ProviderActorID: "f01000"},
+		{ContentCommP: "baga1", ProviderActorID: "f02000"},
+		{ContentCommP: "baga1", ProviderActorID: "f03000"},
+		{ContentCommP: "baga2", ProviderActorID: "f01000"},
+		{ContentCommP: "baga2", ProviderActorID: "f01000"},
+		{ContentCommP: "baga3", ProviderActorID: "f02000"},
+	}
+	providers := []db.Provider{
+		{ActorID: "f01000", ActorName: "one", Region: "europe"},
+		{ActorID: "f02000", Region: "asia"},
+	}
+
+	r := computeCompliance(pieces, replicas, providers, 2)
+
+	if r.TotalPieces != 4 || r.TotalPaddedBytes != 800 || r.ReplicatedPieces != 3 || r.ReplicatedPaddedBytes != 1000 {
+		t.Errorf("unexpected totals: %+v", r)
+	}
+	if r.UniqueProviders != 3 {
+		t.Errorf("unique providers = %d, want 3", r.UniqueProviders)
+	}
+
+	wantHistogram := []ReplicaHistogramBin{{0, 1}, {1, 1}, {2, 1}, {3, 1}}
+	if len(r.ReplicasPerPiece) != len(wantHistogram) {
+		t.Fatalf("histogram = %+v, want %+v", r.ReplicasPerPiece, wantHistogram)
+	}
+	for i, bin := range wantHistogram {
+		if r.ReplicasPerPiece[i] != bin {
+			t.Errorf("histogram = %+v, want %+v", r.ReplicasPerPiece, wantHistogram)
+			break
+		}
+	}
+
+	// f02000 stores 600 bytes, f01000 300 and f03000, which has no region set, 100
+	if r.Providers[0].ActorID != "f02000" || r.Providers[0].Percentage != 60 {
+		t.Errorf("unexpected first provider: %+v", r.Providers[0])
+	}
+	if r.Providers[1].ActorName != "one" || r.Providers[1].Replicas != 3 {
+		t.Errorf("unexpected second provider: %+v", r.Providers[1])
+	}
+	if r.Providers[2].ActorID != "f03000" || r.Providers[2].Region != UNKNOWN_REGION {
+		t.Errorf("unexpected last provider: %+v", r.Providers[2])
+	}
+	if len(r.Regions) != 3 || r.Regions[2].Region != UNKNOWN_REGION || r.Regions[2].Percentage != 10 {
+		t.Errorf("unexpected regions: %+v", r.Regions)
+	}
+
+	if len(r.DuplicateReplicas) != 1 || r.DuplicateReplicas[0] != (DuplicateReplica{"baga2", "f01000", 2}) {
+		t.Errorf("duplicate replicas = %+v", r.DuplicateReplicas)
+	}
+	if len(r.OverReplicatedPieces) != 1 || r.OverReplicatedPieces[0] != (OverReplicatedPiece{"baga1", 3}) {
+		t.Errorf("over replicated pieces = %+v", r.OverReplicatedPieces)
+	}
+	if len(r.DuplicatePayloads) != 1 || r.DuplicatePayloads[0].PayloadCid != "bafy1" || len(r.DuplicatePayloads[0].PieceCids) != 2 {
+		t.Errorf("duplicate payloads = %+v", r.DuplicatePayloads)
+	}
+}
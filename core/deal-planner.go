@@ -0,0 +1,584 @@
+package core
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+	"gorm.io/gorm"
+)
+
+// Bounds on when deals may start (days from now), and how many days before the end of a dataset's deal duration they may end
+const DEFAULT_START_DELAY_DAYS = 3
+const MIN_START_DELAY_DAYS = 1
+const MAX_START_DELAY_DAYS = 14
+const MAX_END_ADVANCE_DAYS = 20
+
+// The minimum duration of a deal on the Filecoin network
+const MIN_DEAL_DURATION_DAYS = 180
+
+const MAINNET_GENESIS_UNIX = 1598306400
+const EPOCH_DURATION_SECONDS = 30
+
+// The order content is selected in for replication
+type SelectionStrategy string
+
+const (
+	// Content with the fewest replications first, so replicas are spread evenly across a dataset
+	SelectionFewestReplicas SelectionStrategy = "fewest_replicas"
+	// Content that was imported first
+	SelectionOldest   SelectionStrategy = "oldest"
+	SelectionRandom   SelectionStrategy = "random"
+	SelectionLargest  SelectionStrategy = "largest"
+	SelectionSmallest SelectionStrategy = "smallest"
+)
+
+const DEFAULT_SELECTION_STRATEGY = SelectionFewestReplicas
+
+// Parse a selection strategy. An empty string is the default strategy
+func ParseSelectionStrategy(s string) (SelectionStrategy, error) {
+	switch SelectionStrategy(s) {
+	case "":
+		return DEFAULT_SELECTION_STRATEGY, nil
+	case SelectionFewestReplicas, SelectionOldest, SelectionRandom, SelectionLargest, SelectionSmallest:
+		return SelectionStrategy(s), nil
+	default:
+		return "", fmt.Errorf("invalid strategy '%s', must be one of fewest_replicas, oldest, random, largest, smallest", s)
+	}
+}
+
+// ORDER BY clause for the content selection query. Ties are broken by piece CID so the order is stable
+func (ss SelectionStrategy) orderBy() string {
+	switch ss {
+	case SelectionOldest:
+		return "c.imported_at ASC, c.comm_p ASC"
+	case SelectionRandom:
+		return "RANDOM()"
+	case SelectionLargest:
+		return "c.padded_size DESC, c.comm_p ASC"
+	case SelectionSmallest:
+		return "c.padded_size ASC, c.comm_p ASC"
+	default:
+		return "c.num_replications ASC, c.comm_p ASC"
+	}
+}
+
+// What to plan deals for. Either a list of pieces is given, or content is selected from what the provider may replicate -
+// optionally from a single dataset, up to Count deals and/or MaxBytes of padded data
+type DealPlanOptions struct {
+	ProviderActorID string
+	Pieces          []string
+	DatasetID       *uint
+	Count           *uint
+	MaxBytes        uint64
+	StartDelayDays  *uint64 // DEFAULT_START_DELAY_DAYS if nil
+	EndAdvanceDays  *uint64 // 0 if nil
+	SelfService     bool
+	Strategy        SelectionStrategy // order content is selected in. DEFAULT_SELECTION_STRATEGY if empty
+}
+
+// A piece that was requested or selected, but will not be dealt
+type SkippedPiece struct {
+	Cid    string `json:"cid"`
+	Reason string `json:"reason"`
+}
+
+// The deals to make with a provider, which can be previewed or executed
+type DealPlan struct {
+	Provider       string             `json:"provider"`
+	SelfService    bool               `json:"self_service"`
+	StartDelayDays uint64             `json:"start_delay_days"`
+	EndAdvanceDays uint64             `json:"end_advance_days"`
+	Deals          OfflineDealRequest `json:"deals"`
+	Skipped        []SkippedPiece     `json:"skipped"`
+	// The content of each planned deal, by piece CID
+	Contents     map[string]db.Content `json:"-"`
+	datasetNames map[uint]string
+}
+
+// What a plan would do, without making any deals
+type DealPlanPreview struct {
+	Provider         string          `json:"provider"`
+	Deals            []DealPreview   `json:"deals"`
+	TotalDeals       int             `json:"total_deals"`
+	TotalPaddedBytes uint64          `json:"total_padded_bytes"`
+	TotalCostFil     string          `json:"total_cost_fil"`
+	DatacapByWallet  []WalletDatacap `json:"datacap_by_wallet"`
+	Skipped          []SkippedPiece  `json:"skipped"`
+	// Set if the deals would take a dataset over its budget, in which case they would not be made
+	BudgetError string `json:"budget_error,omitempty"`
+}
+
+type DealPreview struct {
+	PieceCid       string `json:"piece_cid"`
+	PayloadCid     string `json:"payload_cid"`
+	Dataset        string `json:"dataset"`
+	Wallet         string `json:"wallet"`
+	PaddedSize     uint64 `json:"padded_size"`
+	Verified       bool   `json:"verified"`
+	ConnectionMode string `json:"connection_mode"`
+	DurationDays   uint64 `json:"duration_days"`
+	StartEpoch     int64  `json:"start_epoch"` // estimated, as the chain epoch is only known when the deal is made
+	EndEpoch       int64  `json:"end_epoch"`
+	PricePerEpoch  string `json:"price_per_epoch,omitempty"` // attoFIL
+	CostFil        string `json:"cost_fil,omitempty"`
+}
+
+// Datacap a wallet would spend on verified deals
+type WalletDatacap struct {
+	Wallet       string `json:"wallet"`
+	Deals        uint64 `json:"deals"`
+	DatacapBytes uint64 `json:"datacap_bytes"`
+}
+
+// Content that a provider may replicate, along with its dataset and the provider's replication profile for it
+type UnreplicatedContent struct {
+	db.Content
+	db.Dataset
+	// Note: We can't use `db.ReplicationProfile` here because it has a `DatasetID` field which conflicts with the `Dataset` field above
+	// Thus, the profile's fields are added manually
+	Unsealed         bool
+	Indexed          bool
+	Verified         *bool
+	PricePerGiBEpoch string `gorm:"column:price_per_gib_epoch"`
+	// Both the dataset and replication profile have a connection mode, so they are selected under different names
+	DatasetConnectionMode db.ConnectionMode
+	ProfileConnectionMode db.ConnectionMode
+}
+
+func (uc UnreplicatedContent) dataset() db.Dataset {
+	ds := uc.Dataset
+	ds.ConnectionMode = uc.DatasetConnectionMode
+	return ds
+}
+
+// The provider's replication profile for the content's dataset
+func (uc UnreplicatedContent) profile(providerActorID string) db.ReplicationProfile {
+	return db.ReplicationProfile{
+		ProviderActorID:  providerActorID,
+		DatasetID:        uc.Content.DatasetID,
+		Unsealed:         uc.Unsealed,
+		Indexed:          uc.Indexed,
+		Verified:         uc.Verified,
+		PricePerGiBEpoch: uc.PricePerGiBEpoch,
+		ConnectionMode:   uc.ProfileConnectionMode,
+	}
+}
+
+type dealCandidate struct {
+	content db.Content
+	dataset db.Dataset
+	profile db.ReplicationProfile
+}
+
+// Plan deals for a provider: select or check the content, and build a deal for each piece with the provider's replication profile,
+// the dataset's wallet and the requested epoch bounds. Pieces that cannot be dealt are skipped, with the reason why
+// Hold the AllocationLock from planning until the plan is recorded, so other requests cannot allocate the same content
+func (dldm *DeltaDM) PlanDeals(opts DealPlanOptions) (*DealPlan, error) {
+	startDays, advanceDays, err := ValidateEpochBounds(opts.StartDelayDays, opts.EndAdvanceDays)
+	if err != nil {
+		return nil, err
+	}
+
+	var p db.Provider
+	res := dldm.DB.Model(&db.Provider{}).Preload("ReplicationProfiles").Where("actor_id = ?", opts.ProviderActorID).Find(&p)
+	if res.Error != nil {
+		return nil, fmt.Errorf("could not check if provider %s exists: %s", opts.ProviderActorID, res.Error)
+	}
+	if p.ActorID == "" {
+		return nil, fmt.Errorf("provider %s does not exist in ddm. please add it first", opts.ProviderActorID)
+	}
+
+	plan := &DealPlan{
+		Provider:       p.ActorID,
+		SelfService:    opts.SelfService,
+		StartDelayDays: startDays,
+		EndAdvanceDays: advanceDays,
+		Deals:          OfflineDealRequest{},
+		Skipped:        []SkippedPiece{},
+		Contents:       make(map[string]db.Content),
+		datasetNames:   make(map[uint]string),
+	}
+
+	var candidates []dealCandidate
+	if len(opts.Pieces) > 0 {
+		seen := make(map[string]bool)
+		for _, piece := range opts.Pieces {
+			if seen[piece] {
+				plan.Skipped = append(plan.Skipped, SkippedPiece{Cid: piece, Reason: "piece is duplicated in request"})
+				continue
+			}
+			seen[piece] = true
+
+			cnt, ds, rp, err := CheckPiece(dldm.DB, p, piece)
+			if err != nil {
+				plan.Skipped = append(plan.Skipped, SkippedPiece{Cid: piece, Reason: err.Error()})
+				continue
+			}
+			candidates = append(candidates, dealCandidate{content: *cnt, dataset: *ds, profile: *rp})
+		}
+	} else {
+		if opts.DatasetID != nil {
+			var ds db.Dataset
+			res := dldm.DB.Model(&db.Dataset{}).Where("id = ?", *opts.DatasetID).Find(&ds)
+			if res.Error != nil {
+				return nil, fmt.Errorf("could not check if dataset with id %d exists: %s", *opts.DatasetID, res.Error)
+			}
+			if ds.ID == 0 {
+				return nil, fmt.Errorf("dataset id %d does not exist in ddm", *opts.DatasetID)
+			}
+			if _, ok := profileFor(p, ds.ID); !ok {
+				return nil, fmt.Errorf("provider '%s' is not allowed to replicate dataset '%s'", p.ActorID, ds.Name)
+			}
+		}
+
+		cnt, err := FindUnreplicatedContent(dldm.DB, p.ActorID, opts.DatasetID, opts.Count, opts.Strategy, false)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find content to replicate: %s", err)
+		}
+
+		var total uint64
+		for _, c := range cnt {
+			// Pieces that would take the plan over MaxBytes are left out, so smaller ones may still fit
+			if opts.MaxBytes > 0 && total+c.PaddedSize > opts.MaxBytes {
+				continue
+			}
+			total += c.PaddedSize
+			candidates = append(candidates, dealCandidate{content: c.Content, dataset: c.dataset(), profile: c.profile(p.ActorID)})
+		}
+	}
+
+	wallets := make(map[uint]string)
+	for _, cd := range candidates {
+		walletAddr, ok := wallets[cd.dataset.ID]
+		if !ok {
+			w, err := SelectWallet(dldm.DB, cd.dataset.ID)
+			if err == nil {
+				walletAddr = w.Addr
+			}
+			wallets[cd.dataset.ID] = walletAddr
+		}
+
+		if walletAddr == "" {
+			plan.Skipped = append(plan.Skipped, SkippedPiece{Cid: cd.content.CommP, Reason: fmt.Sprintf("dataset '%s' does not have a wallet", cd.dataset.Name)})
+			continue
+		}
+
+		deal, err := NewDeal(cd.content, cd.dataset, cd.profile, walletAddr, startDays, advanceDays)
+		if err != nil {
+			plan.Skipped = append(plan.Skipped, SkippedPiece{Cid: cd.content.CommP, Reason: err.Error()})
+			continue
+		}
+
+		plan.Deals = append(plan.Deals, deal)
+		plan.Contents[cd.content.CommP] = cd.content
+		plan.datasetNames[cd.dataset.ID] = cd.dataset.Name
+	}
+
+	return plan, nil
+}
+
+// Record the deals in a plan, to be sent to Delta with SendDeals once the AllocationLock is released
+func (dldm *DeltaDM) RecordPlan(plan *DealPlan, authKey string) (*RecordedDeals, error) {
+	if len(plan.Deals) == 0 {
+		return nil, fmt.Errorf("no deals to make")
+	}
+
+	return dldm.RecordDeals(plan.Deals, authKey, plan.SelfService)
+}
+
+// Plan deals and record them, holding the AllocationLock throughout. planFn returns an error to record nothing
+// The recorded deals are nil if the plan has no deals, and are sent to Delta with SendDeals once the lock is released
+func (dldm *DeltaDM) AllocateDeals(planFn func() (*DealPlan, error), authKey string) (*DealPlan, *RecordedDeals, error) {
+	dldm.AllocationLock.Lock()
+	defer dldm.AllocationLock.Unlock()
+
+	plan, err := planFn()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(plan.Deals) == 0 {
+		return plan, nil, nil
+	}
+
+	recorded, err := dldm.RecordPlan(plan, authKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return plan, recorded, nil
+}
+
+// Summarize what the plan would do, as of the given time
+func (dldm *DeltaDM) PreviewPlan(plan *DealPlan, now time.Time) DealPlanPreview {
+	preview := DealPlanPreview{
+		Provider:        plan.Provider,
+		Deals:           []DealPreview{},
+		TotalDeals:      len(plan.Deals),
+		DatacapByWallet: []WalletDatacap{},
+		Skipped:         plan.Skipped,
+	}
+
+	currentEpoch := ChainEpochAt(now)
+	totalCost := big.NewInt(0)
+	datacap := make(map[string]*WalletDatacap)
+	var wallets []string
+
+	for _, d := range plan.Deals {
+		startEpoch := currentEpoch + int64(d.StartEpochInDays*EPOCHS_PER_DAY)
+		dp := DealPreview{
+			PieceCid:       d.PieceCommitment.PieceCid,
+			PayloadCid:     d.PayloadCID,
+			Dataset:        plan.datasetNames[d.DatasetID],
+			Wallet:         d.Wallet.Addr,
+			PaddedSize:     d.PieceCommitment.PaddedPieceSize,
+			Verified:       d.DealVerifyState != "unverified",
+			ConnectionMode: d.ConnectionMode,
+			DurationDays:   d.DurationInDays,
+			StartEpoch:     startEpoch,
+			EndEpoch:       startEpoch + int64(d.DurationInDays*EPOCHS_PER_DAY),
+			PricePerEpoch:  d.PricePerEpoch,
+		}
+		if d.Cost != nil {
+			dp.CostFil = FormatFil(d.Cost)
+			totalCost.Add(totalCost, d.Cost)
+		}
+		preview.Deals = append(preview.Deals, dp)
+		preview.TotalPaddedBytes += dp.PaddedSize
+
+		if dp.Verified {
+			wd, ok := datacap[dp.Wallet]
+			if !ok {
+				wd = &WalletDatacap{Wallet: dp.Wallet}
+				datacap[dp.Wallet] = wd
+				wallets = append(wallets, dp.Wallet)
+			}
+			wd.Deals++
+			wd.DatacapBytes += dp.PaddedSize
+		}
+	}
+
+	for _, w := range wallets {
+		preview.DatacapByWallet = append(preview.DatacapByWallet, *datacap[w])
+	}
+	preview.TotalCostFil = FormatFil(totalCost)
+
+	if err := CheckDatasetBudgets(dldm.DB, plan.Deals); err != nil {
+		preview.BudgetError = err.Error()
+	}
+
+	return preview
+}
+
+// Estimate the Filecoin mainnet chain epoch at a given time
+func ChainEpochAt(t time.Time) int64 {
+	return (t.Unix() - MAINNET_GENESIS_UNIX) / EPOCH_DURATION_SECONDS
+}
+
+// Check the start delay and end advance of deals are within bounds, returning them with defaults applied
+func ValidateEpochBounds(startDelayDays *uint64, endAdvanceDays *uint64) (uint64, uint64, error) {
+	var start uint64 = DEFAULT_START_DELAY_DAYS
+	var advance uint64 = 0
+
+	if startDelayDays != nil {
+		if *startDelayDays < MIN_START_DELAY_DAYS || *startDelayDays > MAX_START_DELAY_DAYS {
+			return 0, 0, fmt.Errorf("start_epoch_delay must be between %d and %d days", MIN_START_DELAY_DAYS, MAX_START_DELAY_DAYS)
+		}
+		start = *startDelayDays
+	}
+
+	if endAdvanceDays != nil {
+		if *endAdvanceDays > MAX_END_ADVANCE_DAYS {
+			return 0, 0, fmt.Errorf("end_epoch_advance must be between 0 and %d days", MAX_END_ADVANCE_DAYS)
+		}
+		advance = *endAdvanceDays
+	}
+
+	return start, advance, nil
+}
+
+// Check that a provider may make a deal for a piece: the content exists, the provider has a replication profile for its dataset,
+// it is within its replication quota, and it is not already replicated to the provider
+func CheckPiece(dbi *gorm.DB, p db.Provider, piece string) (*db.Content, *db.Dataset, *db.ReplicationProfile, error) {
+	var cnt db.Content
+	res := dbi.Model(&db.Content{}).Preload("Replications").Where("comm_p = ?", piece).Find(&cnt)
+	if res.Error != nil {
+		return nil, nil, nil, fmt.Errorf("unable to find content '%s': %s", piece, res.Error)
+	}
+	if cnt.CommP == "" {
+		return nil, nil, nil, fmt.Errorf("content '%s' does not exist in ddm", piece)
+	}
+
+	var ds db.Dataset
+	res = dbi.Model(&db.Dataset{}).Where("id = ?", cnt.DatasetID).Find(&ds)
+	if res.Error != nil {
+		return nil, nil, nil, fmt.Errorf("unable to find dataset %d associated with requested CID", cnt.DatasetID)
+	}
+
+	rp, ok := profileFor(p, ds.ID)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("provider '%s' is not allowed to replicate dataset '%s'", p.ActorID, ds.Name)
+	}
+
+	reserved, err := CountOtherReservations(dbi, p.ActorID, piece)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to check reservations for content '%s': %s", piece, err)
+	}
+
+	if cnt.NumReplications+uint64(reserved) >= ds.ReplicationQuota {
+		return nil, nil, nil, fmt.Errorf("content '%s' has reached its replication quota of %d", piece, ds.ReplicationQuota)
+	}
+
+	// Ensure no pending/successful replications have been made for this content to this provider
+	for _, repl := range cnt.Replications {
+		if repl.ProviderActorID == p.ActorID && !repl.Status.IsInactive() {
+			return nil, nil, nil, fmt.Errorf("content '%s' is already replicated to provider '%s'", piece, p.ActorID)
+		}
+	}
+
+	return &cnt, &ds, &rp, nil
+}
+
+// The provider's replication profile for a dataset, if it is allowed to replicate it
+func profileFor(p db.Provider, datasetID uint) (db.ReplicationProfile, bool) {
+	for _, rp := range p.ReplicationProfiles {
+		if rp.DatasetID == datasetID {
+			return rp, true
+		}
+	}
+	return db.ReplicationProfile{}, false
+}
+
+// Query the database for all contant that does not have replications to this actor yet
+// Arguments: providerID - the actor ID of the provider
+//
+//		datasetID (optional) - the ID of the dataset to replicate
+//		numDeals (optional) - the number of replications (deals) to return. If nil, return all
+//		strategy - the order to return content in, after any content the provider has reserved. DEFAULT_SELECTION_STRATEGY if empty
+//	 filterOnlyContentLocations - if true, only return content where the content_location is present (i.e, downloadable)
+func FindUnreplicatedContent(dbi *gorm.DB, providerID string, datasetId *uint, numDeals *uint, strategy SelectionStrategy, filterOnlyContentLocations bool) ([]UnreplicatedContent, error) {
+	rawQuery, rawValues := unreplicatedContentQuery("*, d.connection_mode AS dataset_connection_mode, rp.connection_mode AS profile_connection_mode", providerID, datasetId, filterOnlyContentLocations)
+
+	if strategy == "" {
+		strategy = DEFAULT_SELECTION_STRATEGY
+	}
+	// Content the provider has reserved comes first, so its reservations are used up before unreserved content is handed out
+	rawQuery += `
+  ORDER BY CASE WHEN EXISTS (
+    SELECT 1
+    FROM reservations rs
+    WHERE rs.content_comm_p = c.comm_p
+    AND rs.provider_actor_id = ?
+    AND rs.expires_at > ?
+    AND rs.deleted_at IS NULL
+  ) THEN 0 ELSE 1 END, ` + strategy.orderBy()
+	rawValues = append(rawValues, providerID, time.Now())
+
+	if numDeals != nil {
+		rawQuery += " LIMIT ?"
+		rawValues = append(rawValues, numDeals)
+	}
+	var contents []UnreplicatedContent
+	tx := dbi.Raw(rawQuery, rawValues...).Scan(&contents)
+
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	return contents, nil
+}
+
+// Count the content that does not have replications to this actor yet. Arguments are as for FindUnreplicatedContent
+func CountUnreplicatedContent(dbi *gorm.DB, providerID string, datasetId *uint, filterOnlyContentLocations bool) (uint64, error) {
+	rawQuery, rawValues := unreplicatedContentQuery("COUNT(*)", providerID, datasetId, filterOnlyContentLocations)
+
+	var count uint64
+	err := dbi.Raw(rawQuery, rawValues...).Row().Scan(&count)
+
+	return count, err
+}
+
+// Count the content that does not have replications to this actor yet, in each dataset it may replicate. Datasets with none are omitted
+func CountUnreplicatedContentByDataset(dbi *gorm.DB, providerID string, filterOnlyContentLocations bool) (map[uint]uint64, error) {
+	rawQuery, rawValues := unreplicatedContentQuery("c.dataset_id, COUNT(*)", providerID, nil, filterOnlyContentLocations)
+
+	rows, err := dbi.Raw(rawQuery+" GROUP BY c.dataset_id", rawValues...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[uint]uint64)
+	for rows.Next() {
+		var datasetId uint
+		var count uint64
+		if err := rows.Scan(&datasetId, &count); err != nil {
+			return nil, err
+		}
+		counts[datasetId] = count
+	}
+
+	return counts, rows.Err()
+}
+
+func unreplicatedContentQuery(columns string, providerID string, datasetId *uint, filterOnlyContentLocations bool) (string, []interface{}) {
+	rawQuery := `
+  SELECT ` + columns + `
+  FROM datasets d
+  INNER JOIN contents c ON d.id = c.dataset_id
+  INNER JOIN replication_profiles rp ON rp.dataset_id = d.id
+	-- Only select content that does not have a non-failed replication to this provider
+	-- An anti-join, so each content is checked with a lookup on idx_replications_content_provider rather than a scan of all replications
+  WHERE NOT EXISTS (
+    SELECT 1
+    FROM replications r
+    WHERE r.content_comm_p = c.comm_p
+    AND r.provider_actor_id = ?
+    AND r.status NOT IN ?
+  )
+  -- Only select content from datasets that this provider is allowed to replicate
+  AND rp.provider_actor_id = ?
+  -- Active reservations held by other providers count against the quota
+  AND c.num_replications + (
+    SELECT COUNT(*)
+    FROM reservations rs
+    WHERE rs.content_comm_p = c.comm_p
+    AND rs.provider_actor_id <> ?
+    AND rs.expires_at > ?
+    AND rs.deleted_at IS NULL
+  ) < d.replication_quota
+	`
+
+	if filterOnlyContentLocations {
+		rawQuery += " AND c.content_location IS NOT NULL"
+	}
+	var rawValues = []interface{}{providerID, db.InactiveStatuses, providerID, providerID, time.Now()}
+
+	if datasetId != nil && *datasetId != 0 {
+		rawQuery += " AND d.id = ?"
+		rawValues = append(rawValues, datasetId)
+	}
+
+	return rawQuery, rawValues
+}
+
+// Find which wallet to use when making deals for a given dataset
+func SelectWallet(dbi *gorm.DB, datasetId uint) (*db.Wallet, error) {
+	var w []db.Wallet
+
+	res := dbi.Raw("select * from wallets w inner join wallet_datasets wd on w.addr = wd.wallet_addr inner join datasets d on wd.dataset_id = d.id where d.id = ?", datasetId).Scan(&w)
+
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if len(w) == 0 {
+		return nil, fmt.Errorf("no wallet found for dataset '%d'", datasetId)
+	}
+
+	// TODO: Wallet selection algorithm
+	// Just choose the first wallet for now
+	return &w[0], nil
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+)
+
+func TestValidateEpochBounds(t *testing.T) {
+	u := func(n uint64) *uint64 { return &n }
+
+	tests := []struct {
+		start       *uint64
+		advance     *uint64
+		wantStart   uint64
+		wantAdvance uint64
+		wantErr     bool
+	}{
+		{nil, nil, DEFAULT_START_DELAY_DAYS, 0, false},
+		{u(1), u(20), 1, 20, false},
+		{u(0), nil, 0, 0, true},
+		{u(15), nil, 0, 0, true},
+		{nil, u(21), 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		start, advance, err := ValidateEpochBounds(tt.start, tt.advance)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateEpochBounds(%v, %v) error = %v, wantErr %v", tt.start, tt.advance, err, tt.wantErr)
+			continue
+		}
+		if start != tt.wantStart || advance != tt.wantAdvance {
+			t.Errorf("ValidateEpochBounds(%v, %v) = %d, %d, want %d, %d", tt.start, tt.advance, start, advance, tt.wantStart, tt.wantAdvance)
+		}
+	}
+}
+
+func TestNewDealDuration(t *testing.T) {
+	cnt := db.Content{CommP: "baga", PaddedSize: 1 << 30}
+	rp := db.ReplicationProfile{ProviderActorID: "f01000"}
+
+	deal, err := NewDeal(cnt, db.Dataset{Name: "ds", DealDuration: 540}, rp, "f1wallet", 3, 20)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if deal.DurationInDays != 520 {
+		t.Errorf("duration = %d, want 520", deal.DurationInDays)
+	}
+
+	// Would underflow, or be shorter than the minimum deal duration
+	for _, advance := range []uint64{1, 200} {
+		if _, err := NewDeal(cnt, db.Dataset{Name: "ds", DealDuration: 180}, rp, "f1wallet", 3, advance); err == nil {
+			t.Errorf("expected an error for an advance of %d days on a 180 day dataset", advance)
+		}
+	}
+}
+
+func TestFindUnreplicatedContentReservedFirst(t *testing.T) {
+	dbi, err := db.OpenDatabase(filepath.Join(t.TempDir(), "ddm.db"), db.PoolOptions{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := []interface{}{
+		&db.Dataset{Name: "ds", ReplicationQuota: 3},
+		&db.Provider{ActorID: "f01000"},
+		&db.ReplicationProfile{ProviderActorID: "f01000", DatasetID: 1},
+		&db.Content{CommP: "a", DatasetID: 1},
+		&db.Content{CommP: "b", DatasetID: 1},
+		&db.Content{CommP: "c", DatasetID: 1},
+		&db.Reservation{ProviderActorID: "f01000", ContentCommP: "c", ExpiresAt: time.Now().Add(time.Hour)},
+		// Expired, so not preferred
+		&db.Reservation{ProviderActorID: "f01000", ContentCommP: "b", ExpiresAt: time.Now().Add(-time.Hour)},
+	}
+	for _, m := range seed {
+		if err := dbi.Omit("Content").Create(m).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, strategy := range []SelectionStrategy{SelectionFewestReplicas, SelectionOldest} {
+		cnt, err := FindUnreplicatedContent(dbi, "f01000", nil, nil, strategy, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, c := range cnt {
+			got = append(got, c.CommP)
+		}
+		if len(got) != 3 || got[0] != "c" || got[1] != "a" || got[2] != "b" {
+			t.Errorf("%s: selected %v, want [c a b]", strategy, got)
+		}
+	}
+}
+
+func TestPlanDealsMaxBytes(t *testing.T) {
+	dbi, err := db.OpenDatabase(filepath.Join(t.TempDir(), "ddm.db"), db.PoolOptions{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const gib = 1 << 30
+	seed := []interface{}{
+		&db.Dataset{Name: "ds", ReplicationQuota: 3, DealDuration: 540},
+		&db.Provider{ActorID: "f01000"},
+		&db.ReplicationProfile{ProviderActorID: "f01000", DatasetID: 1},
+		&db.Wallet{Addr: "f1wallet"},
+		&db.WalletDatasets{WalletAddr: "f1wallet", DatasetID: 1},
+		&db.Content{CommP: "a", DatasetID: 1, PaddedSize: gib},
+		&db.Content{CommP: "b", DatasetID: 1, PaddedSize: gib},
+		&db.Content{CommP: "c", DatasetID: 1, PaddedSize: gib / 2},
+	}
+	for _, m := range seed {
+		if err := dbi.Omit("Content").Create(m).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dldm := &DeltaDM{DB: dbi}
+	for _, maxBytes := range []uint64{gib / 4, gib / 2, gib + gib/4, 2 * gib, 4 * gib} {
+		plan, err := dldm.PlanDeals(DealPlanOptions{ProviderActorID: "f01000", MaxBytes: maxBytes, Strategy: SelectionLargest})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var total uint64
+		for _, d := range plan.Deals {
+			total += d.PieceCommitment.PaddedPieceSize
+		}
+		if total > maxBytes {
+			t.Errorf("max bytes %d: planned %d bytes", maxBytes, total)
+		}
+	}
+}
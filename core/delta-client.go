@@ -0,0 +1,202 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Returned (wrapped) when a Delta node can't be reached, or has failed so many requests in a row that DDM has stopped sending it requests for a while
+var ErrDeltaUnavailable = errors.New("delta unavailable")
+
+// How requests to a Delta node are made
+type DeltaClientOptions struct {
+	// Max time for a request, including reading its response. E2E deals upload the deal's data, so are only bound by ConnectTimeout
+	Timeout        time.Duration
+	ConnectTimeout time.Duration
+	// Idempotent requests (reads, and deal status lookups) are retried this many times, with exponential backoff and jitter, if the node can't be reached
+	Retries      int
+	RetryBackoff time.Duration
+	// After this many requests in a row fail to reach the node, requests fail straight away with ErrDeltaUnavailable,
+	// with one let through every BreakerCooldown to see if it has recovered. 0 disables the breaker
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+var DefaultDeltaClientOptions = DeltaClientOptions{
+	Timeout:          30 * time.Second,
+	ConnectTimeout:   10 * time.Second,
+	Retries:          3,
+	RetryBackoff:     500 * time.Millisecond,
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+}
+
+func newHttpClient(opts DeltaClientOptions) *http.Client {
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout, KeepAlive: 30 * time.Second}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = opts.ConnectTimeout
+
+	// Timeouts are set per request, as e2e uploads can't be bound by the overall timeout
+	return &http.Client{Transport: transport}
+}
+
+// Make a request whose body can be sent again. Idempotent requests are retried if the node can't be reached
+func (d *DeltaAPI) request(method string, url string, raw []byte, authKey string, idempotent bool) ([]byte, error) {
+	attempts := 1
+	if idempotent {
+		attempts += d.opts.Retries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := d.retryDelay(attempt)
+			log.Debugf("retrying delta call %s %s in %s: %s", method, url, delay, err)
+			time.Sleep(delay)
+		}
+
+		var body []byte
+		var retryable bool
+		body, retryable, err = d.send(context.Background(), method, url, bytes.NewReader(raw), "application/json", authKey, d.opts.Timeout, false)
+		if err == nil || !retryable {
+			return body, err
+		}
+	}
+
+	return nil, err
+}
+
+// Exponential backoff, with up to 50% jitter either way so requests retried together don't all land on the node at once
+func (d *DeltaAPI) retryDelay(attempt int) time.Duration {
+	backoff := d.opts.RetryBackoff << (attempt - 1)
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)+1))
+}
+
+// Send a request once. Also returns whether a failed request may be retried: if the node could not be reached, or said it is unavailable
+// Probes (health checks) are sent even while the circuit breaker is open, so the node is seen to recover
+// Requests cancelled by the caller's ctx are not counted as failures of the node
+func (d *DeltaAPI) send(ctx context.Context, method string, url string, reqBody io.Reader, contentType string, authKey string, timeout time.Duration, probe bool) ([]byte, bool, error) {
+	if !probe {
+		if err := d.breaker.allow(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, d.url+url, reqBody)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not construct http request %v", err)
+	}
+
+	if authKey != "" {
+		req.Header.Set("Authorization", "Bearer "+authKey)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return nil, false, fmt.Errorf("delta call cancelled: %s", err)
+		}
+		d.breaker.record(false)
+		return nil, true, fmt.Errorf("%w: could not make http request %s", ErrDeltaUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		d.breaker.record(false)
+		return nil, true, fmt.Errorf("%w: could not read response body: %s", ErrDeltaUnavailable, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		d.breaker.record(true)
+		return body, false, nil
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		d.breaker.record(false)
+		return nil, true, fmt.Errorf("%w: error in delta call %d : %s", ErrDeltaUnavailable, resp.StatusCode, body)
+	case http.StatusTooManyRequests:
+		d.breaker.record(true)
+		return nil, true, fmt.Errorf("error in delta call %d : %s", resp.StatusCode, body)
+	default:
+		// Delta answered, so it is up, even if it refused the request
+		d.breaker.record(true)
+		return nil, false, fmt.Errorf("error in delta call %d : %s", resp.StatusCode, body)
+	}
+}
+
+// Stops requests to a node that keeps failing, so callers get ErrDeltaUnavailable straight away rather than waiting on timeouts
+type circuitBreaker struct {
+	lock      sync.Mutex
+	url       string
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+}
+
+func newCircuitBreaker(url string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{url: url, threshold: threshold, cooldown: cooldown}
+}
+
+func (cb *circuitBreaker) isOpen() bool {
+	return cb.threshold > 0 && cb.failures >= cb.threshold
+}
+
+// Whether a request may be made. While open, one request is let through each cooldown to try the node again
+func (cb *circuitBreaker) allow() error {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if !cb.isOpen() {
+		return nil
+	}
+	if wait := cb.cooldown - time.Since(cb.openedAt); wait > 0 {
+		return fmt.Errorf("%w: %d requests in a row failed, trying again in %s", ErrDeltaUnavailable, cb.failures, wait.Round(time.Second))
+	}
+
+	cb.openedAt = time.Now()
+	return nil
+}
+
+func (cb *circuitBreaker) record(success bool) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if success {
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.failures == cb.threshold {
+		cb.openedAt = time.Now()
+		log.Errorf("%d requests in a row to delta at %s failed, pausing requests to it for %s", cb.failures, cb.url, cb.cooldown)
+	}
+}
+
+// Whether requests are currently being refused, or only let through to try the node again
+func (cb *circuitBreaker) open() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	return cb.isOpen()
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A Delta that answers the first `failures` requests with 503s
+func flakyDelta(t *testing.T, failures int32) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/open/node/info":
+			w.Write([]byte(`{"commit":"abc","version":"v1"}`))
+		case "/api/v1/stats/contents", "/api/v1/deal/imports":
+			w.Write([]byte(`[]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func testClientOptions() DeltaClientOptions {
+	return DeltaClientOptions{
+		Timeout:          time.Second,
+		ConnectTimeout:   time.Second,
+		Retries:          3,
+		RetryBackoff:     time.Millisecond,
+		BreakerThreshold: 10,
+		BreakerCooldown:  time.Minute,
+	}
+}
+
+func TestDeltaClientRetries(t *testing.T) {
+	srv, calls := flakyDelta(t, 2)
+	d := NewDeltaClient(srv.URL, "token", testClientOptions())
+
+	if _, err := d.GetDealStatus([]int64{1}); err != nil {
+		t.Fatalf("deal status lookup should have been retried until it succeeded: %s", err)
+	}
+	if n := atomic.LoadInt32(calls); n != 3 {
+		t.Errorf("made %d requests, want 3", n)
+	}
+
+	// Making deals is not idempotent, so is never retried
+	srv, calls = flakyDelta(t, 1)
+	d = NewDeltaClient(srv.URL, "token", testClientOptions())
+	if _, err := d.MakeOfflineDeals(OfflineDealRequest{}, "token"); err == nil {
+		t.Error("making deals should have failed")
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Errorf("made %d requests to make deals, want 1", n)
+	}
+}
+
+func TestDeltaCircuitBreaker(t *testing.T) {
+	srv, calls := flakyDelta(t, 2)
+	opts := testClientOptions()
+	opts.Retries = 0
+	opts.BreakerThreshold = 2
+	d := NewDeltaClient(srv.URL, "token", opts)
+
+	for i := 0; i < 2; i++ {
+		if _, err := d.GetDealStatus([]int64{1}); !errors.Is(err, ErrDeltaUnavailable) {
+			t.Fatalf("request %d: got %v, want ErrDeltaUnavailable", i, err)
+		}
+	}
+	if !d.CircuitOpen() {
+		t.Fatal("circuit should be open after 2 failures in a row")
+	}
+
+	// While open, requests fail without reaching Delta
+	if _, err := d.GetDealStatus([]int64{1}); !errors.Is(err, ErrDeltaUnavailable) {
+		t.Errorf("got %v while circuit open, want ErrDeltaUnavailable", err)
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Errorf("made %d requests, want 2", n)
+	}
+
+	// Delta has recovered, which a health check sees, closing the circuit
+	if _, err := d.healthCheck(); err != nil {
+		t.Fatalf("health check failed: %s", err)
+	}
+	if d.CircuitOpen() {
+		t.Error("circuit should be closed after a successful health check")
+	}
+	if _, err := d.GetDealStatus([]int64{1}); err != nil {
+		t.Errorf("request after recovery failed: %s", err)
+	}
+}
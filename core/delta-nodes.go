@@ -0,0 +1,332 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+)
+
+// Name the daemon's own Delta node (set with `--delta-api`) is listed under
+const DEFAULT_DELTA_NODE_NAME = "default"
+
+const DELTA_NODE_HEALTH_INTERVAL = 1 * time.Minute
+
+// A Delta node's health, as of its last check
+type DeltaNodeStatus struct {
+	ID      uint   `json:"id"`
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+	// Set while requests to the node are paused, as too many in a row failed
+	CircuitOpen bool           `json:"circuit_open"`
+	CheckedAt   time.Time      `json:"checked_at"`
+	UUID        string         `json:"uuid,omitempty"`
+	DeltaInfo   DeploymentInfo `json:"delta_info"`
+}
+
+// The Delta nodes deals may be made through: the daemon's own (ID 0), and any registered in the database
+type DeltaNodes struct {
+	lock   sync.RWMutex
+	apis   map[uint]*DeltaAPI
+	status map[uint]*DeltaNodeStatus
+	// Clients for registered nodes are made with the same options as the daemon's own
+	opts DeltaClientOptions
+}
+
+func NewDeltaNodes(defaultNode *DeltaAPI) *DeltaNodes {
+	dn := &DeltaNodes{
+		apis:   map[uint]*DeltaAPI{},
+		status: map[uint]*DeltaNodeStatus{},
+		opts:   defaultNode.opts,
+	}
+	dn.Add(db.DeltaNode{ID: db.DEFAULT_DELTA_NODE_ID, Name: DEFAULT_DELTA_NODE_NAME, URL: defaultNode.url}, defaultNode)
+	return dn
+}
+
+// Create a client for a node, checking it can be reached
+func (dn *DeltaNodes) Connect(url string, authToken string) (*DeltaAPI, error) {
+	return NewDeltaAPI(url, authToken, dn.opts)
+}
+
+// Register a node. Its health is unknown (and it is treated as unhealthy) until it is next checked
+func (dn *DeltaNodes) Add(node db.DeltaNode, dapi *DeltaAPI) {
+	dn.lock.Lock()
+	defer dn.lock.Unlock()
+
+	dn.apis[node.ID] = dapi
+	dn.status[node.ID] = &DeltaNodeStatus{
+		ID:        node.ID,
+		Name:      node.Name,
+		URL:       node.URL,
+		UUID:      dapi.NodeUUID,
+		DeltaInfo: dapi.DeltaDeploymentInfo,
+	}
+}
+
+func (dn *DeltaNodes) Remove(id uint) {
+	dn.lock.Lock()
+	defer dn.lock.Unlock()
+
+	delete(dn.apis, id)
+	delete(dn.status, id)
+}
+
+func (dn *DeltaNodes) Get(id uint) (*DeltaAPI, error) {
+	dn.lock.RLock()
+	defer dn.lock.RUnlock()
+
+	dapi, ok := dn.apis[id]
+	if !ok {
+		return nil, fmt.Errorf("delta node %d is not registered", id)
+	}
+	return dapi, nil
+}
+
+// The client for a node, and the token to make deals on it with
+// Deals on the daemon's own node are made with the caller's token, as before. Registered nodes are only given their own service token
+func (dn *DeltaNodes) clientFor(id uint, authKey string) (*DeltaAPI, string, error) {
+	dapi, err := dn.Get(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if id == db.DEFAULT_DELTA_NODE_ID {
+		return dapi, authKey, nil
+	}
+	return dapi, dapi.ServiceAuthToken, nil
+}
+
+// Status of a single node, if it exists
+func (dn *DeltaNodes) StatusOf(id uint) (DeltaNodeStatus, bool) {
+	for _, s := range dn.Status() {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return DeltaNodeStatus{}, false
+}
+
+// Status of every node, in ID order
+func (dn *DeltaNodes) Status() []DeltaNodeStatus {
+	dn.lock.RLock()
+	defer dn.lock.RUnlock()
+
+	statuses := make([]DeltaNodeStatus, 0, len(dn.status))
+	for id, s := range dn.status {
+		status := *s
+		status.CircuitOpen = dn.apis[id].CircuitOpen()
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+func (dn *DeltaNodes) healthy() map[uint]bool {
+	dn.lock.RLock()
+	defer dn.lock.RUnlock()
+
+	healthy := map[uint]bool{}
+	for id, s := range dn.status {
+		if s.Healthy && !dn.apis[id].CircuitOpen() {
+			healthy[id] = true
+		}
+	}
+	return healthy
+}
+
+// Check every node is reachable, updating its status
+func (dn *DeltaNodes) CheckHealth() {
+	dn.lock.RLock()
+	ids := make([]uint, 0, len(dn.apis))
+	for id := range dn.apis {
+		ids = append(ids, id)
+	}
+	dn.lock.RUnlock()
+
+	for _, id := range ids {
+		dn.CheckNode(id)
+	}
+}
+
+// Check a node is reachable, updating its status
+func (dn *DeltaNodes) CheckNode(id uint) {
+	dapi, err := dn.Get(id)
+	if err != nil {
+		return
+	}
+
+	// Requests are made without holding the lock, so a slow node does not hold up making deals on the others
+	ni, err := dapi.healthCheck()
+	uuid := ""
+	if err == nil {
+		uuid, err = dapi.fetchNodeUuid()
+	}
+
+	dn.lock.Lock()
+	if s, ok := dn.status[id]; ok {
+		s.CheckedAt = time.Now()
+		s.Healthy = err == nil
+		s.Error = ""
+		if err != nil {
+			s.Error = err.Error()
+		} else {
+			s.UUID = uuid
+			s.DeltaInfo = DeploymentInfo{Commit: ni.Commit, Version: ni.Version}
+		}
+	}
+	dn.lock.Unlock()
+
+	if err != nil {
+		log.Warnf("delta node %d (%s) is unhealthy: %s", id, dapi.url, err)
+	}
+}
+
+// Register the Delta nodes stored in the database, and check their health
+// Nodes that can't be reached are still registered, so deals pinned to them fail rather than going to another node
+func (dldm *DeltaDM) LoadDeltaNodes() error {
+	var nodes []db.DeltaNode
+	if res := dldm.DB.Model(&db.DeltaNode{}).Order("id").Find(&nodes); res.Error != nil {
+		return fmt.Errorf("could not load delta nodes: %s", res.Error)
+	}
+
+	for _, n := range nodes {
+		dldm.Nodes.Add(n, NewDeltaClient(n.URL, n.AuthToken, dldm.Nodes.opts))
+	}
+	dldm.Nodes.CheckHealth()
+
+	return nil
+}
+
+// Periodically check the health of every Delta node
+func (dldm *DeltaDM) WatchDeltaNodes() {
+	go func() {
+		for {
+			time.Sleep(DELTA_NODE_HEALTH_INTERVAL)
+			dldm.Nodes.CheckHealth()
+		}
+	}()
+}
+
+// Choose the Delta node each deal is made through, keyed by dealKey
+// A provider pinned to a node takes precedence over a dataset pinned to one. Other deals go to the healthy node with the fewest pending replications,
+// or to the daemon's own node if none are healthy
+func (dldm *DeltaDM) routeDeals(deals OfflineDealRequest) (map[string]uint, error) {
+	routes := make(map[string]uint, len(deals))
+
+	var providerIDs []string
+	var datasetIDs []uint
+	for _, d := range deals {
+		providerIDs = append(providerIDs, d.Miner)
+		datasetIDs = append(datasetIDs, d.DatasetID)
+	}
+
+	var providers []db.Provider
+	if res := dldm.DB.Model(&db.Provider{}).Where("actor_id IN ? AND delta_node_id IS NOT NULL", providerIDs).Find(&providers); res.Error != nil {
+		return nil, fmt.Errorf("could not find provider delta nodes: %s", res.Error)
+	}
+	providerPins := map[string]uint{}
+	for _, p := range providers {
+		providerPins[p.ActorID] = *p.DeltaNodeID
+	}
+
+	var datasets []db.Dataset
+	if res := dldm.DB.Model(&db.Dataset{}).Where("id IN ? AND delta_node_id IS NOT NULL", datasetIDs).Find(&datasets); res.Error != nil {
+		return nil, fmt.Errorf("could not find dataset delta nodes: %s", res.Error)
+	}
+	datasetPins := map[uint]uint{}
+	for _, ds := range datasets {
+		datasetPins[ds.ID] = *ds.DeltaNodeID
+	}
+
+	var pending []struct {
+		DeltaNodeID uint
+		Count       int64
+	}
+	res := dldm.DB.Model(&db.Replication{}).
+		Select("delta_node_id, COUNT(*) AS count").
+		Where("on_chain_deal_id = ? AND status NOT IN ?", 0, db.InactiveStatuses).
+		Group("delta_node_id").
+		Scan(&pending)
+	if res.Error != nil {
+		return nil, fmt.Errorf("could not count pending replications by delta node: %s", res.Error)
+	}
+
+	healthy := dldm.Nodes.healthy()
+	if len(healthy) == 0 {
+		healthy[db.DEFAULT_DELTA_NODE_ID] = true
+	}
+	load := map[uint]int64{}
+	for id := range healthy {
+		load[id] = 0
+	}
+	for _, p := range pending {
+		if _, ok := load[p.DeltaNodeID]; ok {
+			load[p.DeltaNodeID] = p.Count
+		}
+	}
+
+	for _, d := range deals {
+		id, pinned := providerPins[d.Miner]
+		if !pinned {
+			id, pinned = datasetPins[d.DatasetID]
+		}
+		if pinned {
+			routes[dealKey(d)] = id
+			if _, ok := load[id]; ok {
+				load[id]++
+			}
+			continue
+		}
+
+		// Ties go to the lowest ID, so the daemon's own node is preferred
+		var least uint
+		first := true
+		for id, l := range load {
+			if first || l < load[least] || (l == load[least] && id < least) {
+				least = id
+				first = false
+			}
+		}
+		routes[dealKey(d)] = least
+		load[least]++
+	}
+
+	return routes, nil
+}
+
+// Find a registered node by name
+func (dn *DeltaNodes) Lookup(name string) (uint, bool) {
+	dn.lock.RLock()
+	defer dn.lock.RUnlock()
+
+	for id, s := range dn.status {
+		if s.Name == name {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// The node to pin a dataset or provider to, given the node's name. An empty name unpins it
+func (dn *DeltaNodes) Pin(name string) (*uint, error) {
+	if name == "" {
+		return nil, nil
+	}
+	id, ok := dn.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("no delta node named %s", name)
+	}
+	return &id, nil
+}
+
+// Check a node a dataset or provider is created pinned to is registered
+func (dn *DeltaNodes) CheckPin(id *uint) error {
+	if id == nil {
+		return nil
+	}
+	_, err := dn.Get(*id)
+	return err
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+
+	db "github.com/application-research/delta-dm/db"
+)
+
+func TestRouteDeals(t *testing.T) {
+	dbi, err := db.OpenDatabase(filepath.Join(t.TempDir(), "ddm.db"), db.PoolOptions{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dldm := &DeltaDM{DB: dbi, Nodes: NewDeltaNodes(NewDeltaClient("http://default", "", DefaultDeltaClientOptions))}
+	for _, n := range []db.DeltaNode{{ID: 1, Name: "one"}, {ID: 2, Name: "two"}} {
+		dldm.Nodes.Add(n, NewDeltaClient("http://"+n.Name, "", DefaultDeltaClientOptions))
+	}
+	// Node 2 has never passed a health check, so only takes deals pinned to it
+	dldm.Nodes.status[0].Healthy = true
+	dldm.Nodes.status[1].Healthy = true
+
+	one, two := uint(1), uint(2)
+	seed := []interface{}{
+		&db.Provider{ActorID: "f01000"},
+		&db.Provider{ActorID: "f02000", DeltaNodeID: &two},
+		&db.Dataset{Name: "pinned", DeltaNodeID: &one},
+		&db.Dataset{Name: "unpinned"},
+		// The default node has two deals pending, so unpinned deals go to node 1 until it has as many, counting those pinned to it
+		&db.Replication{ProviderActorID: "f01000", ContentCommP: "old1", DeltaContentID: 1, ProposalCid: "p1"},
+		&db.Replication{ProviderActorID: "f01000", ContentCommP: "old2", DeltaContentID: 2, ProposalCid: "p2"},
+	}
+	for _, m := range seed {
+		if err := dbi.Create(m).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deal := func(piece string, provider string, dataset uint) Deal {
+		return Deal{Miner: provider, DatasetID: dataset, PieceCommitment: PieceCommitment{PieceCid: piece}}
+	}
+	deals := OfflineDealRequest{
+		deal("a", "f02000", 1), // provider pin takes precedence over dataset pin
+		deal("b", "f01000", 1),
+		deal("c", "f01000", 2),
+		deal("d", "f01000", 2),
+		deal("e", "f01000", 2),
+		deal("f", "f01000", 2),
+	}
+
+	routes, err := dldm.routeDeals(deals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]uint{"a": 2, "b": 1, "c": 1, "d": 0, "e": 1, "f": 0}
+	for _, d := range deals {
+		if got := routes[dealKey(d)]; got != want[d.PieceCommitment.PieceCid] {
+			t.Errorf("deal %s routed to node %d, want %d", d.PieceCommitment.PieceCid, got, want[d.PieceCommitment.PieceCid])
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package core
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"math/big"
+	"mime/multipart"
 	"net/http"
 
 	db "github.com/application-research/delta-dm/db"
@@ -15,21 +17,34 @@ type DeltaAPI struct {
 	url                 string
 	ServiceAuthToken    string
 	DeltaDeploymentInfo DeploymentInfo
+	opts                DeltaClientOptions
+	client              *http.Client
+	breaker             *circuitBreaker
 }
 
-func NewDeltaAPI(url string, authToken string) (*DeltaAPI, error) {
-	ni, hcError := healthCheck(url)
+// Create a client for a Delta node, without checking it can be reached
+func NewDeltaClient(url string, authToken string, opts DeltaClientOptions) *DeltaAPI {
+	return &DeltaAPI{
+		url:              url,
+		ServiceAuthToken: authToken,
+		opts:             opts,
+		client:           newHttpClient(opts),
+		breaker:          newCircuitBreaker(url, opts.BreakerThreshold, opts.BreakerCooldown),
+	}
+}
+
+// Create a client for a Delta node, checking it can be reached
+func NewDeltaAPI(url string, authToken string, opts DeltaClientOptions) (*DeltaAPI, error) {
+	dapi := NewDeltaClient(url, authToken, opts)
+
+	ni, hcError := dapi.healthCheck()
 	if hcError != nil {
 		return nil, hcError
 	}
 
-	dapi := &DeltaAPI{
-		url:              url,
-		ServiceAuthToken: authToken,
-		DeltaDeploymentInfo: DeploymentInfo{
-			Commit:  ni.Commit,
-			Version: ni.Version,
-		},
+	dapi.DeltaDeploymentInfo = DeploymentInfo{
+		Commit:  ni.Commit,
+		Version: ni.Version,
 	}
 
 	err := dapi.populateNodeUuid()
@@ -41,23 +56,13 @@ func NewDeltaAPI(url string, authToken string) (*DeltaAPI, error) {
 }
 
 // Verify that Delta API is reachable
-func healthCheck(baseUrl string) (*NodeInfoResponse, error) {
-	resp, err := http.Get(baseUrl + "/open/node/info")
+// Health checks are made even while requests to the node are paused by its circuit breaker, and resume them if they succeed
+func (d *DeltaAPI) healthCheck() (*NodeInfoResponse, error) {
+	body, _, err := d.send(context.Background(), http.MethodGet, "/open/node/info", nil, "", "", d.opts.Timeout, true)
 	if err != nil {
-		return nil, fmt.Errorf("could not reach delta api: %s", err)
+		return nil, fmt.Errorf("could not reach delta api: %w", err)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("could not read response body: %s", err)
-	}
-	if resp.StatusCode != 200 {
-		resp.Body.Close()
-		return nil, fmt.Errorf("error in delta call %d : %s", resp.StatusCode, body)
-	}
-
-	defer resp.Body.Close()
-
 	result, err := UnmarshalNodeInfoResponse(body)
 	if err != nil {
 		return nil, fmt.Errorf("could not unmarshal node info response %s : %s", err, string(body))
@@ -66,22 +71,37 @@ func healthCheck(baseUrl string) (*NodeInfoResponse, error) {
 	return &result, nil
 }
 
+// Whether requests to the node are being refused, as too many in a row have failed
+func (d *DeltaAPI) CircuitOpen() bool {
+	return d.breaker.open()
+}
+
 // Retrieves delta node UUID and sets it on the DeltaAPI struct
 func (d *DeltaAPI) populateNodeUuid() error {
-	body, closer, err := d.getRequest("/open/node/uuids", d.ServiceAuthToken)
+	uuid, err := d.fetchNodeUuid()
+	if err != nil {
+		return err
+	}
 
+	d.NodeUUID = uuid
+	return nil
+}
+
+func (d *DeltaAPI) fetchNodeUuid() (string, error) {
+	body, err := d.getRequest("/open/node/uuids", d.ServiceAuthToken)
 	if err != nil {
-		return fmt.Errorf("could not get node uuids: %s", err)
+		return "", fmt.Errorf("could not get node uuids: %w", err)
 	}
-	defer closer()
 
 	result, err := UnmarshalNodeUUIDsResponse(body)
 	if err != nil {
-		return fmt.Errorf("could not unmarshal node uuids response %s : %s", err, string(body))
+		return "", fmt.Errorf("could not unmarshal node uuids response %s : %s", err, string(body))
+	}
+	if len(result) == 0 {
+		return "", fmt.Errorf("delta returned no node uuids")
 	}
 
-	d.NodeUUID = result[0].InstanceUUID
-	return nil
+	return result[0].InstanceUUID, nil
 }
 
 // Register a wallet with Delta based on private key & type (i.e, from a private key file)
@@ -91,11 +111,10 @@ func (d *DeltaAPI) AddWalletByPrivateKey(wallet RegisterWalletRequest, authStrin
 		return nil, fmt.Errorf("could not marshal from wallet json: %s", err)
 	}
 
-	body, closer, err := d.postRequest("/admin/wallet/register", w, authString)
+	body, err := d.postRequest("/admin/wallet/register", w, authString, false)
 	if err != nil {
 		return nil, err
 	}
-	defer closer()
 
 	result, err := UnmarshalRegisterWalletResponse(body)
 	if err != nil {
@@ -112,11 +131,10 @@ func (d *DeltaAPI) AddWalletByHexKey(wallet RegisterWalletHexRequest, authString
 		return nil, fmt.Errorf("could not marshal from wallet json: %s", err)
 	}
 
-	body, closer, err := d.postRequest("/admin/wallet/register-hex", w, authString)
+	body, err := d.postRequest("/admin/wallet/register-hex", w, authString, false)
 	if err != nil {
 		return nil, err
 	}
-	defer closer()
 
 	result, err := UnmarshalRegisterWalletResponse(body)
 	if err != nil {
@@ -128,11 +146,10 @@ func (d *DeltaAPI) AddWalletByHexKey(wallet RegisterWalletHexRequest, authString
 
 // Queries delta for wallet balance information
 func (d *DeltaAPI) GetWalletBalance(walletAdr string, authString string) (*GetWalletBalanceResponse, error) {
-	body, closer, err := d.getRequest("/admin/wallet/balance/"+walletAdr, authString)
+	body, err := d.getRequest("/admin/wallet/balance/"+walletAdr, authString)
 	if err != nil {
 		return nil, err
 	}
-	defer closer()
 
 	result, err := UnmarshalGetWalletBalanceResponse(body)
 	if err != nil {
@@ -151,11 +168,10 @@ func (d *DeltaAPI) MakeOfflineDeals(deals OfflineDealRequest, authString string)
 
 	log.Debugf("delta deals request: %s", string(ds))
 
-	body, closer, err := d.postRequest("/api/v1/deal/imports", ds, authString)
+	body, err := d.postRequest("/api/v1/deal/imports", ds, authString, false)
 	if err != nil {
 		return nil, err
 	}
-	defer closer()
 
 	result, err := UnmarshalOfflineDealResponse(body)
 	if err != nil {
@@ -165,85 +181,84 @@ func (d *DeltaAPI) MakeOfflineDeals(deals OfflineDealRequest, authString string)
 	return &result, nil
 }
 
-func (d *DeltaAPI) GetDealStatus(deltaIds []int64) (*DealStatsResponse, error) {
-	dids, err := json.Marshal(deltaIds)
+// Requests an online (end-to-end) deal to be made from Delta, pushing the file to it. Cancelling ctx aborts the upload
+func (d *DeltaAPI) MakeE2EDeal(ctx context.Context, deal Deal, file io.Reader, filename string, authString string) (*OfflineDealResponseElement, error) {
+	meta, err := json.Marshal(deal)
 	if err != nil {
-		return nil, fmt.Errorf("could not marshal from deal ids json: %s", err)
-	}
-
-	body, closer, err := d.postRequest("/api/v1/stats/contents", dids, d.ServiceAuthToken)
+		return nil, fmt.Errorf("could not marshal from deal json: %s", err)
+	}
+
+	log.Debugf("delta e2e deal request: %s", string(meta))
+
+	if authString == "" {
+		return nil, fmt.Errorf("auth token must be provided")
+	}
+
+	// Stream the file into the request, so it does not have to be held in memory
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := mw.WriteField("metadata", string(meta))
+		if err == nil {
+			var part io.Writer
+			part, err = mw.CreateFormFile("data", filename)
+			if err == nil {
+				_, err = io.Copy(part, file)
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	// The upload can't be sent again, so is not retried, and may take as long as it needs - stalled uploads are cancelled through ctx
+	body, _, err := d.send(ctx, http.MethodPost, "/api/v1/deal/end-to-end", pr, mw.FormDataContentType(), authString, 0, false)
 	if err != nil {
+		pr.CloseWithError(err)
 		return nil, err
 	}
-	defer closer()
 
-	result, err := UnmarshalDealStatsResponse(body)
+	var result OfflineDealResponseElement
+	err = json.Unmarshal(body, &result)
 	if err != nil {
-		return nil, fmt.Errorf("could not unmarshal deal stats response %s : %s", err, string(body))
+		err = fmt.Errorf("could not unmarshal e2e deal response %s : %s", err, string(body))
+		pr.CloseWithError(err)
+		return nil, err
 	}
 
 	return &result, nil
-
 }
 
-func (d *DeltaAPI) postRequest(url string, raw []byte, authKey string) ([]byte, func() error, error) {
-	if authKey == "" {
-		return nil, nil, fmt.Errorf("auth token must be provided")
-	}
-
-	req, err := http.NewRequest(http.MethodPost, d.url+url, bytes.NewBuffer(raw))
-	if err != nil {
-		return nil, nil, fmt.Errorf("could not construct http request %v", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+authKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func (d *DeltaAPI) GetDealStatus(deltaIds []int64) (*DealStatsResponse, error) {
+	dids, err := json.Marshal(deltaIds)
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not make http request %s", err)
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != 200 {
-		resp.Body.Close()
-		return nil, nil, fmt.Errorf("error in delta call %d : %s", resp.StatusCode, body)
+		return nil, fmt.Errorf("could not marshal from deal ids json: %s", err)
 	}
 
+	body, err := d.postRequest("/api/v1/stats/contents", dids, d.ServiceAuthToken, true)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	return body, resp.Body.Close, nil
-}
-
-func (d *DeltaAPI) getRequest(url string, authKey string) ([]byte, func() error, error) {
-	req, err := http.NewRequest(http.MethodGet, d.url+url, nil)
+	result, err := UnmarshalDealStatsResponse(body)
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not construct http request %v", err)
+		return nil, fmt.Errorf("could not unmarshal deal stats response %s : %s", err, string(body))
 	}
 
-	req.Header.Set("Authorization", "Bearer "+authKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, nil, fmt.Errorf("could not make http request %s", err)
-	}
+	return &result, nil
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != 200 {
-		resp.Body.Close()
-		return nil, nil, fmt.Errorf("error in delta call %d : %s", resp.StatusCode, body)
-	}
+}
 
-	if err != nil {
-		return nil, nil, err
+func (d *DeltaAPI) postRequest(url string, raw []byte, authKey string, idempotent bool) ([]byte, error) {
+	if authKey == "" {
+		return nil, fmt.Errorf("auth token must be provided")
 	}
+	return d.request(http.MethodPost, url, raw, authKey, idempotent)
+}
 
-	return body, resp.Body.Close, nil
+func (d *DeltaAPI) getRequest(url string, authKey string) ([]byte, error) {
+	return d.request(http.MethodGet, url, nil, authKey, true)
 }
 
 func UnmarshalNodeInfoResponse(data []byte) (NodeInfoResponse, error) {
@@ -308,6 +323,12 @@ type Deal struct { // AKA meta
 	SkipIpniAnnounce   bool            `json:"skip_ipni_announce"`
 	DurationInDays     uint64          `json:"duration_in_days,omitempty"`
 	StartEpochInDays   uint64          `json:"start_epoch_in_days,omitempty"`
+	DealVerifyState    string          `json:"deal_verify_state,omitempty"` // "verified" or "unverified"
+	PricePerEpoch      string          `json:"price_per_epoch,omitempty"`   // attoFIL
+	// Not sent to Delta - used to track spend against the dataset's budget, and to find the data for e2e deals
+	DatasetID       uint     `json:"-"`
+	Cost            *big.Int `json:"-"`
+	ContentLocation string   `json:"-"`
 }
 
 type ParamRequestMeta struct {
@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	db "github.com/application-research/delta-dm/db"
@@ -16,14 +17,14 @@ func (ddm *DeltaDM) WatchReplications() {
 		fmt.Println(util.Red + "disabling Delta watcher in dry run mode" + util.Reset)
 		return
 	}
-	go watch(ddm.DB, ddm.DAPI)
+	go watch(ddm.DB, ddm.Nodes)
 }
 
-func watch(db *gorm.DB, d *DeltaAPI) {
+func watch(db *gorm.DB, nodes *DeltaNodes) {
 	for {
 		time.Sleep(10 * time.Second)
 
-		err := RunReconciliation(db, d)
+		err := RunReconciliation(db, nodes)
 
 		if err != nil {
 			log.Errorf("failed running delta reconciliation job: %s", err)
@@ -31,20 +32,52 @@ func watch(db *gorm.DB, d *DeltaAPI) {
 	}
 }
 
-func RunReconciliation(dbi *gorm.DB, d *DeltaAPI) error {
+func RunReconciliation(dbi *gorm.DB, nodes *DeltaNodes) error {
 	log.Debug("starting reconcile task")
-	var pendingReplications []int64
+	var pendingReplications []struct {
+		DeltaNodeID    uint
+		DeltaContentID int64
+	}
 
 	// Once the on_chain_deal_id is nonzero, we don't need to continue checking the deal
 	// Or, if it's in a failed state it's not going to change
-	dbi.Model(&db.Replication{}).Where("on_chain_deal_id = ? AND status NOT IN ?", 0, db.FailedStatuses).Select("delta_content_id").Find(&pendingReplications)
+	// Queued e2e deals are not known to Delta until their data has been pushed
+	dbi.Model(&db.Replication{}).Where("on_chain_deal_id = ? AND status NOT IN ?", 0, db.InactiveStatuses).Where("status <> ?", db.DDM_StorageDealStatusQueued).Select("delta_node_id, delta_content_id").Find(&pendingReplications)
 
 	if len(pendingReplications) == 0 {
 		log.Debug("no pending replications")
 		return nil
 	}
 
-	log.Debugf("reconciling %v\n", pendingReplications)
+	// Each node is asked about the deals it made. A node that can't be reached doesn't hold up the others
+	byNode := map[uint][]int64{}
+	var nodeIDs []uint
+	for _, r := range pendingReplications {
+		if _, ok := byNode[r.DeltaNodeID]; !ok {
+			nodeIDs = append(nodeIDs, r.DeltaNodeID)
+		}
+		byNode[r.DeltaNodeID] = append(byNode[r.DeltaNodeID], r.DeltaContentID)
+	}
+
+	var errs []string
+	for _, node := range nodeIDs {
+		d, err := nodes.Get(node)
+		if err == nil {
+			err = reconcileNode(dbi, d, node, byNode[node])
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("node %d: %s", node, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func reconcileNode(dbi *gorm.DB, d *DeltaAPI, node uint, pendingReplications []int64) error {
+	log.Debugf("reconciling %v on node %d\n", pendingReplications, node)
 	statsResponse, err := d.GetDealStatus(pendingReplications)
 	if err != nil {
 		return fmt.Errorf("could not get deal status: %s", err)
@@ -54,14 +87,15 @@ func RunReconciliation(dbi *gorm.DB, d *DeltaAPI) error {
 
 	log.Debugf("updating %d replications\n", len(ru))
 	for _, r := range ru {
-		err := dbi.Model(&db.Replication{}).Where("delta_content_id = ?", r.DeltaContentID).Updates(r)
+		// Replications that have failed or been cancelled since the status was requested are left as they are
+		err := dbi.Model(&db.Replication{}).Where("delta_node_id = ? AND delta_content_id = ? AND status NOT IN ?", node, r.DeltaContentID, db.InactiveStatuses).Updates(r)
 
 		if err.Error != nil {
 			return fmt.Errorf("could not update replication: %s", err.Error)
 		}
 
 		// Remove a replication if it failed
-		if r.Status.HasFailed() {
+		if r.Status.HasFailed() && err.RowsAffected > 0 {
 			var cnt db.Content
 
 			err := dbi.Model(&db.Content{}).Where("comm_p = ?", r.ContentCommP).First(&cnt)
@@ -101,6 +135,7 @@ func computeReplicationUpdates(dealStats DealStatsResponse) []db.Replication {
 
 			if deal.Deals[0].DealID != 0 {
 				r.OnChainDealID = deal.Deals[0].DealID
+				r.OnChainAt = parseOnChainAt(deal.Deals[0].OnChainAt)
 			}
 
 		}
@@ -113,3 +148,12 @@ func computeReplicationUpdates(dealStats DealStatsResponse) []db.Replication {
 
 	return toUpdate
 }
+
+// Delta reports when the deal landed on chain, but fall back to now (when the deal was first seen on chain) if it can't be parsed
+func parseOnChainAt(onChainAt string) *time.Time {
+	t, err := time.Parse(time.RFC3339, onChainAt)
+	if err != nil || t.IsZero() {
+		t = time.Now()
+	}
+	return &t
+}
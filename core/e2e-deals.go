@@ -0,0 +1,273 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+	"gorm.io/gorm"
+)
+
+// Number of e2e deals whose data is pushed to Delta at once
+const E2E_TRANSFER_WORKERS = 4
+
+// Max time to connect to a content location, and for it to start responding
+const E2E_CONNECT_TIMEOUT = 30 * time.Second
+
+// A transfer is aborted if none of the deal's data can be read for this long, so a stalled download or upload doesn't hold up a worker
+const E2E_IDLE_TIMEOUT = 2 * time.Minute
+
+// How long Delta has to answer once all of a deal's data has been pushed to it
+const E2E_RESPONSE_TIMEOUT = 10 * time.Minute
+
+// Downloads the data of e2e deals from their content locations
+var e2eDownloadClient = newE2EDownloadClient()
+
+func newE2EDownloadClient() *http.Client {
+	dialer := &net.Dialer{Timeout: E2E_CONNECT_TIMEOUT, KeepAlive: 30 * time.Second}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = E2E_CONNECT_TIMEOUT
+	transport.ResponseHeaderTimeout = E2E_CONNECT_TIMEOUT
+
+	// No overall timeout, as large pieces take a while to download. Stalled downloads are aborted by the idle timeout instead
+	return &http.Client{Transport: transport}
+}
+
+// An e2e deal that has been recorded as queued, whose data is waiting to be pushed to Delta
+type e2eTransfer struct {
+	replicationID uint
+	deal          Deal
+	node          uint
+	// Not stored, so transfers queued when DDM stops can't be resumed
+	authKey string
+}
+
+// E2E deals are recorded while the AllocationLock is held, and their data is pushed to Delta afterwards by background workers,
+// so other allocations don't wait on transfers
+type e2eQueue struct {
+	lock      sync.Mutex
+	cond      *sync.Cond
+	transfers []e2eTransfer
+}
+
+func newE2EQueue() *e2eQueue {
+	q := &e2eQueue{}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+func (q *e2eQueue) push(t e2eTransfer) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.transfers = append(q.transfers, t)
+	q.cond.Signal()
+}
+
+// Blocks until a transfer is queued
+func (q *e2eQueue) pop() e2eTransfer {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for len(q.transfers) == 0 {
+		q.cond.Wait()
+	}
+	t := q.transfers[0]
+	q.transfers = q.transfers[1:]
+	return t
+}
+
+// Start the workers that push the data of queued e2e deals to Delta
+// Deals left queued by a previous run, e2e or not yet sent to Delta, are failed, as the auth key they were made with is not stored
+func (dldm *DeltaDM) RunE2ETransfers() error {
+	var stale []uint
+	if err := dldm.DB.Model(&db.Replication{}).Where("status = ?", db.DDM_StorageDealStatusQueued).Pluck("id", &stale).Error; err != nil {
+		return fmt.Errorf("could not find queued e2e deals: %s", err)
+	}
+	for _, id := range stale {
+		failE2EDeal(dldm.DB, id, "ddm restarted before the deal was sent to delta")
+	}
+	if len(stale) > 0 {
+		log.Errorf("failed %d deals left queued when ddm stopped", len(stale))
+	}
+
+	for i := 0; i < E2E_TRANSFER_WORKERS; i++ {
+		go func() {
+			for {
+				dldm.pushE2EDeal(dldm.e2eTransfers.pop())
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Push a queued e2e deal's data to Delta, and record the outcome on its replication
+func (dldm *DeltaDM) pushE2EDeal(t e2eTransfer) {
+	var queued int64
+	if err := dldm.DB.Model(&db.Replication{}).Where("id = ? AND status = ?", t.replicationID, db.DDM_StorageDealStatusQueued).Count(&queued).Error; err != nil {
+		log.Errorf("could not look up e2e deal %d: %s", t.replicationID, err)
+		return
+	}
+	if queued == 0 {
+		// Cancelled while it was waiting
+		return
+	}
+
+	resp, err := dldm.makeE2EDeal(t.deal, t.node, t.authKey)
+	if err == nil && resp.Status != "success" {
+		err = fmt.Errorf("delta did not make the deal: %s", resp.Message)
+	}
+	if err != nil {
+		log.Errorf("unable to make e2e deal for %s: %s", t.deal.PieceCommitment.PieceCid, err)
+		failE2EDeal(dldm.DB, t.replicationID, err.Error())
+		return
+	}
+
+	res := dldm.DB.Model(&db.Replication{}).Where("id = ? AND status = ?", t.replicationID, db.DDM_StorageDealStatusQueued).Updates(db.Replication{DeltaContentID: resp.DeltaContentID, Status: db.DDM_StorageDealStatusPending})
+	if res.Error != nil {
+		log.Errorf("unable to record e2e deal %d (delta content %d): %s", t.replicationID, resp.DeltaContentID, res.Error)
+	} else if res.RowsAffected == 0 {
+		log.Errorf("e2e deal %d was cancelled while its data was pushed, delta still made the deal (delta content %d)", t.replicationID, resp.DeltaContentID)
+	}
+}
+
+// Mark a queued e2e deal as failed, so it no longer counts against its content's replications
+func failE2EDeal(dbi *gorm.DB, replicationID uint, reason string) {
+	err := dbi.Transaction(func(tx *gorm.DB) error {
+		var r db.Replication
+		if err := tx.Where("id = ?", replicationID).First(&r).Error; err != nil {
+			return err
+		}
+
+		res := tx.Model(&db.Replication{}).Where("id = ? AND status = ?", replicationID, db.DDM_StorageDealStatusQueued).Updates(db.Replication{Status: db.DDM_StorageDealStatusTransferFailed, DeltaMessage: reason})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+
+		return tx.Model(&db.Content{}).Where("comm_p = ? AND num_replications > 0", r.ContentCommP).Update("num_replications", gorm.Expr("num_replications - ?", 1)).Error
+	})
+	if err != nil {
+		log.Errorf("unable to mark e2e deal %d as failed: %s", replicationID, err)
+	}
+}
+
+// Make an online deal, pushing the data to Delta
+func (dldm *DeltaDM) makeE2EDeal(d Deal, node uint, authKey string) (*OfflineDealResponseElement, error) {
+	dapi, authKey, err := dldm.Nodes.clientFor(node, authKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data, err := dldm.openDealData(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	idle := newIdleTimeoutReader(data, E2E_IDLE_TIMEOUT, E2E_RESPONSE_TIMEOUT, cancel)
+	defer idle.stop()
+
+	resp, err := dapi.MakeE2EDeal(ctx, d, idle, d.PieceCommitment.PieceCid+".car", authKey)
+	if err != nil {
+		if idle.timedOut() {
+			return nil, fmt.Errorf("transfer timed out: no data read for %s, or no answer from delta within %s of pushing it", E2E_IDLE_TIMEOUT, E2E_RESPONSE_TIMEOUT)
+		}
+		return nil, fmt.Errorf("unable to make deal with delta api: %s", err)
+	}
+
+	return resp, nil
+}
+
+// Open the data for an e2e deal, from DDM's CAR store if enabled, or else from the content's location
+func (dldm *DeltaDM) openDealData(ctx context.Context, d Deal) (io.ReadCloser, error) {
+	piece := d.PieceCommitment.PieceCid
+
+	if dldm.CarServer != nil {
+		f, err := dldm.CarServer.Store.Open(piece)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("could not open piece %s from car store: %s", piece, err)
+		}
+	}
+
+	if d.ContentLocation == "" {
+		return nil, fmt.Errorf("no data available for piece %s: it is not in the car store, and has no content location", piece)
+	}
+
+	location := d.ContentLocation
+	if dldm.Signer != nil {
+		// Hosts may only serve signed locations. DDM downloads the data itself, so it signs them with its own identity rather than the provider's
+		signed, err := dldm.Signer.Sign(location, SIGNED_URL_DDM_IDENTITY)
+		if err != nil {
+			return nil, fmt.Errorf("could not sign content location for piece %s: %s", piece, err)
+		}
+		location = signed
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not download piece %s: %s", piece, err)
+	}
+	resp, err := e2eDownloadClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not download piece %s: %s", piece, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("could not download piece %s: status %d", piece, resp.StatusCode)
+	}
+
+	return resp.Body, nil
+}
+
+// Calls cancel if no data is read for the idle timeout, or, once all the data has been read, if the transfer takes longer than the done timeout to finish
+type idleTimeoutReader struct {
+	r       io.Reader
+	idle    time.Duration
+	done    time.Duration
+	timer   *time.Timer
+	expired int32
+}
+
+func newIdleTimeoutReader(r io.Reader, idle time.Duration, done time.Duration, cancel context.CancelFunc) *idleTimeoutReader {
+	ir := &idleTimeoutReader{r: r, idle: idle, done: done}
+	ir.timer = time.AfterFunc(idle, func() {
+		atomic.StoreInt32(&ir.expired, 1)
+		cancel()
+	})
+	return ir
+}
+
+func (ir *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if err == io.EOF {
+		ir.timer.Reset(ir.done)
+	} else if n > 0 {
+		ir.timer.Reset(ir.idle)
+	}
+	return n, err
+}
+
+func (ir *idleTimeoutReader) timedOut() bool {
+	return atomic.LoadInt32(&ir.expired) == 1
+}
+
+func (ir *idleTimeoutReader) stop() {
+	ir.timer.Stop()
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Never returns any data, like a stalled download
+type stalledReader struct{ ctx context.Context }
+
+func (s stalledReader) Read(p []byte) (int, error) {
+	<-s.ctx.Done()
+	return 0, s.ctx.Err()
+}
+
+func TestIdleTimeoutReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	idle := newIdleTimeoutReader(stalledReader{ctx}, 20*time.Millisecond, time.Minute, cancel)
+	defer idle.stop()
+
+	if _, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from a stalled reader should fail")
+	}
+	if !idle.timedOut() {
+		t.Error("stalled reader should have timed out")
+	}
+}
+
+func TestIdleTimeoutReaderFinished(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	idle := newIdleTimeoutReader(strings.NewReader("data"), 20*time.Millisecond, time.Minute, cancel)
+	defer idle.stop()
+
+	if _, err := io.ReadAll(idle); err != nil {
+		t.Fatal(err)
+	}
+	// Once all the data is read, the idle timeout no longer applies while waiting for Delta to answer
+	time.Sleep(50 * time.Millisecond)
+	if idle.timedOut() || ctx.Err() != nil {
+		t.Error("reader should not time out after all its data was read")
+	}
+}
+
+func TestOpenDealDataSigned(t *testing.T) {
+	signer := NewURLSigner("key", time.Hour)
+
+	// A host that only serves signed locations
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := signer.Verify("http://" + r.Host + r.URL.String()); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	d := Deal{ContentLocation: srv.URL + "/piece.car", PieceCommitment: PieceCommitment{PieceCid: "baga"}}
+
+	dldm := &DeltaDM{}
+	if _, err := dldm.openDealData(context.Background(), d); err == nil {
+		t.Error("unsigned download should be refused")
+	}
+
+	dldm.Signer = signer
+	data, err := dldm.openDealData(context.Background(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	if b, _ := io.ReadAll(data); string(b) != "data" {
+		t.Errorf("read %q, want %q", b, "data")
+	}
+}
@@ -0,0 +1,271 @@
+package core
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+	"github.com/jszwec/csvutil"
+	"github.com/xitongsys/parquet-go/writer"
+	"gorm.io/gorm"
+)
+
+type ExportFormat string
+
+const (
+	ExportFormatCSV     ExportFormat = "csv"
+	ExportFormatNDJSON  ExportFormat = "ndjson"
+	ExportFormatParquet ExportFormat = "parquet"
+)
+
+// Parquet row groups are buffered in memory before they are written, so keep them small enough to stream
+const PARQUET_ROW_GROUP_SIZE = 16 * 1024 * 1024
+
+func ParseExportFormat(s string) (ExportFormat, error) {
+	switch ExportFormat(s) {
+	case ExportFormatCSV, ExportFormatNDJSON, ExportFormatParquet:
+		return ExportFormat(s), nil
+	case "":
+		return ExportFormatCSV, nil
+	default:
+		return "", fmt.Errorf("invalid format '%s', must be one of csv, ndjson, parquet", s)
+	}
+}
+
+func (f ExportFormat) ContentType() string {
+	switch f {
+	case ExportFormatNDJSON:
+		return "application/x-ndjson"
+	case ExportFormatParquet:
+		return "application/vnd.apache.parquet"
+	default:
+		return "text/csv"
+	}
+}
+
+// A replication joined with its content, dataset and provider: which piece is stored where
+type ReplicationExportRow struct {
+	ReplicationID   uint          `json:"replication_id" csv:"replication_id" gorm:"column:replication_id"`
+	PieceCid        string        `json:"piece_cid" csv:"piece_cid" gorm:"column:piece_cid"`
+	PayloadCid      string        `json:"payload_cid" csv:"payload_cid" gorm:"column:payload_cid"`
+	Size            uint64        `json:"size" csv:"size" gorm:"column:size"`
+	PaddedSize      uint64        `json:"padded_size" csv:"padded_size" gorm:"column:padded_size"`
+	Dataset         string        `json:"dataset" csv:"dataset" gorm:"column:dataset"`
+	ProviderActorID string        `json:"provider_actor_id" csv:"provider_actor_id" gorm:"column:provider_actor_id"`
+	ProviderName    string        `json:"provider_name" csv:"provider_name" gorm:"column:provider_name"`
+	Status          db.DealStatus `json:"status" csv:"status" gorm:"column:status"`
+	OnChainDealID   uint          `json:"on_chain_deal_id" csv:"on_chain_deal_id" gorm:"column:on_chain_deal_id"`
+	DealUUID        string        `json:"deal_uuid" csv:"deal_uuid" gorm:"column:deal_uuid"`
+	ProposalCid     string        `json:"proposal_cid" csv:"proposal_cid" gorm:"column:proposal_cid"`
+	DealTime        time.Time     `json:"deal_time" csv:"deal_time" gorm:"column:deal_time"`
+	OnChainAt       *time.Time    `json:"on_chain_at" csv:"on_chain_at" gorm:"column:on_chain_at"`
+	WalletAddr      string        `json:"wallet_addr" csv:"wallet_addr" gorm:"column:wallet_addr"`
+	SelfService     bool          `json:"self_service" csv:"self_service" gorm:"column:self_service"`
+}
+
+// Parquet has no time type the writer can take directly, so times are written as unix milliseconds
+type parquetReplicationRow struct {
+	ReplicationID   int64  `parquet:"name=replication_id, type=INT64"`
+	PieceCid        string `parquet:"name=piece_cid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PayloadCid      string `parquet:"name=payload_cid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Size            int64  `parquet:"name=size, type=INT64"`
+	PaddedSize      int64  `parquet:"name=padded_size, type=INT64"`
+	Dataset         string `parquet:"name=dataset, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ProviderActorID string `parquet:"name=provider_actor_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ProviderName    string `parquet:"name=provider_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Status          string `parquet:"name=status, type=BYTE_ARRAY, convertedtype=UTF8"`
+	OnChainDealID   int64  `parquet:"name=on_chain_deal_id, type=INT64"`
+	DealUUID        string `parquet:"name=deal_uuid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ProposalCid     string `parquet:"name=proposal_cid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	DealTime        int64  `parquet:"name=deal_time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	OnChainAt       *int64 `parquet:"name=on_chain_at, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+	WalletAddr      string `parquet:"name=wallet_addr, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SelfService     bool   `parquet:"name=self_service, type=BOOLEAN"`
+}
+
+func (r ReplicationExportRow) parquet() parquetReplicationRow {
+	pr := parquetReplicationRow{
+		ReplicationID:   int64(r.ReplicationID),
+		PieceCid:        r.PieceCid,
+		PayloadCid:      r.PayloadCid,
+		Size:            int64(r.Size),
+		PaddedSize:      int64(r.PaddedSize),
+		Dataset:         r.Dataset,
+		ProviderActorID: r.ProviderActorID,
+		ProviderName:    r.ProviderName,
+		Status:          string(r.Status),
+		OnChainDealID:   int64(r.OnChainDealID),
+		DealUUID:        r.DealUUID,
+		ProposalCid:     r.ProposalCid,
+		DealTime:        r.DealTime.UnixMilli(),
+		WalletAddr:      r.WalletAddr,
+		SelfService:     r.SelfService,
+	}
+	if r.OnChainAt != nil {
+		ms := r.OnChainAt.UnixMilli()
+		pr.OnChainAt = &ms
+	}
+	return pr
+}
+
+type exportWriter interface {
+	Write(row ReplicationExportRow) error
+	Close() error
+}
+
+type csvExportWriter struct {
+	w   *csv.Writer
+	enc *csvutil.Encoder
+}
+
+func (cw *csvExportWriter) Write(row ReplicationExportRow) error {
+	return cw.enc.Encode(row)
+}
+
+func (cw *csvExportWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type ndjsonExportWriter struct {
+	enc *json.Encoder
+}
+
+func (nw *ndjsonExportWriter) Write(row ReplicationExportRow) error {
+	return nw.enc.Encode(row)
+}
+
+func (nw *ndjsonExportWriter) Close() error {
+	return nil
+}
+
+type parquetExportWriter struct {
+	pw *writer.ParquetWriter
+}
+
+func (pw *parquetExportWriter) Write(row ReplicationExportRow) error {
+	return pw.pw.Write(row.parquet())
+}
+
+func (pw *parquetExportWriter) Close() error {
+	return pw.pw.WriteStop()
+}
+
+func newExportWriter(format ExportFormat, w io.Writer) (exportWriter, error) {
+	switch format {
+	case ExportFormatNDJSON:
+		return &ndjsonExportWriter{enc: json.NewEncoder(w)}, nil
+	case ExportFormatParquet:
+		pw, err := writer.NewParquetWriterFromWriter(w, new(parquetReplicationRow), 1)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create parquet writer: %s", err)
+		}
+		pw.RowGroupSize = PARQUET_ROW_GROUP_SIZE
+		return &parquetExportWriter{pw: pw}, nil
+	default:
+		cw := csv.NewWriter(w)
+		enc := csvutil.NewEncoder(cw)
+		// Write the header even if there are no rows
+		if err := enc.EncodeHeader(ReplicationExportRow{}); err != nil {
+			return nil, err
+		}
+		return &csvExportWriter{w: cw, enc: enc}, nil
+	}
+}
+
+// Stream replications to w in the given format, one row at a time
+// tx must be a query on replications, joined with their content as `Content` (i.e, Model(&db.Replication{}).Joins("Content")), with any filters applied
+func ExportReplications(tx *gorm.DB, format ExportFormat, w io.Writer) error {
+	rows, err := tx.
+		Select(`replications.id AS replication_id, replications.content_comm_p AS piece_cid, "Content".payload_c_id AS payload_cid,
+			"Content".size AS size, "Content".padded_size AS padded_size, d.name AS dataset,
+			replications.provider_actor_id AS provider_actor_id, p.actor_name AS provider_name, replications.status AS status,
+			replications.on_chain_deal_id AS on_chain_deal_id, replications.deal_uuid AS deal_uuid, replications.proposal_cid AS proposal_cid,
+			replications.deal_time AS deal_time, replications.on_chain_at AS on_chain_at, replications.wallet_addr AS wallet_addr,
+			replications.ss_is_self_service AS self_service`).
+		Joins(`LEFT JOIN datasets d ON d.id = "Content".dataset_id`).
+		Joins("LEFT JOIN providers p ON p.actor_id = replications.provider_actor_id").
+		Order("replications.id ASC").
+		Rows()
+	if err != nil {
+		return fmt.Errorf("unable to query replications: %s", err)
+	}
+	defer rows.Close()
+
+	ew, err := newExportWriter(format, w)
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var row ReplicationExportRow
+		if err := tx.ScanRows(rows, &row); err != nil {
+			return fmt.Errorf("unable to read replication: %s", err)
+		}
+		if err := ew.Write(row); err != nil {
+			return fmt.Errorf("unable to write replication %d: %s", row.ReplicationID, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unable to read replications: %s", err)
+	}
+
+	return ew.Close()
+}
+
+// Periodically export all replications to a file in dir, named by the time of the export
+func (dldm *DeltaDM) ScheduleReports(dir string, format ExportFormat, interval time.Duration) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create report directory: %s", err)
+	}
+
+	go func() {
+		for {
+			path, err := dldm.WriteReplicationsReport(dir, format)
+			if err != nil {
+				log.Errorf("failed writing scheduled replications report: %s", err)
+			} else {
+				log.Infof("wrote replications report to %s", path)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+
+	return nil
+}
+
+// Export all replications to a new file in dir, returning its path
+// The report is written to a temporary file first, so a partially written report is never left under the final name
+func (dldm *DeltaDM) WriteReplicationsReport(dir string, format ExportFormat) (string, error) {
+	name := fmt.Sprintf("replications-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	path := filepath.Join(dir, name)
+
+	f, err := os.CreateTemp(dir, "."+name+"-*")
+	if err != nil {
+		return "", fmt.Errorf("unable to create report file: %s", err)
+	}
+	defer os.Remove(f.Name())
+
+	err = ExportReplications(dldm.DB.Model(&db.Replication{}).Joins("Content"), format, f)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", fmt.Errorf("unable to write report file: %s", err)
+	}
+
+	return path, nil
+}
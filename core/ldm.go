@@ -1,6 +1,8 @@
 package core
 
 import (
+	"sync"
+
 	db "github.com/application-research/delta-dm/db"
 	logging "github.com/ipfs/go-log/v2"
 	"gorm.io/gorm"
@@ -15,39 +17,85 @@ type DeploymentInfo struct {
 	Version string `json:"version"`
 }
 type DeltaDM struct {
-	DAPI       *DeltaAPI
+	// The daemon's own Delta node
+	DAPI *DeltaAPI
+	// Every Delta node deals may be made through, including DAPI
+	Nodes      *DeltaNodes
 	DB         *gorm.DB
 	AS         *AuthServer
 	Info       DeploymentInfo
 	DryRunMode bool
+	// Optional - when set, content locations handed out to providers are signed
+	Signer *URLSigner
+	// Optional - when set, DDM serves CAR files to providers itself
+	CarServer *CarServer
+	// Optional - when set, providers with a low reputation score may not self-serve
+	ReputationPolicy *ReputationPolicy
+	// Held while selecting content and recording deals or reservations for it, so the same content is not allocated beyond its quota
+	AllocationLock sync.Mutex
+	// E2E deals whose data is waiting to be pushed to Delta
+	e2eTransfers *e2eQueue
 }
 
-func NewDeltaDM(dbConnStr string, deltaApi string, authToken string, authServerUrl string, di DeploymentInfo, debug bool, dryRun bool) *DeltaDM {
+func NewDeltaDM(dbConnStr string, dbPool db.PoolOptions, autoMigrate bool, deltaApi string, authToken string, deltaOpts DeltaClientOptions, authServerUrl string, di DeploymentInfo, debug bool, dryRun bool) *DeltaDM {
 	if debug {
 		logging.SetDebugLogging()
 	}
 
-	dbi, err := db.OpenDatabase(dbConnStr, debug)
+	dbi, err := db.Connect(dbConnStr, dbPool, debug)
 	if err != nil {
 		log.Fatalf("could not connect to db: %s", err)
 	} else {
 		log.Debugf("successfully connected to delta db at %s\n", dbConnStr)
 	}
 
-	dapi, err := NewDeltaAPI(deltaApi, authToken)
+	if autoMigrate {
+		if err := db.Migrate(dbi, ""); err != nil {
+			log.Fatalf("%s", err)
+		}
+	} else if err := db.CheckMigrated(dbi); err != nil {
+		log.Fatalf("refusing to start: %s. apply migrations with `ddm db migrate up`", err)
+	}
+
+	// If Delta is down, DDM still starts, and makes deals once the health checks see it come back
+	dapi, err := NewDeltaAPI(deltaApi, authToken, deltaOpts)
 	if err != nil {
-		log.Fatalf("could not connect to delta api: %s", err)
+		log.Errorf("could not connect to delta api, starting in degraded mode until it is reachable: %s", err)
+		dapi = NewDeltaClient(deltaApi, authToken, deltaOpts)
 	} else {
 		log.Debugf("successfully connected to api at %s\n", deltaApi)
 	}
 
 	as := NewAuthServer(authServerUrl, authToken)
 
-	return &DeltaDM{
-		DAPI:       dapi,
-		DB:         dbi,
-		AS:         as,
-		Info:       di,
-		DryRunMode: dryRun,
+	dldm := &DeltaDM{
+		DAPI:         dapi,
+		Nodes:        NewDeltaNodes(dapi),
+		DB:           dbi,
+		AS:           as,
+		Info:         di,
+		DryRunMode:   dryRun,
+		e2eTransfers: newE2EQueue(),
+	}
+
+	if err := dldm.LoadDeltaNodes(); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	return dldm
+}
+
+// Returns the content location to hand out to a provider, signing it if URL signing is enabled
+// Content without a location of its own is served from DDM's CAR server, if enabled with a public url
+func (dldm *DeltaDM) ContentLocationFor(cnt db.Content, providerActorID string) (string, error) {
+	location := cnt.ContentLocation
+	if location == "" && dldm.CarServer != nil && dldm.CarServer.PublicUrl != "" {
+		location = dldm.CarServer.LocationFor(cnt.CommP)
 	}
+
+	if dldm.Signer == nil || location == "" {
+		return location, nil
+	}
+
+	return dldm.Signer.Sign(location, providerActorID)
 }
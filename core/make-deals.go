@@ -11,8 +11,44 @@ import (
 	"gorm.io/gorm"
 )
 
-// Make deals for the given OfflineDealRequests, and update DDM database accordingly
-func (dldm *DeltaDM) MakeDeals(dealsToMake OfflineDealRequest, authKey string, isSelfService bool) (*OfflineDealResponse, error) {
+// Deals that have been recorded as queued, and are waiting to be sent to Delta
+type RecordedDeals struct {
+	deals         []recordedDeal
+	authKey       string
+	isSelfService bool
+	// Deals that could not be recorded, and won't be sent
+	failed OfflineDealResponse
+	// Set in dry run mode, where the deals are recorded as made and nothing is sent
+	dryRun *OfflineDealResponse
+}
+
+type recordedDeal struct {
+	replicationID uint
+	deal          Deal
+	node          uint
+	// Reservations consumed by the replication, restored if Delta does not make the deal
+	reservations []uint
+}
+
+// Record the given deals as queued, counting them against their contents' replications and consuming the providers' reservations
+// Call this while holding the AllocationLock, then release it and send the deals to Delta with SendDeals
+func (dldm *DeltaDM) RecordDeals(dealsToMake OfflineDealRequest, authKey string, isSelfService bool) (*RecordedDeals, error) {
+	if err := CheckDatasetBudgets(dldm.DB, dealsToMake); err != nil {
+		return nil, err
+	}
+
+	requested := make(map[string]Deal)
+	for _, d := range dealsToMake {
+		requested[dealKey(d)] = d
+	}
+
+	routes, err := dldm.routeDeals(dealsToMake)
+	if err != nil {
+		return nil, err
+	}
+
+	rd := &RecordedDeals{authKey: authKey, isSelfService: isSelfService}
+
 	if dldm.DryRunMode {
 		fmt.Println(util.Red + "-- DRY RUN MODE (NO DEALS MADE) --" + util.Reset)
 		fmt.Printf("\n\n %+v \n\n", dealsToMake)
@@ -25,6 +61,7 @@ func (dldm *DeltaDM) MakeDeals(dealsToMake OfflineDealRequest, authKey string, i
 				ContentCommP:    c.DealRequestMeta.PieceCommitment.PieceCid,
 				ProviderActorID: c.DealRequestMeta.Miner,
 				DeltaContentID:  c.DeltaContentID,
+				DeltaNodeID:     routes[dealKey(c.DealRequestMeta)],
 				DealTime:        time.Now(),
 				Status:          db.DealStatus(sm.DealStates[sm.StorageDealProposalAccepted]),
 				OnChainDealID:   0,
@@ -33,50 +70,261 @@ func (dldm *DeltaDM) MakeDeals(dealsToMake OfflineDealRequest, authKey string, i
 				DeltaMessage:    "this is a dry run, no deal was made",
 			}
 			newReplication.SelfService.IsSelfService = isSelfService
+			applyRequestedDeal(&newReplication, requested[dealKey(c.DealRequestMeta)])
+			if isSelfService {
+				newReplication.SelfService.Status = db.SelfServiceStatusPending
+			}
 
-			res := dldm.DB.Model(&db.Replication{}).Create(&newReplication)
-			if res.Error != nil {
-				log.Errorf("unable to create replication in db: %s", res.Error)
+			err := dldm.DB.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Model(&db.Replication{}).Create(&newReplication).Error; err != nil {
+					return err
+				}
+				return ConsumeReservation(tx, newReplication.ProviderActorID, newReplication.ContentCommP)
+			})
+			if err != nil {
+				log.Errorf("unable to create replication in db: %s", err)
 				continue
 			}
 		}
 
-		return dealResp, nil
+		rd.dryRun = dealResp
+		return rd, nil
 	}
 
-	deltaResp, err := dldm.DAPI.MakeOfflineDeals(dealsToMake, authKey)
-	if err != nil {
-		return nil, fmt.Errorf("unable to make deal with delta api: %s", err)
+	for _, d := range dealsToMake {
+		var newReplication = db.Replication{
+			ContentCommP:    d.PieceCommitment.PieceCid,
+			ProviderActorID: d.Miner,
+			// Placeholder until Delta has made the deal. Delta's content IDs are positive, so this can't clash with a real one
+			DeltaContentID: -rand.Int63(),
+			DeltaNodeID:    routes[dealKey(d)],
+			DealTime:       time.Now(),
+			Status:         db.DDM_StorageDealStatusQueued,
+			OnChainDealID:  0,
+			ProposalCid:    "PENDING_" + fmt.Sprint(rand.Int()),
+			DealUUID:       "PENDING_" + fmt.Sprint(rand.Int()),
+		}
+		newReplication.SelfService.IsSelfService = isSelfService
+		applyRequestedDeal(&newReplication, requested[dealKey(d)])
+		if isSelfService {
+			newReplication.SelfService.Status = db.SelfServiceStatusPending
+		}
+
+		reservations, err := dldm.recordReplication(&newReplication)
+		if err != nil {
+			log.Errorf("unable to create replication in db: %s", err)
+			rd.failed = append(rd.failed, OfflineDealResponseElement{Status: "error", Message: "unable to record deal", DealRequestMeta: d})
+			continue
+		}
+
+		rd.deals = append(rd.deals, recordedDeal{replicationID: newReplication.ID, deal: d, node: newReplication.DeltaNodeID, reservations: reservations})
 	}
 
-	for _, c := range *deltaResp {
-		if c.Status != "success" {
+	return rd, nil
+}
+
+// Send recorded deals to Delta. Call this after releasing the AllocationLock, so other allocations don't wait on Delta
+// Offline deals Delta does not make are rolled back, as if they had never been recorded
+// E2E deals stay queued, and their data is pushed to Delta by background workers
+func (dldm *DeltaDM) SendDeals(rd *RecordedDeals) (*OfflineDealResponse, error) {
+	if rd.dryRun != nil {
+		return rd.dryRun, nil
+	}
+
+	deltaResp := &OfflineDealResponse{}
+	*deltaResp = append(*deltaResp, rd.failed...)
+
+	// Offline deals are made in one request per Delta node
+	imports := map[uint][]recordedDeal{}
+	var nodes []uint
+	var e2e []recordedDeal
+	for _, r := range rd.deals {
+		if r.deal.ConnectionMode == string(db.ConnectionModeE2E) {
+			e2e = append(e2e, r)
 			continue
 		}
-		var newReplication = db.Replication{
-			ContentCommP:    c.DealRequestMeta.PieceCommitment.PieceCid,
-			ProviderActorID: c.DealRequestMeta.Miner,
-			DeltaContentID:  c.DeltaContentID,
-			DealTime:        time.Now(),
-			Status:          db.DDM_StorageDealStatusPending,
-			OnChainDealID:   0,
-			ProposalCid:     "PENDING_" + fmt.Sprint(rand.Int()),
-			DealUUID:        "PENDING_" + fmt.Sprint(rand.Int()),
+		if _, ok := imports[r.node]; !ok {
+			nodes = append(nodes, r.node)
+		}
+		imports[r.node] = append(imports[r.node], r)
+	}
+
+	var nodeErrs []error
+	for _, node := range nodes {
+		var deals OfflineDealRequest
+		recorded := make(map[string]recordedDeal)
+		for _, r := range imports[node] {
+			deals = append(deals, r.deal)
+			recorded[dealKey(r.deal)] = r
 		}
-		newReplication.SelfService.IsSelfService = isSelfService
 
-		res := dldm.DB.Model(&db.Replication{}).Create(&newReplication)
-		if res.Error != nil {
-			log.Errorf("unable to create replication in db: %s", res.Error)
+		resp, err := dldm.makeOfflineDeals(node, deals, rd.authKey)
+		if err != nil {
+			// Deals on other nodes may have been made, so this node's deals are reported as failed rather than failing the whole request
+			nodeErrs = append(nodeErrs, err)
+			for _, r := range imports[node] {
+				dldm.rollbackDeal(r)
+				*deltaResp = append(*deltaResp, OfflineDealResponseElement{Status: "error", Message: err.Error(), DealRequestMeta: r.deal})
+			}
 			continue
 		}
 
-		// Update the content's num replications
-		dldm.DB.Model(&db.Content{}).Where("comm_p = ?", newReplication.ContentCommP).Update("num_replications", gorm.Expr("num_replications + ?", 1))
+		for _, c := range *resp {
+			r, ok := recorded[dealKey(c.DealRequestMeta)]
+			if !ok {
+				continue
+			}
+			delete(recorded, dealKey(c.DealRequestMeta))
+
+			if c.Status != "success" {
+				dldm.rollbackDeal(r)
+				continue
+			}
+
+			res := dldm.DB.Model(&db.Replication{}).Where("id = ? AND status = ?", r.replicationID, db.DDM_StorageDealStatusQueued).Updates(db.Replication{DeltaContentID: c.DeltaContentID, Status: db.DDM_StorageDealStatusPending})
+			if res.Error != nil {
+				log.Errorf("unable to record deal %d (delta content %d): %s", r.replicationID, c.DeltaContentID, res.Error)
+			} else if res.RowsAffected == 0 {
+				log.Errorf("deal %d was cancelled while it was sent, delta still made the deal (delta content %d)", r.replicationID, c.DeltaContentID)
+			}
+		}
+		*deltaResp = append(*deltaResp, *resp...)
+
+		// Delta did not answer for these, so they were not made
+		for _, r := range recorded {
+			dldm.rollbackDeal(r)
+		}
+	}
+	if len(nodeErrs) > 0 && len(nodeErrs) == len(nodes) && len(e2e) == 0 {
+		return nil, nodeErrs[0]
 	}
+
+	for _, r := range e2e {
+		dldm.e2eTransfers.push(e2eTransfer{replicationID: r.replicationID, deal: r.deal, node: r.node, authKey: rd.authKey})
+		*deltaResp = append(*deltaResp, OfflineDealResponseElement{Status: "success", Message: "queued - the data will be pushed to delta in the background", DealRequestMeta: r.deal})
+	}
+
 	return deltaResp, nil
 }
 
+// Record a new replication, counting it against its content's replications and consuming the provider's reservation for the content
+// The replica and the reservation are swapped in one transaction, so the content is never counted twice against its quota
+// Returns the IDs of the consumed reservations
+func (dldm *DeltaDM) recordReplication(r *db.Replication) ([]uint, error) {
+	var reservations []uint
+
+	err := dldm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&db.Replication{}).Create(r).Error; err != nil {
+			return err
+		}
+
+		// Update the content's num replications
+		if err := tx.Model(&db.Content{}).Where("comm_p = ?", r.ContentCommP).Update("num_replications", gorm.Expr("num_replications + ?", 1)).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&db.Reservation{}).Where("provider_actor_id = ? AND content_comm_p = ?", r.ProviderActorID, r.ContentCommP).Pluck("id", &reservations).Error; err != nil {
+			return err
+		}
+
+		return ConsumeReservation(tx, r.ProviderActorID, r.ContentCommP)
+	})
+
+	return reservations, err
+}
+
+// Undo recordReplication for a deal Delta did not make: remove its replication, and give back the content's replication and the provider's reservations
+// Deals cancelled while they were sent are left alone, as cancelling them already gave back the replication
+func (dldm *DeltaDM) rollbackDeal(r recordedDeal) {
+	err := dldm.DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Unscoped().Where("id = ? AND status = ?", r.replicationID, db.DDM_StorageDealStatusQueued).Delete(&db.Replication{})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+
+		if err := tx.Model(&db.Content{}).Where("comm_p = ? AND num_replications > 0", r.deal.PieceCommitment.PieceCid).Update("num_replications", gorm.Expr("num_replications - ?", 1)).Error; err != nil {
+			return err
+		}
+
+		if len(r.reservations) == 0 {
+			return nil
+		}
+		return tx.Unscoped().Model(&db.Reservation{}).Where("id IN ?", r.reservations).Update("deleted_at", nil).Error
+	})
+	if err != nil {
+		log.Errorf("unable to roll back deal %d for %s: %s", r.replicationID, r.deal.PieceCommitment.PieceCid, err)
+	}
+}
+
+func (dldm *DeltaDM) makeOfflineDeals(node uint, deals OfflineDealRequest, authKey string) (*OfflineDealResponse, error) {
+	dapi, authKey, err := dldm.Nodes.clientFor(node, authKey)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := dapi.MakeOfflineDeals(deals, authKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to make deal with delta api (node %d): %w", node, err)
+	}
+	return resp, nil
+}
+
+// Build the deal for a content, with the settings and price from the provider's replication profile
+// Deals last for the dataset's deal duration, less advanceDays
+func NewDeal(cnt db.Content, ds db.Dataset, rp db.ReplicationProfile, walletAddr string, startDays uint64, advanceDays uint64) (Deal, error) {
+	if ds.DealDuration < advanceDays+MIN_DEAL_DURATION_DAYS {
+		return Deal{}, fmt.Errorf("dataset '%s' has a deal duration of %d days, which less an end_epoch_advance of %d days is below the minimum deal duration of %d days", ds.Name, ds.DealDuration, advanceDays, MIN_DEAL_DURATION_DAYS)
+	}
+	durationDays := ds.DealDuration - advanceDays
+
+	deal := Deal{
+		PayloadCID: cnt.PayloadCID,
+		Wallet: db.Wallet{
+			Addr: walletAddr,
+		},
+		ConnectionMode:     string(db.ResolveConnectionMode(ds, rp)),
+		Miner:              rp.ProviderActorID,
+		Size:               cnt.Size,
+		SkipIpniAnnounce:   !rp.Indexed,
+		RemoveUnsealedCopy: !rp.Unsealed,
+		DurationInDays:     durationDays,
+		StartEpochInDays:   startDays,
+		PieceCommitment: PieceCommitment{
+			PieceCid:        cnt.CommP,
+			PaddedPieceSize: cnt.PaddedSize,
+		},
+		DatasetID:       cnt.DatasetID,
+		ContentLocation: cnt.ContentLocation,
+	}
+
+	if !rp.IsVerified() {
+		deal.DealVerifyState = "unverified"
+	}
+
+	pricePerEpoch, err := DealPricePerEpoch(rp.PricePerGiBEpoch, cnt.PaddedSize)
+	if err != nil {
+		return deal, fmt.Errorf("invalid price for provider %s: %s", rp.ProviderActorID, err)
+	}
+	if pricePerEpoch.Sign() > 0 {
+		deal.PricePerEpoch = pricePerEpoch.String()
+		deal.Cost = DealCost(pricePerEpoch, durationDays)
+	}
+
+	return deal, nil
+}
+
+func dealKey(d Deal) string {
+	return d.PieceCommitment.PieceCid + "/" + d.Miner
+}
+
+// Record the wallet and cost of the deal that was requested on its replication
+func applyRequestedDeal(r *db.Replication, d Deal) {
+	r.WalletAddr = d.Wallet.Addr
+	if d.Cost != nil && d.Cost.Sign() > 0 {
+		r.DealCost = d.Cost.String()
+	}
+}
+
 // Stub function to generate a mocked deal response for local testing.
 func dryRunDeal(odr *OfflineDealRequest) (*OfflineDealResponse, error) {
 	var resp OfflineDealResponse
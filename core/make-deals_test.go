@@ -0,0 +1,84 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+	"gorm.io/gorm"
+)
+
+func TestSendDealsRollsBack(t *testing.T) {
+	dbi, err := db.OpenDatabase(filepath.Join(t.TempDir(), "ddm.db"), db.PoolOptions{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := []interface{}{
+		&db.Dataset{Name: "ds", ReplicationQuota: 3, DealDuration: 540},
+		&db.Provider{ActorID: "f01000"},
+		&db.ReplicationProfile{ProviderActorID: "f01000", DatasetID: 1},
+		&db.Wallet{Addr: "f1wallet"},
+		&db.WalletDatasets{WalletAddr: "f1wallet", DatasetID: 1},
+		&db.Content{CommP: "a", DatasetID: 1, PaddedSize: 1 << 30},
+		&db.Reservation{ProviderActorID: "f01000", ContentCommP: "a", ExpiresAt: time.Now().Add(time.Hour)},
+	}
+	for _, m := range seed {
+		if err := dbi.Omit("Content").Create(m).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Delta refuses every request
+	srv, _ := flakyDelta(t, 1000)
+	dldm := &DeltaDM{DB: dbi, Nodes: NewDeltaNodes(NewDeltaClient(srv.URL, "", testClientOptions()))}
+	dldm.Nodes.status[0].Healthy = true
+
+	_, recorded, err := dldm.AllocateDeals(func() (*DealPlan, error) {
+		return dldm.PlanDeals(DealPlanOptions{ProviderActorID: "f01000", Pieces: []string{"a"}})
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r db.Replication
+	if err := dbi.Where("content_comm_p = ?", "a").First(&r).Error; err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != db.DDM_StorageDealStatusQueued {
+		t.Errorf("recorded status = %s, want %s", r.Status, db.DDM_StorageDealStatusQueued)
+	}
+	assertReplicas(t, dbi, 1, 0)
+
+	if _, err := dldm.SendDeals(recorded); err == nil {
+		t.Fatal("expected an error when delta refuses the deals")
+	}
+
+	var count int64
+	dbi.Unscoped().Model(&db.Replication{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d replications left after rollback, want 0", count)
+	}
+	assertReplicas(t, dbi, 0, 1)
+}
+
+func assertReplicas(t *testing.T, dbi *gorm.DB, wantReplications uint64, wantReservations int) {
+	t.Helper()
+
+	var c db.Content
+	if err := dbi.Where("comm_p = ?", "a").First(&c).Error; err != nil {
+		t.Fatal(err)
+	}
+	if c.NumReplications != wantReplications {
+		t.Errorf("num replications = %d, want %d", c.NumReplications, wantReplications)
+	}
+
+	reservations, err := ActiveReservations(dbi, "f01000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reservations) != wantReservations {
+		t.Errorf("%d active reservations, want %d", len(reservations), wantReservations)
+	}
+}
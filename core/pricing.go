@@ -0,0 +1,216 @@
+package core
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	db "github.com/application-research/delta-dm/db"
+	"gorm.io/gorm"
+)
+
+const EPOCHS_PER_DAY = 2880
+
+const GIB = 1 << 30
+
+var attoFilPerFil = big.NewInt(1e18)
+
+// Total spend on deals, for a wallet, provider or dataset
+type SpendEntry struct {
+	Key      string `json:"key"`
+	Deals    uint64 `json:"deals"`
+	AttoFil  string `json:"total_attofil"`
+	Fil      string `json:"total_fil"`
+	totalBig *big.Int
+}
+
+// Parse a non-negative amount of attoFIL. An empty string is zero
+func ParseAttoFil(s string) (*big.Int, error) {
+	if s == "" {
+		return big.NewInt(0), nil
+	}
+
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 {
+		return nil, fmt.Errorf("invalid attoFIL amount '%s', must be a non-negative integer", s)
+	}
+
+	return n, nil
+}
+
+// Format an amount of attoFIL as FIL
+func FormatFil(attoFil *big.Int) string {
+	s := new(big.Rat).SetFrac(attoFil, attoFilPerFil).FloatString(18)
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+// Price per epoch of a deal for a piece, given the price per GiB per epoch
+func DealPricePerEpoch(pricePerGiBEpoch string, paddedSize uint64) (*big.Int, error) {
+	price, err := ParseAttoFil(pricePerGiBEpoch)
+	if err != nil {
+		return nil, err
+	}
+
+	perEpoch := new(big.Int).Mul(price, new(big.Int).SetUint64(paddedSize))
+	return perEpoch.Div(perEpoch, big.NewInt(GIB)), nil
+}
+
+// Total price of a deal, over its whole duration
+func DealCost(pricePerEpoch *big.Int, durationDays uint64) *big.Int {
+	return new(big.Int).Mul(pricePerEpoch, new(big.Int).SetUint64(durationDays*EPOCHS_PER_DAY))
+}
+
+// Ensure the deals would not take any dataset over its budget
+func CheckDatasetBudgets(dbi *gorm.DB, deals []Deal) error {
+	costs := make(map[uint]*big.Int)
+	for _, d := range deals {
+		if d.Cost == nil || d.Cost.Sign() == 0 {
+			continue
+		}
+		if _, ok := costs[d.DatasetID]; !ok {
+			costs[d.DatasetID] = big.NewInt(0)
+		}
+		costs[d.DatasetID].Add(costs[d.DatasetID], d.Cost)
+	}
+
+	for datasetID, cost := range costs {
+		var ds db.Dataset
+		res := dbi.Model(&db.Dataset{}).Where("id = ?", datasetID).Find(&ds)
+		if res.Error != nil {
+			return fmt.Errorf("unable to find dataset %d: %s", datasetID, res.Error)
+		}
+		if ds.Budget == "" {
+			continue
+		}
+
+		budget, err := ParseAttoFil(ds.Budget)
+		if err != nil {
+			return fmt.Errorf("dataset '%s' has an invalid budget: %s", ds.Name, err)
+		}
+
+		spent, err := DatasetSpend(dbi, datasetID)
+		if err != nil {
+			return err
+		}
+
+		total := new(big.Int).Add(spent, cost)
+		if total.Cmp(budget) > 0 {
+			return fmt.Errorf("deals would take dataset '%s' over its budget: %s FIL spent, %s FIL requested, %s FIL budget", ds.Name, FormatFil(spent), FormatFil(cost), FormatFil(budget))
+		}
+	}
+
+	return nil
+}
+
+// Total spend on a dataset's deals, not counting deals that failed or were cancelled
+func DatasetSpend(dbi *gorm.DB, datasetID uint) (*big.Int, error) {
+	var costs []string
+	res := dbi.Model(&db.Replication{}).
+		Joins("inner join contents c on c.comm_p = replications.content_comm_p").
+		Where("c.dataset_id = ? AND replications.deal_cost <> '' AND replications.status NOT IN ?", datasetID, db.InactiveStatuses).
+		Pluck("replications.deal_cost", &costs)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to compute dataset spend: %s", res.Error)
+	}
+
+	total := big.NewInt(0)
+	for _, c := range costs {
+		n, err := ParseAttoFil(c)
+		if err != nil {
+			return nil, err
+		}
+		total.Add(total, n)
+	}
+
+	return total, nil
+}
+
+// Total spend on each of several datasets' deals, with one query. Datasets with no spend are not included in the result
+func DatasetSpends(dbi *gorm.DB, datasetIDs []uint) (map[uint]*big.Int, error) {
+	spends := make(map[uint]*big.Int)
+	if len(datasetIDs) == 0 {
+		return spends, nil
+	}
+
+	var rows []struct {
+		DatasetID uint
+		DealCost  string
+	}
+	res := dbi.Model(&db.Replication{}).
+		Select("c.dataset_id, replications.deal_cost").
+		Joins("inner join contents c on c.comm_p = replications.content_comm_p").
+		Where("c.dataset_id IN ? AND replications.deal_cost <> '' AND replications.status NOT IN ?", datasetIDs, db.InactiveStatuses).
+		Scan(&rows)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to compute dataset spend: %s", res.Error)
+	}
+
+	for _, r := range rows {
+		n, err := ParseAttoFil(r.DealCost)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := spends[r.DatasetID]; !ok {
+			spends[r.DatasetID] = big.NewInt(0)
+		}
+		spends[r.DatasetID].Add(spends[r.DatasetID], n)
+	}
+
+	return spends, nil
+}
+
+// Total spend on deals that have not failed or been cancelled, grouped by "wallet", "provider" or "dataset"
+func SpendReport(dbi *gorm.DB, groupBy string) ([]SpendEntry, error) {
+	var keyCol string
+	switch groupBy {
+	case "wallet":
+		keyCol = "replications.wallet_addr"
+	case "provider":
+		keyCol = "replications.provider_actor_id"
+	case "dataset":
+		keyCol = "d.name"
+	default:
+		return nil, fmt.Errorf("invalid group_by '%s', must be one of wallet, provider, dataset", groupBy)
+	}
+
+	var rows []struct {
+		Key      string
+		DealCost string
+	}
+	res := dbi.Model(&db.Replication{}).
+		Select(keyCol+" AS key, replications.deal_cost").
+		Joins("inner join contents c on c.comm_p = replications.content_comm_p").
+		Joins("inner join datasets d on d.id = c.dataset_id").
+		Where("replications.deal_cost <> '' AND replications.status NOT IN ?", db.InactiveStatuses).
+		Scan(&rows)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to compute spend: %s", res.Error)
+	}
+
+	entries := make(map[string]*SpendEntry)
+	for _, r := range rows {
+		cost, err := ParseAttoFil(r.DealCost)
+		if err != nil {
+			return nil, err
+		}
+
+		e, ok := entries[r.Key]
+		if !ok {
+			e = &SpendEntry{Key: r.Key, totalBig: big.NewInt(0)}
+			entries[r.Key] = e
+		}
+		e.Deals++
+		e.totalBig.Add(e.totalBig, cost)
+	}
+
+	report := []SpendEntry{}
+	for _, e := range entries {
+		e.AttoFil = e.totalBig.String()
+		e.Fil = FormatFil(e.totalBig)
+		report = append(report, *e)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].totalBig.Cmp(report[j].totalBig) > 0 })
+
+	return report, nil
+}
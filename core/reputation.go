@@ -0,0 +1,226 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+	"gorm.io/gorm"
+)
+
+// Rolling windows, in days, that reputation is computed over
+var ReputationWindowDays = []uint{7, 30, 90}
+
+// The window the reputation score is computed from
+const REPUTATION_SCORE_WINDOW_DAYS = 30
+
+// Min number of finished (on chain or failed) deals in the scoring window for a provider to be scored
+const DEFAULT_REPUTATION_MIN_SAMPLES = 10
+
+// How long a provider has to report telemetry for a self-service deal before it counts against its responsiveness
+const TELEMETRY_GRACE_PERIOD = 24 * time.Hour
+
+// How long a provider's reputation check is cached for, as it is computed over all of its deals in the largest window
+const REPUTATION_CACHE_TTL = 10 * time.Minute
+
+// Gates self-service for providers whose reputation score is below a threshold
+type ReputationPolicy struct {
+	MinScore float64
+	// Providers with fewer finished deals than this in the scoring window are not gated
+	MinSamples uint64
+
+	lock   sync.Mutex
+	checks map[string]reputationCheck
+}
+
+type reputationCheck struct {
+	err       error
+	checkedAt time.Time
+}
+
+func NewReputationPolicy(minScore float64, minSamples uint64) *ReputationPolicy {
+	return &ReputationPolicy{
+		MinScore:   minScore,
+		MinSamples: minSamples,
+		checks:     make(map[string]reputationCheck),
+	}
+}
+
+// The columns of a replication that reputation is computed from
+type reputationSample struct {
+	ProviderActorID string
+	Status          db.DealStatus
+	OnChainDealID   uint
+	DealTime        time.Time
+	OnChainAt       *time.Time
+	SsIsSelfService bool
+	SsStatus        db.SelfServiceStatus
+}
+
+// Compute the reputation of every provider with deals in the largest window
+func ProviderReputations(dbi *gorm.DB) (map[string]*db.ProviderReputation, error) {
+	return providerReputations(dbi, "")
+}
+
+// Compute the reputation of a single provider
+func ProviderReputation(dbi *gorm.DB, providerActorID string) (*db.ProviderReputation, error) {
+	reps, err := providerReputations(dbi, providerActorID)
+	if err != nil {
+		return nil, err
+	}
+
+	rep, ok := reps[providerActorID]
+	if !ok {
+		return computeReputation(nil, time.Now(), DEFAULT_REPUTATION_MIN_SAMPLES), nil
+	}
+
+	return rep, nil
+}
+
+// Check a provider's reputation against the policy, returning an error if it should not be allowed to self-serve
+// The result is cached for REPUTATION_CACHE_TTL
+func (rp *ReputationPolicy) Check(dbi *gorm.DB, providerActorID string) error {
+	rp.lock.Lock()
+	cached, ok := rp.checks[providerActorID]
+	rp.lock.Unlock()
+	if ok && time.Since(cached.checkedAt) < REPUTATION_CACHE_TTL {
+		return cached.err
+	}
+
+	err := rp.check(dbi, providerActorID)
+
+	rp.lock.Lock()
+	rp.checks[providerActorID] = reputationCheck{err: err, checkedAt: time.Now()}
+	rp.lock.Unlock()
+
+	return err
+}
+
+func (rp *ReputationPolicy) check(dbi *gorm.DB, providerActorID string) error {
+	rep, err := ProviderReputation(dbi, providerActorID)
+	if err != nil {
+		return err
+	}
+
+	w := rep.Windows[scoreWindowIndex()]
+	if w.OnChain+w.Failed < rp.MinSamples {
+		return nil
+	}
+
+	score := reputationScore(w)
+	if score < rp.MinScore {
+		return fmt.Errorf("provider score %.1f is below the minimum of %.1f required for self-service", score, rp.MinScore)
+	}
+
+	return nil
+}
+
+func providerReputations(dbi *gorm.DB, providerActorID string) (map[string]*db.ProviderReputation, error) {
+	now := time.Now()
+	since := now.Add(-windowDuration(ReputationWindowDays[len(ReputationWindowDays)-1]))
+
+	tx := dbi.Model(&db.Replication{}).
+		Select("provider_actor_id, status, on_chain_deal_id, deal_time, on_chain_at, ss_is_self_service, ss_status").
+		Where("deal_time >= ?", since)
+
+	if providerActorID != "" {
+		tx.Where("provider_actor_id = ?", providerActorID)
+	}
+
+	var samples []reputationSample
+	res := tx.Find(&samples)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to find replications: %s", res.Error)
+	}
+
+	byProvider := make(map[string][]reputationSample)
+	for _, s := range samples {
+		byProvider[s.ProviderActorID] = append(byProvider[s.ProviderActorID], s)
+	}
+
+	reps := make(map[string]*db.ProviderReputation)
+	for p, s := range byProvider {
+		reps[p] = computeReputation(s, now, DEFAULT_REPUTATION_MIN_SAMPLES)
+	}
+
+	return reps, nil
+}
+
+func computeReputation(samples []reputationSample, now time.Time, minSamples uint64) *db.ProviderReputation {
+	rep := &db.ProviderReputation{}
+
+	for _, days := range ReputationWindowDays {
+		since := now.Add(-windowDuration(days))
+		w := db.ReputationWindow{Days: days, FailureCategories: make(map[db.DealStatus]uint64)}
+		var toOnChain []time.Duration
+
+		for _, s := range samples {
+			if s.DealTime.Before(since) {
+				continue
+			}
+			w.Deals++
+
+			switch {
+			case s.Status.IsCancelled():
+				w.Cancelled++
+			case s.Status.HasFailed():
+				w.Failed++
+				w.FailureCategories[s.Status]++
+			case s.OnChainDealID != 0:
+				w.OnChain++
+				if s.OnChainAt != nil && s.OnChainAt.After(s.DealTime) {
+					toOnChain = append(toOnChain, s.OnChainAt.Sub(s.DealTime))
+				}
+			default:
+				w.InFlight++
+			}
+
+			if s.SsIsSelfService && now.Sub(s.DealTime) >= TELEMETRY_GRACE_PERIOD {
+				w.SelfServiceDeals++
+				if s.SsStatus != "" && s.SsStatus != db.SelfServiceStatusPending {
+					w.TelemetryReported++
+				}
+			}
+		}
+
+		if w.OnChain+w.Failed > 0 {
+			w.SuccessRate = float64(w.OnChain) / float64(w.OnChain+w.Failed)
+		}
+		if w.SelfServiceDeals > 0 {
+			w.TelemetryResponsiveness = float64(w.TelemetryReported) / float64(w.SelfServiceDeals)
+		}
+		w.MedianTimeToOnChainSeconds = uint64(median(toOnChain).Seconds())
+
+		rep.Windows = append(rep.Windows, w)
+	}
+
+	w := rep.Windows[scoreWindowIndex()]
+	if w.OnChain+w.Failed >= minSamples {
+		score := reputationScore(w)
+		rep.Score = &score
+	}
+
+	return rep
+}
+
+// Success rate makes up the score, with telemetry responsiveness weighed in for providers that use self-service
+func reputationScore(w db.ReputationWindow) float64 {
+	if w.SelfServiceDeals == 0 {
+		return 100 * w.SuccessRate
+	}
+	return 100 * (0.8*w.SuccessRate + 0.2*w.TelemetryResponsiveness)
+}
+
+func scoreWindowIndex() int {
+	for i, days := range ReputationWindowDays {
+		if days == REPUTATION_SCORE_WINDOW_DAYS {
+			return i
+		}
+	}
+	return len(ReputationWindowDays) - 1
+}
+
+func windowDuration(days uint) time.Duration {
+	return time.Duration(days) * 24 * time.Hour
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+)
+
+func TestComputeReputation(t *testing.T) {
+	now := time.Unix(1685000000, 0)
+	daysAgo := func(d int) time.Time { return now.Add(-time.Duration(d) * 24 * time.Hour) }
+	onChain := func(dealTime time.Time, after time.Duration) *time.Time {
+		t := dealTime.Add(after)
+		return &t
+	}
+
+	samples := []reputationSample{
+		{Status: "active", OnChainDealID: 1, DealTime: daysAgo(2), OnChainAt: onChain(daysAgo(2), time.Hour), SsIsSelfService: true, SsStatus: db.SelfServiceStatusSealed},
+		{Status: "active", OnChainDealID: 2, DealTime: daysAgo(3), OnChainAt: onChain(daysAgo(3), 3*time.Hour), SsIsSelfService: true},
+		{Status: "transfer-failed", DealTime: daysAgo(10)},
+		{Status: "transfer-failed", DealTime: daysAgo(60)},
+		{Status: "ddm-pending", DealTime: daysAgo(1)},
+		// Cancelled in DDM, so not a failure of the provider
+		{Status: db.DDM_StorageDealStatusCancelled, DealTime: daysAgo(5)},
+	}
+
+	rep := computeReputation(samples, now, 3)
+
+	tests := []struct {
+		days        uint
+		deals       uint64
+		onChain     uint64
+		failed      uint64
+		inFlight    uint64
+		cancelled   uint64
+		successRate float64
+		medianSecs  uint64
+		ssDeals     uint64
+		ssReported  uint64
+	}{
+		{7, 4, 2, 0, 1, 1, 1, 7200, 2, 1},
+		{30, 5, 2, 1, 1, 1, 2.0 / 3, 7200, 2, 1},
+		{90, 6, 2, 2, 1, 1, 0.5, 7200, 2, 1},
+	}
+
+	for i, tt := range tests {
+		w := rep.Windows[i]
+		if w.Days != tt.days || w.Deals != tt.deals || w.OnChain != tt.onChain || w.Failed != tt.failed || w.InFlight != tt.inFlight || w.Cancelled != tt.cancelled {
+			t.Errorf("window %d: got %+v", tt.days, w)
+		}
+		if w.SuccessRate != tt.successRate {
+			t.Errorf("window %d: success rate = %f, want %f", tt.days, w.SuccessRate, tt.successRate)
+		}
+		if w.MedianTimeToOnChainSeconds != tt.medianSecs {
+			t.Errorf("window %d: median time to on chain = %d, want %d", tt.days, w.MedianTimeToOnChainSeconds, tt.medianSecs)
+		}
+		if w.SelfServiceDeals != tt.ssDeals || w.TelemetryReported != tt.ssReported {
+			t.Errorf("window %d: telemetry = %d/%d, want %d/%d", tt.days, w.TelemetryReported, w.SelfServiceDeals, tt.ssReported, tt.ssDeals)
+		}
+	}
+
+	if rep.Score == nil {
+		t.Fatalf("expected a score")
+	}
+	want := 100 * (0.8*(2.0/3) + 0.2*0.5)
+	if math.Abs(*rep.Score-want) > 1e-9 {
+		t.Errorf("score = %f, want %f", *rep.Score, want)
+	}
+
+	if unscored := computeReputation(samples, now, 4); unscored.Score != nil {
+		t.Errorf("expected no score with too few samples, got %f", *unscored.Score)
+	}
+}
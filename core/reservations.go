@@ -0,0 +1,149 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+	"gorm.io/gorm"
+)
+
+const DEFAULT_RESERVATION_DURATION = 24 * time.Hour
+const MAX_RESERVATION_DURATION = 7 * 24 * time.Hour
+
+// Max number of active reservations a provider may hold at once
+const MAX_ACTIVE_RESERVATIONS = 500
+
+// Reserve contents for a provider, for the given duration
+func CreateReservations(dbi *gorm.DB, providerActorID string, commPs []string, duration time.Duration) ([]db.Reservation, error) {
+	if err := validateReservationDuration(duration); err != nil {
+		return nil, err
+	}
+
+	var active int64
+	res := dbi.Model(&db.Reservation{}).Where("provider_actor_id = ? AND expires_at > ?", providerActorID, time.Now()).Count(&active)
+	if res.Error != nil {
+		return nil, fmt.Errorf("could not count active reservations: %s", res.Error)
+	}
+
+	if active+int64(len(commPs)) > MAX_ACTIVE_RESERVATIONS {
+		return nil, fmt.Errorf("provider '%s' may hold at most %d active reservations, and has %d", providerActorID, MAX_ACTIVE_RESERVATIONS, active)
+	}
+
+	expiresAt := time.Now().Add(duration)
+	var reservations []db.Reservation
+	for _, commP := range commPs {
+		reservations = append(reservations, db.Reservation{
+			ProviderActorID: providerActorID,
+			ContentCommP:    commP,
+			ExpiresAt:       expiresAt,
+		})
+	}
+
+	if len(reservations) == 0 {
+		return reservations, nil
+	}
+
+	res = dbi.Omit("Content").Create(&reservations)
+	if res.Error != nil {
+		return nil, fmt.Errorf("could not create reservations: %s", res.Error)
+	}
+
+	return reservations, nil
+}
+
+// Get all of a provider's reservations that have not expired
+func ActiveReservations(dbi *gorm.DB, providerActorID string) ([]db.Reservation, error) {
+	var reservations []db.Reservation
+
+	res := dbi.Model(&db.Reservation{}).
+		Preload("Content").
+		Where("provider_actor_id = ? AND expires_at > ?", providerActorID, time.Now()).
+		Order("expires_at ASC").
+		Find(&reservations)
+
+	if res.Error != nil {
+		return nil, fmt.Errorf("could not find reservations: %s", res.Error)
+	}
+
+	return reservations, nil
+}
+
+// Extend a provider's active reservation, so it expires after the given duration from now
+func ExtendReservation(dbi *gorm.DB, providerActorID string, id uint, duration time.Duration) (*db.Reservation, error) {
+	if err := validateReservationDuration(duration); err != nil {
+		return nil, err
+	}
+
+	r, err := findActiveReservation(dbi, providerActorID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.ExpiresAt = time.Now().Add(duration)
+	res := dbi.Model(r).Update("expires_at", r.ExpiresAt)
+	if res.Error != nil {
+		return nil, fmt.Errorf("could not extend reservation %d: %s", id, res.Error)
+	}
+
+	return r, nil
+}
+
+// Release a provider's active reservation, so the content may be handed out to others
+func ReleaseReservation(dbi *gorm.DB, providerActorID string, id uint) error {
+	r, err := findActiveReservation(dbi, providerActorID, id)
+	if err != nil {
+		return err
+	}
+
+	res := dbi.Delete(r)
+	if res.Error != nil {
+		return fmt.Errorf("could not release reservation %d: %s", id, res.Error)
+	}
+
+	return nil
+}
+
+// Remove a provider's reservation for a content once a deal has been made for it
+func ConsumeReservation(dbi *gorm.DB, providerActorID string, commP string) error {
+	res := dbi.Where("provider_actor_id = ? AND content_comm_p = ?", providerActorID, commP).Delete(&db.Reservation{})
+	if res.Error != nil {
+		return fmt.Errorf("could not consume reservation for content '%s': %s", commP, res.Error)
+	}
+	return nil
+}
+
+// Count the active reservations other providers hold for a content
+func CountOtherReservations(dbi *gorm.DB, providerActorID string, commP string) (int64, error) {
+	var count int64
+
+	res := dbi.Model(&db.Reservation{}).
+		Where("content_comm_p = ? AND provider_actor_id <> ? AND expires_at > ?", commP, providerActorID, time.Now()).
+		Count(&count)
+
+	return count, res.Error
+}
+
+func findActiveReservation(dbi *gorm.DB, providerActorID string, id uint) (*db.Reservation, error) {
+	var r db.Reservation
+
+	res := dbi.Model(&db.Reservation{}).
+		Where("id = ? AND provider_actor_id = ? AND expires_at > ?", id, providerActorID, time.Now()).
+		Find(&r)
+
+	if res.Error != nil {
+		return nil, fmt.Errorf("could not find reservation %d: %s", id, res.Error)
+	}
+	if r.ID == 0 {
+		return nil, fmt.Errorf("reservation %d does not exist, or has expired", id)
+	}
+
+	return &r, nil
+}
+
+func validateReservationDuration(duration time.Duration) error {
+	if duration < time.Hour || duration > MAX_RESERVATION_DURATION {
+		return fmt.Errorf("reservation duration must be between 1 hour and %d hours", int(MAX_RESERVATION_DURATION.Hours()))
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+	"gorm.io/gorm"
+)
+
+// A series of snapshots for one dataset or provider, oldest first
+type StatsSeries struct {
+	EntityType db.StatsEntityType `json:"entity_type"`
+	EntityID   string             `json:"entity_id"`
+	Points     []StatsPoint       `json:"points"`
+}
+
+type StatsPoint struct {
+	Time time.Time `json:"time"`
+	db.StatsTotals
+}
+
+type StatsTimeseriesQuery struct {
+	EntityType db.StatsEntityType
+	EntityID   string // optional - all datasets or providers if empty
+	From       time.Time
+	To         time.Time
+	Interval   time.Duration // optional - if set, only the last snapshot in each interval is returned
+}
+
+type statsAggregate struct {
+	EntityID string
+	db.StatsTotals
+}
+
+// Compute the current totals for every dataset or provider that has replications, with one grouped query
+func aggregateStats(dbi *gorm.DB, entityType db.StatsEntityType) (map[string]db.StatsTotals, error) {
+	var keyCol string
+	switch entityType {
+	case db.StatsEntityDataset:
+		keyCol = "d.name"
+	case db.StatsEntityProvider:
+		keyCol = "r.provider_actor_id"
+	default:
+		return nil, fmt.Errorf("invalid entity type '%s', must be one of dataset, provider", entityType)
+	}
+
+	var rows []statsAggregate
+	res := dbi.Raw(`SELECT `+keyCol+` AS entity_id,
+			SUM(CASE WHEN r.status NOT IN @inactive AND r.on_chain_deal_id <> 0 THEN 1 ELSE 0 END) AS count_replicated,
+			SUM(CASE WHEN r.status NOT IN @inactive AND r.on_chain_deal_id <> 0 THEN c.padded_size ELSE 0 END) AS bytes_replicated,
+			SUM(CASE WHEN r.status NOT IN @inactive AND r.on_chain_deal_id = 0 THEN 1 ELSE 0 END) AS count_pending,
+			SUM(CASE WHEN r.status NOT IN @inactive AND r.on_chain_deal_id = 0 THEN c.padded_size ELSE 0 END) AS bytes_pending,
+			SUM(CASE WHEN r.status IN @failed THEN 1 ELSE 0 END) AS count_failed,
+			SUM(CASE WHEN r.status IN @failed THEN c.padded_size ELSE 0 END) AS bytes_failed,
+			SUM(CASE WHEN r.status IN @cancelled THEN 1 ELSE 0 END) AS count_cancelled,
+			SUM(CASE WHEN r.status IN @cancelled THEN c.padded_size ELSE 0 END) AS bytes_cancelled
+		FROM replications r
+		INNER JOIN contents c ON c.comm_p = r.content_comm_p
+		INNER JOIN datasets d ON d.id = c.dataset_id
+		WHERE r.deleted_at IS NULL
+		GROUP BY `+keyCol, map[string]interface{}{"failed": db.FailedStatuses, "cancelled": db.CancelledStatuses, "inactive": db.InactiveStatuses}).Scan(&rows)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to compute %s stats: %s", entityType, res.Error)
+	}
+
+	totals := make(map[string]db.StatsTotals, len(rows))
+	for _, r := range rows {
+		totals[r.EntityID] = r.StatsTotals
+	}
+
+	return totals, nil
+}
+
+// Record the current totals of every dataset and provider, including those with no replications yet
+func TakeStatsSnapshot(dbi *gorm.DB, now time.Time) ([]db.StatsSnapshot, error) {
+	var datasets []string
+	if res := dbi.Model(&db.Dataset{}).Pluck("name", &datasets); res.Error != nil {
+		return nil, fmt.Errorf("unable to query datasets: %s", res.Error)
+	}
+
+	var providers []string
+	if res := dbi.Model(&db.Provider{}).Pluck("actor_id", &providers); res.Error != nil {
+		return nil, fmt.Errorf("unable to query providers: %s", res.Error)
+	}
+
+	snapshots := []db.StatsSnapshot{}
+	for entityType, ids := range map[db.StatsEntityType][]string{db.StatsEntityDataset: datasets, db.StatsEntityProvider: providers} {
+		totals, err := aggregateStats(dbi, entityType)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			snapshots = append(snapshots, db.StatsSnapshot{EntityType: entityType, EntityID: id, TakenAt: now, StatsTotals: totals[id]})
+		}
+	}
+
+	if len(snapshots) == 0 {
+		return snapshots, nil
+	}
+
+	if res := dbi.CreateInBatches(&snapshots, 500); res.Error != nil {
+		return nil, fmt.Errorf("unable to save stats snapshot: %s", res.Error)
+	}
+
+	return snapshots, nil
+}
+
+// Periodically snapshot dataset and provider stats, starting immediately
+func (dldm *DeltaDM) ScheduleStatsSnapshots(interval time.Duration) {
+	go func() {
+		for {
+			snapshots, err := TakeStatsSnapshot(dldm.DB, time.Now().UTC())
+			if err != nil {
+				log.Errorf("failed taking stats snapshot: %s", err)
+			} else {
+				log.Debugf("took stats snapshot of %d datasets and providers", len(snapshots))
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Get stored snapshots for a dataset or provider, or all of them, within a time range
+func StatsTimeseries(dbi *gorm.DB, q StatsTimeseriesQuery) ([]StatsSeries, error) {
+	var snapshots []db.StatsSnapshot
+	tx := dbi.Model(&db.StatsSnapshot{}).
+		Where("entity_type = ? AND taken_at >= ? AND taken_at <= ?", q.EntityType, q.From.UTC(), q.To.UTC())
+	if q.EntityID != "" {
+		tx = tx.Where("entity_id = ?", q.EntityID)
+	}
+	if res := tx.Order("entity_id ASC, taken_at ASC").Find(&snapshots); res.Error != nil {
+		return nil, fmt.Errorf("unable to query stats: %s", res.Error)
+	}
+
+	return buildStatsSeries(snapshots, q.Interval), nil
+}
+
+// Group snapshots, ordered by entity and time, into a series per entity
+// If interval is set, consecutive snapshots in the same interval are collapsed into the last of them, timed at the start of the interval
+func buildStatsSeries(snapshots []db.StatsSnapshot, interval time.Duration) []StatsSeries {
+	series := []StatsSeries{}
+
+	for _, s := range snapshots {
+		if len(series) == 0 || series[len(series)-1].EntityID != s.EntityID {
+			series = append(series, StatsSeries{EntityType: s.EntityType, EntityID: s.EntityID, Points: []StatsPoint{}})
+		}
+		cur := &series[len(series)-1]
+
+		t := s.TakenAt.UTC()
+		if interval > 0 {
+			t = t.Truncate(interval)
+			if n := len(cur.Points); n > 0 && cur.Points[n-1].Time.Equal(t) {
+				cur.Points[n-1].StatsTotals = s.StatsTotals
+				continue
+			}
+		}
+		cur.Points = append(cur.Points, StatsPoint{Time: t, StatsTotals: s.StatsTotals})
+	}
+
+	return series
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+)
+
+func TestBuildStatsSeries(t *testing.T) {
+	base := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	snap := func(id string, after time.Duration, replicated uint64) db.StatsSnapshot {
+		return db.StatsSnapshot{EntityType: db.StatsEntityDataset, EntityID: id, TakenAt: base.Add(after), StatsTotals: db.StatsTotals{CountReplicated: replicated}}
+	}
+
+	snapshots := []db.StatsSnapshot{
+		snap("a", 10*time.Minute, 1),
+		snap("a", 50*time.Minute, 2),
+		snap("a", 70*time.Minute, 3),
+		snap("b", 0, 7),
+	}
+
+	raw := buildStatsSeries(snapshots, 0)
+	if len(raw) != 2 || len(raw[0].Points) != 3 || len(raw[1].Points) != 1 {
+		t.Fatalf("unexpected series: %+v", raw)
+	}
+
+	hourly := buildStatsSeries(snapshots, time.Hour)
+	if len(hourly[0].Points) != 2 {
+		t.Fatalf("expected 2 hourly points, got %+v", hourly[0].Points)
+	}
+	if p := hourly[0].Points[0]; !p.Time.Equal(base) || p.CountReplicated != 2 {
+		t.Errorf("first hour = %+v, want the last snapshot in the hour at %s", p, base)
+	}
+	if p := hourly[0].Points[1]; !p.Time.Equal(base.Add(time.Hour)) || p.CountReplicated != 3 {
+		t.Errorf("second hour = %+v", p)
+	}
+	if hourly[1].EntityID != "b" || hourly[1].Points[0].CountReplicated != 7 {
+		t.Errorf("unexpected second series: %+v", hourly[1])
+	}
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+	"gorm.io/gorm"
+)
+
+// Median time a provider's self-service deals spend in each state
+type TimeInStateStats struct {
+	ProviderActorID string                          `json:"provider_actor_id"`
+	MedianSeconds   map[db.SelfServiceStatus]uint64 `json:"median_seconds"`
+	Samples         map[db.SelfServiceStatus]uint64 `json:"samples"`
+}
+
+// Apply a provider's telemetry update to a self-service replication, validating the state transition and recording it as an event
+// Reporting the current state again only updates the message
+func UpdateSelfServiceState(dbi *gorm.DB, repl *db.Replication, state db.SelfServiceStatus, message string) error {
+	from := repl.SelfService.Status.Current()
+
+	now := time.Now()
+
+	return dbi.Transaction(func(tx *gorm.DB) error {
+		if from != state {
+			if !from.CanTransitionTo(state) {
+				return fmt.Errorf("invalid state transition from %s to %s", from, state)
+			}
+
+			evt := db.SelfServiceEvent{
+				ReplicationID:   repl.ID,
+				ProviderActorID: repl.ProviderActorID,
+				FromState:       from,
+				State:           state,
+				Message:         message,
+				Timestamp:       now,
+			}
+			if err := tx.Create(&evt).Error; err != nil {
+				return fmt.Errorf("unable to record state change: %s", err)
+			}
+		}
+
+		repl.SelfService.LastUpdate = now
+		repl.SelfService.Status = state
+		repl.SelfService.Message = message
+
+		return tx.Model(&db.Replication{}).Where("id = ?", repl.ID).Updates(map[string]interface{}{
+			"ss_last_update": repl.SelfService.LastUpdate,
+			"ss_status":      repl.SelfService.Status,
+			"ss_message":     repl.SelfService.Message,
+		}).Error
+	})
+}
+
+// Compute the median time spent in each state across a provider's self-service deals
+func ProviderTimeInState(dbi *gorm.DB, providerActorID string) (*TimeInStateStats, error) {
+	var events []db.SelfServiceEvent
+	res := dbi.Model(&db.SelfServiceEvent{}).
+		Where("provider_actor_id = ?", providerActorID).
+		Order("replication_id ASC, timestamp ASC, id ASC").
+		Find(&events)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to find telemetry events: %s", res.Error)
+	}
+
+	// Deals are pending from when they are made until their first event
+	var deals []struct {
+		ID       uint
+		DealTime time.Time
+	}
+	res = dbi.Model(&db.Replication{}).
+		Select("id, deal_time").
+		Where("provider_actor_id = ? AND id IN (?)", providerActorID, dbi.Model(&db.SelfServiceEvent{}).Select("replication_id").Where("provider_actor_id = ?", providerActorID)).
+		Find(&deals)
+	if res.Error != nil {
+		return nil, fmt.Errorf("unable to find self-service deals: %s", res.Error)
+	}
+
+	madeAt := make(map[uint]time.Time)
+	for _, d := range deals {
+		madeAt[d.ID] = d.DealTime
+	}
+
+	medians, samples := computeTimeInState(events, madeAt)
+
+	return &TimeInStateStats{
+		ProviderActorID: providerActorID,
+		MedianSeconds:   medians,
+		Samples:         samples,
+	}, nil
+}
+
+// Time in a state is measured from the event entering it to the next event for the same replication.
+// Time in PENDING is measured from when the deal was made (madeAt, by replication ID) to its first event.
+// Events must be ordered by replication, then timestamp
+func computeTimeInState(events []db.SelfServiceEvent, madeAt map[uint]time.Time) (map[db.SelfServiceStatus]uint64, map[db.SelfServiceStatus]uint64) {
+	durations := make(map[db.SelfServiceStatus][]time.Duration)
+
+	for i, cur := range events {
+		if i == 0 || events[i-1].ReplicationID != cur.ReplicationID {
+			if t, ok := madeAt[cur.ReplicationID]; ok && cur.FromState == db.SelfServiceStatusPending && !cur.Timestamp.Before(t) {
+				durations[db.SelfServiceStatusPending] = append(durations[db.SelfServiceStatusPending], cur.Timestamp.Sub(t))
+			}
+		}
+
+		if i+1 < len(events) && events[i+1].ReplicationID == cur.ReplicationID {
+			durations[cur.State] = append(durations[cur.State], events[i+1].Timestamp.Sub(cur.Timestamp))
+		}
+	}
+
+	medians := make(map[db.SelfServiceStatus]uint64)
+	samples := make(map[db.SelfServiceStatus]uint64)
+	for state, d := range durations {
+		medians[state] = uint64(median(d).Seconds())
+		samples[state] = uint64(len(d))
+	}
+
+	return medians, samples
+}
+
+func median(d []time.Duration) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+
+	sorted := make([]time.Duration, len(d))
+	copy(sorted, d)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	db "github.com/application-research/delta-dm/db"
+)
+
+func TestComputeTimeInState(t *testing.T) {
+	made := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return made.Add(time.Duration(minutes) * time.Minute) }
+	event := func(repl uint, from db.SelfServiceStatus, state db.SelfServiceStatus, minutes int) db.SelfServiceEvent {
+		return db.SelfServiceEvent{ReplicationID: repl, FromState: from, State: state, Timestamp: at(minutes)}
+	}
+
+	events := []db.SelfServiceEvent{
+		event(1, db.SelfServiceStatusPending, db.SelfServiceStatusDownloading, 10),
+		event(1, db.SelfServiceStatusDownloading, db.SelfServiceStatusDownloaded, 70),
+		event(2, db.SelfServiceStatusPending, db.SelfServiceStatusDownloading, 30),
+		event(2, db.SelfServiceStatusDownloading, db.SelfServiceStatusFailed, 60),
+		// Made before deal times were known to the stats, so its time pending is not counted
+		event(3, db.SelfServiceStatusPending, db.SelfServiceStatusImporting, 5),
+	}
+	madeAt := map[uint]time.Time{1: made, 2: made}
+
+	medians, samples := computeTimeInState(events, madeAt)
+
+	want := map[db.SelfServiceStatus]struct{ median, samples uint64 }{
+		db.SelfServiceStatusPending:     {20 * 60, 2},
+		db.SelfServiceStatusDownloading: {45 * 60, 2},
+	}
+	for state, w := range want {
+		if medians[state] != w.median || samples[state] != w.samples {
+			t.Errorf("%s: median %ds over %d samples, want %ds over %d", state, medians[state], samples[state], w.median, w.samples)
+		}
+	}
+	if len(samples) != len(want) {
+		t.Errorf("got samples for %v, want only %v", samples, want)
+	}
+}
+
+func TestSelfServiceStatusCurrent(t *testing.T) {
+	// States from before they were validated are treated as pending, so deals can move on from them
+	for _, ss := range []db.SelfServiceStatus{"", "downloading 50%"} {
+		if !ss.CanTransitionTo(db.SelfServiceStatusDownloading) {
+			t.Errorf("%q should be able to move to DOWNLOADING", ss)
+		}
+	}
+	for _, ss := range []db.SelfServiceStatus{db.SelfServiceStatusSealed, "SUCCESS"} {
+		if ss.CanTransitionTo(db.SelfServiceStatusDownloading) {
+			t.Errorf("%q should not be able to move to DOWNLOADING", ss)
+		}
+	}
+
+	// Legacy SUCCESS/FAILURE states are sealed/failed, as the migration maps them
+	if got := db.SelfServiceStatus("SUCCESS").Current(); got != db.SelfServiceStatusSealed {
+		t.Errorf("SUCCESS is %s, want SEALED", got)
+	}
+	if got := db.SelfServiceStatus("FAILURE").Current(); got != db.SelfServiceStatusFailed {
+		t.Errorf("FAILURE is %s, want FAILED", got)
+	}
+}
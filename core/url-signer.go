@@ -0,0 +1,120 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	SIGNED_URL_PROVIDER_PARAM  = "ddm_provider"
+	SIGNED_URL_EXPIRES_PARAM   = "ddm_expires"
+	SIGNED_URL_SIGNATURE_PARAM = "ddm_signature"
+
+	// Identity DDM signs content locations with when it downloads them itself, for e2e deals. Not an actor ID, so it can't clash with a provider
+	SIGNED_URL_DDM_IDENTITY = "ddm"
+)
+
+// Issues and verifies HMAC-signed, time-limited content download URLs that are bound to a provider
+type URLSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// The information carried by a valid signed URL
+type SignedURLClaims struct {
+	Location        string    `json:"location"`
+	ProviderActorID string    `json:"provider_actor_id"`
+	Expires         time.Time `json:"expires"`
+}
+
+func NewURLSigner(key string, ttl time.Duration) *URLSigner {
+	return &URLSigner{key: []byte(key), ttl: ttl}
+}
+
+// Sign a content location for the given provider. The URL will be valid until the signer's TTL elapses
+func (us *URLSigner) Sign(location string, providerActorID string) (string, error) {
+	return us.signAt(location, providerActorID, time.Now().Add(us.ttl))
+}
+
+func (us *URLSigner) signAt(location string, providerActorID string, expires time.Time) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("could not parse content location %s: %s", location, err)
+	}
+
+	q := u.Query()
+	for _, p := range []string{SIGNED_URL_PROVIDER_PARAM, SIGNED_URL_EXPIRES_PARAM, SIGNED_URL_SIGNATURE_PARAM} {
+		if q.Has(p) {
+			return "", fmt.Errorf("content location %s already contains reserved parameter %s", location, p)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	exp := expires.Unix()
+	sig := us.signature(u.String(), providerActorID, exp)
+
+	q.Set(SIGNED_URL_PROVIDER_PARAM, providerActorID)
+	q.Set(SIGNED_URL_EXPIRES_PARAM, strconv.FormatInt(exp, 10))
+	q.Set(SIGNED_URL_SIGNATURE_PARAM, sig)
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Verify a signed URL, returning the claims it carries if the signature is valid and has not expired
+func (us *URLSigner) Verify(signedUrl string) (*SignedURLClaims, error) {
+	return us.verifyAt(signedUrl, time.Now())
+}
+
+func (us *URLSigner) verifyAt(signedUrl string, now time.Time) (*SignedURLClaims, error) {
+	u, err := url.Parse(signedUrl)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse url: %s", err)
+	}
+
+	q := u.Query()
+	provider := q.Get(SIGNED_URL_PROVIDER_PARAM)
+	expires := q.Get(SIGNED_URL_EXPIRES_PARAM)
+	sig := q.Get(SIGNED_URL_SIGNATURE_PARAM)
+
+	if provider == "" || expires == "" || sig == "" {
+		return nil, fmt.Errorf("url is not signed")
+	}
+
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry %s", expires)
+	}
+
+	q.Del(SIGNED_URL_PROVIDER_PARAM)
+	q.Del(SIGNED_URL_EXPIRES_PARAM)
+	q.Del(SIGNED_URL_SIGNATURE_PARAM)
+	u.RawQuery = q.Encode()
+
+	expected := us.signature(u.String(), provider, exp)
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	expiresAt := time.Unix(exp, 0)
+	if now.After(expiresAt) {
+		return nil, fmt.Errorf("url expired at %s", expiresAt.UTC().Format(time.RFC3339))
+	}
+
+	return &SignedURLClaims{
+		Location:        u.String(),
+		ProviderActorID: provider,
+		Expires:         expiresAt,
+	}, nil
+}
+
+func (us *URLSigner) signature(location string, providerActorID string, expires int64) string {
+	mac := hmac.New(sha256.New, us.key)
+	mac.Write([]byte(fmt.Sprintf("%s\n%s\n%d", location, providerActorID, expires)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
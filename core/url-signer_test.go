@@ -0,0 +1,55 @@
+package core
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	signer := NewURLSigner("secret", time.Hour)
+	now := time.Unix(1685000000, 0)
+
+	signed, err := signer.signAt("https://cars.example.com/data/piece.car?bucket=a", "f01000", now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("signAt() error = %s", err)
+	}
+
+	tamper := func(param string, value string) string {
+		u, _ := url.Parse(signed)
+		q := u.Query()
+		q.Set(param, value)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		now  time.Time
+		want bool
+	}{
+		{"valid", signed, now, true},
+		{"expired", signed, now.Add(2 * time.Hour), false},
+		{"other provider", tamper(SIGNED_URL_PROVIDER_PARAM, "f02000"), now, false},
+		{"extended expiry", tamper(SIGNED_URL_EXPIRES_PARAM, "1785000000"), now, false},
+		{"other location", tamper("bucket", "b"), now, false},
+		{"unsigned", "https://cars.example.com/data/piece.car?bucket=a", now, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := signer.verifyAt(tt.url, tt.now)
+			if got := err == nil; got != tt.want {
+				t.Errorf("verifyAt(%s) valid = %v, want %v (err: %v)", tt.url, got, tt.want, err)
+			}
+			if claims != nil && claims.ProviderActorID != "f01000" {
+				t.Errorf("verifyAt(%s) provider = %s, want f01000", tt.url, claims.ProviderActorID)
+			}
+		})
+	}
+
+	if _, err := NewURLSigner("other-secret", time.Hour).verifyAt(signed, now); err == nil {
+		t.Errorf("verifyAt() with a different key should fail")
+	}
+}
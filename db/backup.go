@@ -0,0 +1,328 @@
+package db
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Backups are gzipped tar archives, holding a manifest followed by a file per table with one JSON object (keyed by column name) per row
+// The format version is bumped if the layout of the archive itself changes. Changes to the schema are tracked by the migration ID
+const BACKUP_FORMAT_VERSION = 1
+
+const BACKUP_MANIFEST_NAME = "manifest.json"
+
+const backupBatchSize = 1000
+
+type BackupManifest struct {
+	FormatVersion int           `json:"format_version"`
+	MigrationID   string        `json:"migration_id"` // the latest migration applied to the database the backup was taken from
+	CreatedAt     time.Time     `json:"created_at"`
+	Driver        string        `json:"driver"`
+	Tables        []BackupTable `json:"tables"`
+}
+
+type BackupTable struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	Rows int64  `json:"rows"`
+}
+
+// Write a backup of every table to w
+// All tables are read in one transaction, so the backup is a consistent snapshot even if the daemon is writing to the database
+func WriteBackup(dbi *gorm.DB, w io.Writer) (*BackupManifest, error) {
+	tx := dbi.Begin(&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if tx.Error != nil {
+		return nil, fmt.Errorf("unable to start backup transaction: %s", tx.Error)
+	}
+	defer tx.Rollback()
+
+	version, pending, err := MigrationVersion(tx)
+	if err != nil {
+		return nil, err
+	}
+	if version == "" || len(pending) > 0 {
+		return nil, fmt.Errorf("database has pending migrations, start the daemon against it to apply them before backing it up")
+	}
+
+	manifest := &BackupManifest{
+		FormatVersion: BACKUP_FORMAT_VERSION,
+		MigrationID:   version,
+		CreatedAt:     time.Now().UTC(),
+		Driver:        dbi.Dialector.Name(),
+	}
+
+	tables := []schemaTable{}
+	for _, t := range schemaTables {
+		sch, err := parseSchema(tx, t.model)
+		if err != nil {
+			return nil, err
+		}
+		if !tx.Migrator().HasTable(sch.Table) {
+			continue
+		}
+		tables = append(tables, t)
+
+		bt := BackupTable{Name: sch.Table, File: sch.Table + ".ndjson"}
+		if res := tx.Unscoped().Model(t.model).Count(&bt.Rows); res.Error != nil {
+			return nil, fmt.Errorf("unable to count %s: %s", sch.Table, res.Error)
+		}
+		manifest.Tables = append(manifest.Tables, bt)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	mb, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, BACKUP_MANIFEST_NAME, manifest.CreatedAt, mb); err != nil {
+		return nil, err
+	}
+
+	// Tables are buffered one at a time, as tar entries need their size up front
+	for i, t := range tables {
+		sch, err := parseSchema(tx, t.model)
+		if err != nil {
+			return nil, err
+		}
+
+		// Only columns in the database are backed up, which are fewer than the model's if it has been rolled back to an older schema
+		columnTypes, err := tx.Migrator().ColumnTypes(t.model)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s columns: %s", sch.Table, err)
+		}
+		columns := make(map[string]bool, len(columnTypes))
+		for _, ct := range columnTypes {
+			columns[ct.Name()] = true
+		}
+
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		err = t.scan(tx, sch, nil, backupBatchSize, func(rows []map[string]interface{}) error {
+			for _, row := range rows {
+				for col := range row {
+					if !columns[col] {
+						delete(row, col)
+					}
+				}
+				if err := enc.Encode(row); err != nil {
+					return fmt.Errorf("unable to encode %s row: %s", sch.Table, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := writeTarFile(tw, manifest.Tables[i].File, manifest.CreatedAt, buf.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, modTime time.Time, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime}); err != nil {
+		return fmt.Errorf("unable to write %s to backup: %s", name, err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("unable to write %s to backup: %s", name, err)
+	}
+	return nil
+}
+
+// Read only the manifest of a backup
+func ReadBackupManifest(r io.Reader) (*BackupManifest, error) {
+	_, manifest, err := openBackup(r)
+	return manifest, err
+}
+
+func openBackup(r io.Reader) (*tar.Reader, *BackupManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a ddm backup: %s", err)
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != BACKUP_MANIFEST_NAME {
+		return nil, nil, fmt.Errorf("not a ddm backup: missing %s", BACKUP_MANIFEST_NAME)
+	}
+
+	var manifest BackupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, nil, fmt.Errorf("unable to read backup manifest: %s", err)
+	}
+	if manifest.FormatVersion != BACKUP_FORMAT_VERSION {
+		return nil, nil, fmt.Errorf("unsupported backup format version %d, this version of ddm reads version %d", manifest.FormatVersion, BACKUP_FORMAT_VERSION)
+	}
+
+	return tr, &manifest, nil
+}
+
+// Restore a backup into dbi, which must be migrated to the current schema and have no data in it
+// A backup taken at an older schema version is restored by rolling the (empty) schema back to that version, loading the rows, and applying the migrations since
+// Backups from a newer version of ddm are refused
+func RestoreBackup(dbi *gorm.DB, r io.Reader) (*BackupManifest, error) {
+	tr, manifest, err := openBackup(r)
+	if err != nil {
+		return nil, err
+	}
+
+	known := false
+	for _, m := range Migrations {
+		known = known || m.ID == manifest.MigrationID
+	}
+	if !known {
+		return nil, fmt.Errorf("backup is at schema version %s, which this version of ddm does not know. restore it with the version of ddm that took it, or a newer one", manifest.MigrationID)
+	}
+
+	version, pending, err := MigrationVersion(dbi)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		return nil, fmt.Errorf("database has pending migrations, it must be migrated to schema version %s before restoring", Migrations[len(Migrations)-1].ID)
+	}
+
+	for _, t := range schemaTables {
+		var count int64
+		if res := dbi.Unscoped().Model(t.model).Count(&count); res.Error != nil {
+			return nil, fmt.Errorf("unable to check database is empty: %s", res.Error)
+		}
+		if count > 0 {
+			return nil, fmt.Errorf("database is not empty, backups can only be restored into an empty database")
+		}
+	}
+
+	schemas := map[string]*schema.Schema{}
+	for _, t := range schemaTables {
+		sch, err := parseSchema(dbi, t.model)
+		if err != nil {
+			return nil, err
+		}
+		schemas[sch.Table] = sch
+	}
+
+	// Everything, including rolling back and re-applying migrations, is done in one transaction, so a failed restore leaves the database empty
+	err = dbi.Transaction(func(tx *gorm.DB) error {
+		m := newMigrator(tx)
+		if manifest.MigrationID != version {
+			if err := m.RollbackTo(manifest.MigrationID); err != nil {
+				return fmt.Errorf("unable to roll schema back to backup version %s: %s", manifest.MigrationID, err)
+			}
+		}
+
+		for _, bt := range manifest.Tables {
+			hdr, err := tr.Next()
+			if err != nil {
+				return fmt.Errorf("backup is truncated, missing %s: %s", bt.File, err)
+			}
+			if hdr.Name != bt.File {
+				return fmt.Errorf("backup is corrupt, expected %s but found %s", bt.File, hdr.Name)
+			}
+			sch, ok := schemas[bt.Name]
+			if !ok {
+				return fmt.Errorf("backup has unknown table %s", bt.Name)
+			}
+
+			restored, err := restoreTable(tx, sch, tr)
+			if err != nil {
+				return err
+			}
+			if restored != bt.Rows {
+				return fmt.Errorf("restored %d rows of %s, but the backup manifest lists %d", restored, bt.Name, bt.Rows)
+			}
+		}
+
+		if manifest.MigrationID != version {
+			if err := m.Migrate(); err != nil {
+				return fmt.Errorf("unable to migrate restored data: %s", err)
+			}
+		}
+
+		if tx.Dialector.Name() == "postgres" {
+			return resetSequences(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func restoreTable(tx *gorm.DB, sch *schema.Schema, r io.Reader) (int64, error) {
+	var restored int64
+	dec := json.NewDecoder(r)
+	batch := make([]map[string]interface{}, 0, backupBatchSize)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := insertRows(tx, sch.Table, batch); err != nil {
+			return err
+		}
+		restored += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		var raw map[string]json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("unable to read %s row: %s", sch.Table, err)
+		}
+
+		// Decode each column into its Go type, so times, nulls and custom types are written as the driver expects
+		// Older backups may not have every column, which are left to their defaults
+		row := make(map[string]interface{}, len(raw))
+		for col, val := range raw {
+			field, ok := sch.FieldsByDBName[col]
+			if !ok {
+				return 0, fmt.Errorf("backup has unknown column %s.%s", sch.Table, col)
+			}
+			v := reflect.New(field.FieldType)
+			if err := json.Unmarshal(val, v.Interface()); err != nil {
+				return 0, fmt.Errorf("unable to read %s.%s: %s", sch.Table, col, err)
+			}
+			row[col] = v.Elem().Interface()
+		}
+
+		batch = append(batch, row)
+		if len(batch) == backupBatchSize {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	return restored, nil
+}
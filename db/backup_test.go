@@ -0,0 +1,90 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	gormigrate "github.com/go-gormigrate/gormigrate/v2"
+)
+
+func TestBackupRestore(t *testing.T) {
+	src := openTestDatabase(t, "src.db")
+	created := seedTestDatabase(t, src)
+
+	var buf bytes.Buffer
+	manifest, err := WriteBackup(src, &buf)
+	if err != nil {
+		t.Fatalf("backup failed: %s", err)
+	}
+	if manifest.MigrationID != Migrations[len(Migrations)-1].ID || len(manifest.Tables) != len(schemaTables) {
+		t.Errorf("unexpected manifest: %+v", manifest)
+	}
+	backup := buf.Bytes()
+
+	dst := openTestDatabase(t, "dst.db")
+	if _, err := RestoreBackup(dst, bytes.NewReader(backup)); err != nil {
+		t.Fatalf("restore failed: %s", err)
+	}
+	if _, err := VerifyCopy(src, dst); err != nil {
+		t.Fatalf("restored database differs: %s", err)
+	}
+
+	var rp ReplicationProfile
+	if err := dst.First(&rp).Error; err != nil || rp.Verified != nil {
+		t.Errorf("replication profile not restored as-is: %+v, %v", rp, err)
+	}
+	var ds Dataset
+	if err := dst.First(&ds).Error; err != nil || !ds.CreatedAt.Equal(created) {
+		t.Errorf("dataset not restored as-is: %+v, %v", ds, err)
+	}
+
+	if _, err := RestoreBackup(dst, bytes.NewReader(backup)); err == nil {
+		t.Error("restoring into a database with data in it should fail")
+	}
+}
+
+func TestRestoreOlderBackup(t *testing.T) {
+	src := openTestDatabase(t, "src.db")
+	seedTestDatabase(t, src)
+
+	// Take the backup at the schema version before content import times were tracked
+	if err := gormigrate.New(src, gormigrate.DefaultOptions, Migrations).RollbackTo("2026101908"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := WriteBackup(src, &buf); err == nil {
+		t.Fatal("backing up a database with pending migrations should fail")
+	}
+
+	// Backups are only taken of fully migrated databases, so build one at the old version by hand
+	old := make([]*gormigrate.Migration, 0, len(Migrations))
+	for _, m := range Migrations {
+		old = append(old, m)
+		if m.ID == "2026101908" {
+			break
+		}
+	}
+	saved := Migrations
+	Migrations = old
+	manifest, err := WriteBackup(src, &buf)
+	Migrations = saved
+	if err != nil {
+		t.Fatalf("backup failed: %s", err)
+	}
+	if manifest.MigrationID != "2026101908" {
+		t.Fatalf("backup taken at version %s, want 2026101908", manifest.MigrationID)
+	}
+
+	dst := openTestDatabase(t, "dst.db")
+	if _, err := RestoreBackup(dst, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("restore failed: %s", err)
+	}
+
+	var missing int64
+	if err := dst.Model(&Content{}).Where("imported_at IS NULL").Count(&missing).Error; err != nil || missing != 0 {
+		t.Errorf("migrations were not applied to restored content: %d without imported_at, %v", missing, err)
+	}
+	if version, pending, _ := MigrationVersion(dst); version != saved[len(saved)-1].ID || len(pending) != 0 {
+		t.Errorf("restored database at version %s with pending %v", version, pending)
+	}
+}
@@ -0,0 +1,258 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const DEFAULT_COPY_BATCH_SIZE = 1000
+
+// Progress of copying one table, reported after each batch
+type TableCopyProgress struct {
+	Table  string `json:"table"`
+	Source int64  `json:"source"` // rows in the source table
+	Copied int64  `json:"copied"` // rows copied so far in this run
+	// Set if the destination already had every row, from an earlier run
+	Skipped bool `json:"skipped"`
+}
+
+type CopyOptions struct {
+	BatchSize int
+	Progress  func(TableCopyProgress) // optional
+}
+
+// Page through a table, in primary key order, handing each batch of rows to fn as column values
+// For tables with a single primary key, only rows with a key greater than after (if set) are read
+type tableScanner func(dbi *gorm.DB, sch *schema.Schema, after interface{}, batchSize int, fn func(rows []map[string]interface{}) error) error
+
+type schemaTable struct {
+	model interface{}
+	scan  tableScanner
+}
+
+// Every table in the schema, in an order that satisfies foreign keys
+var schemaTables = []schemaTable{
+	{&DeltaNode{}, scanTable[DeltaNode]},
+	{&Provider{}, scanTable[Provider]},
+	{&Dataset{}, scanTable[Dataset]},
+	{&Content{}, scanTable[Content]},
+	{&Wallet{}, scanTable[Wallet]},
+	{&WalletDatasets{}, scanTable[WalletDatasets]},
+	{&ReplicationProfile{}, scanTable[ReplicationProfile]},
+	{&Replication{}, scanTable[Replication]},
+	{&Reservation{}, scanTable[Reservation]},
+	{&SelfServiceEvent{}, scanTable[SelfServiceEvent]},
+	{&StatsSnapshot{}, scanTable[StatsSnapshot]},
+}
+
+// Copy every row of every table from src to dst, keeping primary keys and timestamps as they are
+// dst must already have the schema, at the same migration version as src
+// Rows already in dst are left alone, so an interrupted copy can be run again to finish it
+func CopyData(src *gorm.DB, dst *gorm.DB, opts CopyOptions) error {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DEFAULT_COPY_BATCH_SIZE
+	}
+
+	for _, t := range schemaTables {
+		if err := copyTable(src, dst, t, opts); err != nil {
+			return err
+		}
+	}
+
+	if dst.Dialector.Name() == "postgres" {
+		if err := resetSequences(dst); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Row counts of a table in the source and destination databases
+type TableCount struct {
+	Table       string `json:"table"`
+	Source      int64  `json:"source"`
+	Destination int64  `json:"destination"`
+}
+
+// Count the rows of every table in src and dst, including soft-deleted rows
+// Returns the counts of all tables, and an error if any of them differ
+func VerifyCopy(src *gorm.DB, dst *gorm.DB) ([]TableCount, error) {
+	counts := []TableCount{}
+	mismatched := []string{}
+
+	for _, t := range schemaTables {
+		table, err := tableName(src, t.model)
+		if err != nil {
+			return nil, err
+		}
+
+		tc := TableCount{Table: table}
+		if res := src.Unscoped().Model(t.model).Count(&tc.Source); res.Error != nil {
+			return nil, fmt.Errorf("unable to count source %s: %s", table, res.Error)
+		}
+		if res := dst.Unscoped().Model(t.model).Count(&tc.Destination); res.Error != nil {
+			return nil, fmt.Errorf("unable to count destination %s: %s", table, res.Error)
+		}
+
+		counts = append(counts, tc)
+		if tc.Source != tc.Destination {
+			mismatched = append(mismatched, fmt.Sprintf("%s (%d in source, %d in destination)", table, tc.Source, tc.Destination))
+		}
+	}
+
+	if len(mismatched) > 0 {
+		return counts, fmt.Errorf("row counts differ for %v", mismatched)
+	}
+
+	return counts, nil
+}
+
+func copyTable(src *gorm.DB, dst *gorm.DB, t schemaTable, opts CopyOptions) error {
+	sch, err := parseSchema(src, t.model)
+	if err != nil {
+		return err
+	}
+	progress := TableCopyProgress{Table: sch.Table}
+	report := func() {
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+
+	var existing int64
+	if res := src.Unscoped().Model(t.model).Count(&progress.Source); res.Error != nil {
+		return fmt.Errorf("unable to count source %s: %s", sch.Table, res.Error)
+	}
+	if res := dst.Unscoped().Model(t.model).Count(&existing); res.Error != nil {
+		return fmt.Errorf("unable to count destination %s: %s", sch.Table, res.Error)
+	}
+	if existing == progress.Source {
+		progress.Skipped = true
+		report()
+		return nil
+	}
+
+	// Batches are copied in key order, so for an auto-incremented ID every row up to the highest ID copied is already there
+	var after interface{}
+	if len(sch.PrimaryFields) == 1 && sch.PrimaryFields[0].AutoIncrement && existing > 0 {
+		var maxID uint64
+		if res := dst.Unscoped().Model(t.model).Select("MAX(" + sch.PrimaryFields[0].DBName + ")").Scan(&maxID); res.Error != nil {
+			return fmt.Errorf("unable to find resume point for %s: %s", sch.Table, res.Error)
+		}
+		after = maxID
+	}
+
+	return t.scan(src, sch, after, opts.BatchSize, func(rows []map[string]interface{}) error {
+		if err := insertRows(dst, sch.Table, rows); err != nil {
+			return err
+		}
+		progress.Copied += int64(len(rows))
+		report()
+		return nil
+	})
+}
+
+func scanTable[T any](dbi *gorm.DB, sch *schema.Schema, after interface{}, batchSize int, fn func(rows []map[string]interface{}) error) error {
+	order := make([]clause.OrderByColumn, 0, len(sch.PrimaryFields))
+	for _, f := range sch.PrimaryFields {
+		order = append(order, clause.OrderByColumn{Column: clause.Column{Name: f.DBName}})
+	}
+
+	// Tables with a single primary key are paged through by key, others (small join tables) by offset
+	var pk *schema.Field
+	if len(sch.PrimaryFields) == 1 {
+		pk = sch.PrimaryFields[0]
+	}
+
+	for offset := 0; ; offset += batchSize {
+		tx := dbi.Unscoped().Table(sch.Table).Order(clause.OrderBy{Columns: order}).Limit(batchSize)
+		if pk != nil && after != nil {
+			tx = tx.Where(clause.Gt{Column: clause.Column{Name: pk.DBName}, Value: after})
+		} else if pk == nil {
+			tx = tx.Offset(offset)
+		}
+
+		var batch []T
+		if res := tx.Find(&batch); res.Error != nil {
+			return fmt.Errorf("unable to read %s: %s", sch.Table, res.Error)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		rows := make([]map[string]interface{}, len(batch))
+		for i := range batch {
+			rv := reflect.ValueOf(&batch[i]).Elem()
+			rows[i] = make(map[string]interface{}, len(sch.DBNames))
+			for _, name := range sch.DBNames {
+				rows[i][name], _ = sch.FieldsByDBName[name].ValueOf(dbi.Statement.Context, rv)
+			}
+		}
+
+		if err := fn(rows); err != nil {
+			return err
+		}
+
+		if pk != nil {
+			after = rows[len(rows)-1][pk.DBName]
+		}
+		if len(batch) < batchSize {
+			return nil
+		}
+	}
+}
+
+// Insert rows given as column values, leaving any that already exist alone
+// Rows are written as column maps rather than structs, as gorm replaces zero values with column defaults when creating structs
+func insertRows(dbi *gorm.DB, table string, rows []map[string]interface{}) error {
+	res := dbi.Session(&gorm.Session{SkipHooks: true}).
+		Table(table).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&rows)
+	if res.Error != nil {
+		return fmt.Errorf("unable to write %s: %s", table, res.Error)
+	}
+	return nil
+}
+
+// Copied rows keep their IDs, so Postgres sequences must be moved past them or new rows would collide
+func resetSequences(dst *gorm.DB) error {
+	for _, t := range schemaTables {
+		sch, err := parseSchema(dst, t.model)
+		if err != nil {
+			return err
+		}
+		if len(sch.PrimaryFields) != 1 || !sch.PrimaryFields[0].AutoIncrement {
+			continue
+		}
+
+		col := sch.PrimaryFields[0].DBName
+		res := dst.Exec(fmt.Sprintf(`SELECT setval(pg_get_serial_sequence('%s', '%s'), COALESCE(MAX(%s), 0) + 1, false) FROM %s`, sch.Table, col, col, sch.Table))
+		if res.Error != nil {
+			return fmt.Errorf("unable to reset %s sequence: %s", sch.Table, res.Error)
+		}
+	}
+
+	return nil
+}
+
+func parseSchema(dbi *gorm.DB, model interface{}) (*schema.Schema, error) {
+	stmt := &gorm.Statement{DB: dbi}
+	if err := stmt.Parse(model); err != nil {
+		return nil, fmt.Errorf("unable to parse schema: %s", err)
+	}
+	return stmt.Schema, nil
+}
+
+func tableName(dbi *gorm.DB, model interface{}) (string, error) {
+	sch, err := parseSchema(dbi, model)
+	if err != nil {
+		return "", err
+	}
+	return sch.Table, nil
+}
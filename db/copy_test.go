@@ -0,0 +1,106 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func openTestDatabase(t *testing.T, name string) *gorm.DB {
+	dbi, err := OpenDatabase(filepath.Join(t.TempDir(), name), PoolOptions{}, false)
+	if err != nil {
+		t.Fatalf("unable to open %s: %s", name, err)
+	}
+	return dbi
+}
+
+// Seed a database with rows in every table, returning the creation time given to the dataset
+// The replication profile's verified flag is nil, and one replication is soft-deleted
+func seedTestDatabase(t *testing.T, src *gorm.DB) time.Time {
+	created := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	ds := Dataset{Name: "ds", ReplicationQuota: 2}
+	ds.CreatedAt = created
+	seed := []interface{}{
+		&Provider{ActorID: "f01000"},
+		&ds,
+		&Content{CommP: "baga1", DatasetID: 1, ImportedAt: created},
+		&Content{CommP: "baga2", DatasetID: 1, ImportedAt: created},
+		&Wallet{Addr: "f1wallet"},
+		&WalletDatasets{WalletAddr: "f1wallet", DatasetID: 1},
+		&ReplicationProfile{ProviderActorID: "f01000", DatasetID: 1},
+	}
+	for _, m := range seed {
+		if err := src.Create(m).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Verified defaults to true, so it is only nil if set so explicitly
+	if err := src.Model(&ReplicationProfile{}).Where("provider_actor_id = ?", "f01000").Update("verified", nil).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for i, commp := range []string{"baga1", "baga2", "baga1"} {
+		r := Replication{ContentCommP: commp, ProviderActorID: "f01000", DeltaContentID: int64(i + 1), ProposalCid: commp + string(rune('a'+i)), Status: "active"}
+		if err := src.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.Delete(&Replication{}, 2).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := StatsSnapshot{EntityType: StatsEntityDataset, EntityID: "ds", TakenAt: created}
+	if err := src.Create(&snapshot).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return created
+}
+
+func TestCopyData(t *testing.T) {
+	src := openTestDatabase(t, "src.db")
+	dst := openTestDatabase(t, "dst.db")
+
+	created := seedTestDatabase(t, src)
+
+	if err := CopyData(src, dst, CopyOptions{BatchSize: 2}); err != nil {
+		t.Fatalf("copy failed: %s", err)
+	}
+	if _, err := VerifyCopy(src, dst); err != nil {
+		t.Fatalf("verify failed: %s", err)
+	}
+
+	var gotDs Dataset
+	if err := dst.Preload("Wallets").First(&gotDs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !gotDs.CreatedAt.Equal(created) || len(gotDs.Wallets) != 1 {
+		t.Errorf("dataset not copied as-is: %+v", gotDs)
+	}
+
+	var rp ReplicationProfile
+	if err := dst.First(&rp).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rp.Verified != nil {
+		t.Errorf("replication profile verified = %v, want nil", *rp.Verified)
+	}
+
+	var deleted Replication
+	if err := dst.Unscoped().First(&deleted, 2).Error; err != nil || !deleted.DeletedAt.Valid {
+		t.Errorf("soft-deleted replication not copied: %+v, %v", deleted, err)
+	}
+
+	// An interrupted copy is finished by running it again
+	if err := dst.Unscoped().Where("id > ?", 1).Delete(&Replication{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyData(src, dst, CopyOptions{BatchSize: 2}); err != nil {
+		t.Fatalf("resumed copy failed: %s", err)
+	}
+	if _, err := VerifyCopy(src, dst); err != nil {
+		t.Fatalf("verify after resume failed: %s", err)
+	}
+}
@@ -1,6 +1,10 @@
 package db
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	gormigrate "github.com/go-gormigrate/gormigrate/v2"
 	"gorm.io/gorm"
 )
@@ -8,10 +12,10 @@ import (
 // If this runs, it means the database is empty. No migrations will be applied on top of it, as this sets up the database from scratch so it starts out "up to date"
 func BaselineSchema(tx *gorm.DB) error {
 	log.Debugf("first run: initializing database schema")
-	err := tx.AutoMigrate(&Provider{}, &Dataset{}, &Content{}, &Wallet{}, &ReplicationProfile{}, &WalletDatasets{}, &Replication{})
+	err := tx.AutoMigrate(&Provider{}, &Dataset{}, &Content{}, &Wallet{}, &ReplicationProfile{}, &WalletDatasets{}, &Replication{}, &Reservation{}, &SelfServiceEvent{}, &StatsSnapshot{}, &DeltaNode{})
 
 	if err != nil {
-		log.Fatalf("error initializing database: %s", err)
+		return fmt.Errorf("error initializing database: %s", err)
 	}
 	return nil
 }
@@ -23,7 +27,262 @@ var Migrations []*gormigrate.Migration = []*gormigrate.Migration{
 			return tx.Migrator().AddColumn(&Content{}, "ContentLocation")
 		},
 		Rollback: func(tx *gorm.DB) error {
-			return tx.Migrator().DropColumn(&Content{}, "ContentLocation")
+			return dropColumn(tx, &Content{}, "ContentLocation")
+		},
+	},
+	{
+		ID: "2026101900",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&Replication{}, "BytesTransferred")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumn(tx, &Replication{}, "BytesTransferred")
+		},
+	},
+	{
+		ID: "2026101901",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&Reservation{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&Reservation{})
+		},
+	},
+	{
+		ID: "2026101902",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&SelfServiceEvent{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&SelfServiceEvent{})
+		},
+	},
+	{
+		ID: "2026101903",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&Replication{}, "OnChainAt")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumn(tx, &Replication{}, "OnChainAt")
+		},
+	},
+	{
+		ID: "2026101904",
+		Migrate: func(tx *gorm.DB) error {
+			for _, col := range []string{"Verified", "PricePerGiBEpoch"} {
+				if err := tx.Migrator().AddColumn(&ReplicationProfile{}, col); err != nil {
+					return err
+				}
+			}
+			for _, col := range []string{"WalletAddr", "DealCost"} {
+				if err := tx.Migrator().AddColumn(&Replication{}, col); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().AddColumn(&Dataset{}, "Budget")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			for _, col := range []string{"Verified", "PricePerGiBEpoch"} {
+				if err := dropColumn(tx, &ReplicationProfile{}, col); err != nil {
+					return err
+				}
+			}
+			for _, col := range []string{"WalletAddr", "DealCost"} {
+				if err := dropColumn(tx, &Replication{}, col); err != nil {
+					return err
+				}
+			}
+			return dropColumn(tx, &Dataset{}, "Budget")
+		},
+	},
+	{
+		ID: "2026101905",
+		Migrate: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&Dataset{}, "ConnectionMode"); err != nil {
+				return err
+			}
+			return tx.Migrator().AddColumn(&ReplicationProfile{}, "ConnectionMode")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := dropColumn(tx, &Dataset{}, "ConnectionMode"); err != nil {
+				return err
+			}
+			return dropColumn(tx, &ReplicationProfile{}, "ConnectionMode")
+		},
+	},
+	{
+		ID: "2026101906",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&Provider{}, "Region")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumn(tx, &Provider{}, "Region")
+		},
+	},
+	{
+		ID: "2026101907",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&StatsSnapshot{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&StatsSnapshot{})
+		},
+	},
+	{
+		ID: "2026101908",
+		Migrate: func(tx *gorm.DB) error {
+			for _, idx := range replicationIndexes {
+				if err := tx.Migrator().CreateIndex(&Replication{}, idx); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateIndex(&Content{}, "idx_contents_dataset")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			for _, idx := range replicationIndexes {
+				if err := tx.Migrator().DropIndex(&Replication{}, idx); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropIndex(&Content{}, "idx_contents_dataset")
+		},
+	},
+	{
+		ID: "2026101909",
+		Migrate: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&Content{}, "ImportedAt"); err != nil {
+				return err
+			}
+			// When content was imported before this was tracked is unknown, so treat it all as imported now
+			return tx.Model(&Content{}).Where("imported_at IS NULL").Update("imported_at", time.Now()).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumn(tx, &Content{}, "ImportedAt")
+		},
+	},
+	{
+		ID: "2026101910",
+		Migrate: func(tx *gorm.DB) error {
+			if err := tx.Migrator().CreateTable(&DeltaNode{}); err != nil {
+				return err
+			}
+			for _, model := range deltaNodeModels {
+				if err := tx.Migrator().AddColumn(model, "DeltaNodeID"); err != nil {
+					return err
+				}
+			}
+
+			// Delta content IDs are now only unique within a node, so the unique constraint on them is replaced with one on (node, content ID)
+			var err error
+			if tx.Dialector.Name() == "sqlite" {
+				err = keepIndexes(tx, &Replication{}, "", func() error {
+					return tx.Migrator().AlterColumn(&Replication{}, "DeltaContentID")
+				})
+			} else {
+				err = tx.Exec("ALTER TABLE replications DROP CONSTRAINT IF EXISTS replications_delta_content_id_key").Error
+			}
+			if err != nil {
+				return err
+			}
+			if err := tx.Exec("DROP INDEX IF EXISTS idx_replications_delta_content_id").Error; err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&Replication{}, "idx_replications_node_content")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex(&Replication{}, "idx_replications_node_content"); err != nil {
+				return err
+			}
+			for _, model := range deltaNodeModels {
+				if err := dropColumn(tx, model, "DeltaNodeID"); err != nil {
+					return err
+				}
+			}
+			if err := tx.Exec("CREATE UNIQUE INDEX idx_replications_delta_content_id ON replications(delta_content_id)").Error; err != nil {
+				return fmt.Errorf("unable to make delta content IDs unique again, deals from different nodes may share them: %s", err)
+			}
+			return tx.Migrator().DropTable(&DeltaNode{})
+		},
+	},
+	{
+		ID: "2026101911",
+		Migrate: func(tx *gorm.DB) error {
+			// Self-service states used to be SUCCESS/FAILURE, or whatever providers reported. Map them onto the state machine, so deals in flight can move on
+			setState := func(state SelfServiceStatus, query string, args ...interface{}) error {
+				return tx.Model(&Replication{}).Where(query, args...).Update("ss_status", state).Error
+			}
+			if err := setState(SelfServiceStatusSealed, "ss_status = ?", "SUCCESS"); err != nil {
+				return err
+			}
+			if err := setState(SelfServiceStatusFailed, "ss_status = ?", "FAILURE"); err != nil {
+				return err
+			}
+
+			var known []SelfServiceStatus
+			for ss := range selfServiceTransitions {
+				known = append(known, ss)
+			}
+			return setState(SelfServiceStatusPending, "ss_status IS NULL OR ss_status NOT IN ?", known)
+		},
+		Rollback: func(tx *gorm.DB) error {
+			// The original states are not kept, so there is nothing to undo
+			return nil
 		},
 	},
 }
+
+// Indexes for selecting unreplicated content, reconciling pending deals with Delta and computing provider reputations
+var replicationIndexes = []string{"idx_replications_content_provider", "idx_replications_on_chain_status", "idx_replications_provider_deal_time"}
+
+// Tables that record or pin the Delta node deals are made through
+var deltaNodeModels = []interface{}{&Replication{}, &Dataset{}, &Provider{}}
+
+// Drop a column, keeping the table's indexes
+// SQLite drops a column by rebuilding its table, which also drops the table's indexes, so any that don't cover the dropped column are recreated
+func dropColumn(tx *gorm.DB, model interface{}, field string) error {
+	if tx.Dialector.Name() != "sqlite" {
+		return tx.Migrator().DropColumn(model, field)
+	}
+
+	column := field
+	if sch, err := parseSchema(tx, model); err != nil {
+		return err
+	} else if f := sch.LookUpField(field); f != nil {
+		column = f.DBName
+	}
+
+	return keepIndexes(tx, model, column, func() error {
+		return tx.Migrator().DropColumn(model, field)
+	})
+}
+
+// Run a change that rebuilds a SQLite table, recreating the table's indexes afterwards, except any on skipColumn
+func keepIndexes(tx *gorm.DB, model interface{}, skipColumn string, rebuild func() error) error {
+	sch, err := parseSchema(tx, model)
+	if err != nil {
+		return err
+	}
+
+	var indexes []struct {
+		Name string
+		Sql  string
+	}
+	if res := tx.Raw("SELECT name, sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", sch.Table).Scan(&indexes); res.Error != nil {
+		return res.Error
+	}
+
+	if err := rebuild(); err != nil {
+		return err
+	}
+
+	for _, idx := range indexes {
+		if (skipColumn != "" && strings.Contains(idx.Sql, "`"+skipColumn+"`")) || tx.Migrator().HasIndex(model, idx.Name) {
+			continue
+		}
+		if err := tx.Exec(idx.Sql).Error; err != nil {
+			return fmt.Errorf("unable to recreate index %s: %s", idx.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	sm "github.com/filecoin-project/go-fil-markets/storagemarket"
@@ -12,6 +14,15 @@ type DealStatus string
 
 const DDM_StorageDealStatusPending DealStatus = "ddm-pending"
 
+// Set on e2e deals until DDM has pushed their data to Delta, which it does in the background
+const DDM_StorageDealStatusQueued DealStatus = "ddm-queued"
+
+// Set on e2e deals whose data DDM could not push to Delta
+const DDM_StorageDealStatusTransferFailed DealStatus = "ddm-transfer-failed"
+
+// Set when a replication is cancelled in DDM before its deal lands on chain
+const DDM_StorageDealStatusCancelled DealStatus = "ddm-cancelled"
+
 // List of statuses that indicate a deal has failed
 var FailedStatuses = []DealStatus{
 	DealStatus(sm.DealStates[sm.StorageDealProposalRejected]),
@@ -19,10 +30,32 @@ var FailedStatuses = []DealStatus{
 	// These events come from Delta, if the deal never makes it to the chain
 	DealStatus("transfer-failed"),
 	DealStatus("deal-proposal-failed"),
+	DDM_StorageDealStatusTransferFailed,
+}
+
+// List of statuses of replications that were ended in DDM. These are not failures of the provider
+var CancelledStatuses = []DealStatus{
+	DDM_StorageDealStatusCancelled,
 }
 
+// List of statuses of replications that will not land on chain, because they failed or were cancelled
+// They don't count against replication quotas, and are not reconciled with Delta
+var InactiveStatuses = append(append([]DealStatus{}, FailedStatuses...), CancelledStatuses...)
+
 func (ds DealStatus) HasFailed() bool {
-	for _, state := range FailedStatuses {
+	return ds.in(FailedStatuses)
+}
+
+func (ds DealStatus) IsCancelled() bool {
+	return ds.in(CancelledStatuses)
+}
+
+func (ds DealStatus) IsInactive() bool {
+	return ds.in(InactiveStatuses)
+}
+
+func (ds DealStatus) in(statuses []DealStatus) bool {
+	for _, state := range statuses {
 		if state == ds {
 			return true
 		}
@@ -30,53 +63,243 @@ func (ds DealStatus) HasFailed() bool {
 	return false
 }
 
-// This is separate from the `DealStatus` enum to accomodate more granular statuses in the future (ex, SealingInProgress)
+// Provider-side progress of a self-service deal, as reported by the provider through telemetry
+// This is separate from the `DealStatus` enum, which tracks the deal itself as reported by Delta
 type SelfServiceStatus string
 
 const (
-	SelfServiceStatusPending SelfServiceStatus = "PENDING"
-	SelfServiceStatusSuccess SelfServiceStatus = "SUCCESS"
-	SelfServiceStatusFailure SelfServiceStatus = "FAILURE"
+	SelfServiceStatusPending     SelfServiceStatus = "PENDING"
+	SelfServiceStatusDownloading SelfServiceStatus = "DOWNLOADING"
+	SelfServiceStatusDownloaded  SelfServiceStatus = "DOWNLOADED"
+	SelfServiceStatusImporting   SelfServiceStatus = "IMPORTING"
+	SelfServiceStatusSealing     SelfServiceStatus = "SEALING"
+	SelfServiceStatusSealed      SelfServiceStatus = "SEALED"
+	SelfServiceStatusFailed      SelfServiceStatus = "FAILED"
+)
+
+// The states a self-service deal may move to from each state. A failed deal may be retried
+var selfServiceTransitions = map[SelfServiceStatus][]SelfServiceStatus{
+	SelfServiceStatusPending:     {SelfServiceStatusDownloading, SelfServiceStatusDownloaded, SelfServiceStatusImporting, SelfServiceStatusFailed},
+	SelfServiceStatusDownloading: {SelfServiceStatusDownloaded, SelfServiceStatusFailed},
+	SelfServiceStatusDownloaded:  {SelfServiceStatusImporting, SelfServiceStatusFailed},
+	SelfServiceStatusImporting:   {SelfServiceStatusSealing, SelfServiceStatusFailed},
+	SelfServiceStatusSealing:     {SelfServiceStatusSealed, SelfServiceStatusFailed},
+	SelfServiceStatusSealed:      {},
+	SelfServiceStatusFailed:      {SelfServiceStatusDownloading, SelfServiceStatusImporting},
+}
+
+// Parse a self-service status, case-insensitively
+func ParseSelfServiceStatus(s string) (SelfServiceStatus, error) {
+	ss := SelfServiceStatus(strings.ToUpper(s))
+	if _, ok := selfServiceTransitions[ss]; !ok {
+		return "", fmt.Errorf("invalid state '%s'", s)
+	}
+	return ss, nil
+}
+
+// States from before states were validated, and the state each maps to, as in migration 2026101911
+var legacySelfServiceStatuses = map[SelfServiceStatus]SelfServiceStatus{
+	"SUCCESS": SelfServiceStatusSealed,
+	"FAILURE": SelfServiceStatusFailed,
+}
+
+// The state a self-service deal is in. Legacy SUCCESS/FAILURE states are sealed/failed. Replications that have not reported any state yet,
+// or have another state from before states were validated, are pending
+func (ss SelfServiceStatus) Current() SelfServiceStatus {
+	if legacy, ok := legacySelfServiceStatuses[ss]; ok {
+		return legacy
+	}
+	if _, ok := selfServiceTransitions[ss]; !ok {
+		return SelfServiceStatusPending
+	}
+	return ss
+}
+
+// Check whether a self-service deal may move from this state to the next
+func (ss SelfServiceStatus) CanTransitionTo(next SelfServiceStatus) bool {
+	for _, allowed := range selfServiceTransitions[ss.Current()] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// How the data for a deal gets to the provider
+type ConnectionMode string
+
+const (
+	// Offline deal - the provider downloads the data and imports it
+	ConnectionModeImport ConnectionMode = "import"
+	// Online deal - Delta pushes the data to the provider
+	ConnectionModeE2E ConnectionMode = "e2e"
 )
 
+// Parse a connection mode. An empty string is allowed, and means the mode is inherited (ex, from the dataset)
+func ParseConnectionMode(s string) (ConnectionMode, error) {
+	cm := ConnectionMode(strings.ToLower(s))
+	switch cm {
+	case "", ConnectionModeImport, ConnectionModeE2E:
+		return cm, nil
+	default:
+		return "", fmt.Errorf("invalid connection mode '%s', must be one of import, e2e", s)
+	}
+}
+
+// The connection mode to make deals for a dataset with, to a provider with the given replication profile
+func ResolveConnectionMode(ds Dataset, rp ReplicationProfile) ConnectionMode {
+	if rp.ConnectionMode != "" {
+		return rp.ConnectionMode
+	}
+	if ds.ConnectionMode != "" {
+		return ds.ConnectionMode
+	}
+	return ConnectionModeImport
+}
+
 // A replication refers to a deal, for a specific content, with a client
 type Replication struct {
 	gorm.Model
-	Content         Content    `json:"content"`
-	DealTime        time.Time  `json:"deal_time"`
-	DeltaContentID  int64      `json:"delta_content_id" gorm:"unique"`
-	DealUUID        string     `json:"deal_uuid"`
-	OnChainDealID   uint       `json:"on_chain_deal_id"`
-	ProposalCid     string     `json:"proposal_cid" gorm:"unique"`
-	ProviderActorID string     `json:"provider_actor_id"`
-	ContentCommP    string     `json:"content_commp"`
-	Status          DealStatus `json:"status" gorm:"notnull,default:'PENDING'"`
-	DeltaMessage    string     `json:"delta_message,omitempty"`
-	SelfService     struct {
-		IsSelfService bool      `json:"is_self_service"`
-		LastUpdate    time.Time `json:"last_update"`
-		Status        string    `json:"status" gorm:"notnull,default:'PENDING'"`
-		Message       string    `json:"message"`
+	Content          Content    `json:"content"`
+	DealTime         time.Time  `json:"deal_time" gorm:"index:idx_replications_provider_deal_time,priority:2"`
+	DeltaContentID   int64      `json:"delta_content_id" gorm:"uniqueIndex:idx_replications_node_content,priority:2"`                 // only unique within a Delta node
+	DeltaNodeID      uint       `json:"delta_node_id" gorm:"not null;default:0;uniqueIndex:idx_replications_node_content,priority:1"` // the node that made the deal. 0 is the daemon's own Delta node
+	DealUUID         string     `json:"deal_uuid"`
+	OnChainDealID    uint       `json:"on_chain_deal_id" gorm:"index:idx_replications_on_chain_status,priority:1"`
+	OnChainAt        *time.Time `json:"on_chain_at,omitempty"`
+	ProposalCid      string     `json:"proposal_cid" gorm:"unique"`
+	ProviderActorID  string     `json:"provider_actor_id" gorm:"index:idx_replications_content_provider,priority:2;index:idx_replications_provider_deal_time,priority:1"`
+	ContentCommP     string     `json:"content_commp" gorm:"index:idx_replications_content_provider,priority:1"`
+	Status           DealStatus `json:"status" gorm:"notnull,default:'PENDING';index:idx_replications_on_chain_status,priority:2"`
+	DeltaMessage     string     `json:"delta_message,omitempty"`
+	BytesTransferred uint64     `json:"bytes_transferred" gorm:"not null;default:0"`
+	WalletAddr       string     `json:"wallet_addr,omitempty"`
+	DealCost         string     `json:"deal_cost,omitempty"` // total price of the deal, in attoFIL. Empty for free deals
+	SelfService      struct {
+		IsSelfService bool              `json:"is_self_service"`
+		LastUpdate    time.Time         `json:"last_update"`
+		Status        SelfServiceStatus `json:"status" gorm:"notnull,default:'PENDING'"`
+		Message       string            `json:"message"`
 	} `json:"self_service" gorm:"embedded;embeddedPrefix:ss_"`
 }
 
+// The Delta node configured on the daemon (`--delta-api`) has ID 0, and is not stored. Others are registered through the API
+const DEFAULT_DELTA_NODE_ID = 0
+
+// A Delta node that deals may be made through, in addition to the daemon's own
+// Removed nodes are soft-deleted, so their IDs are never reused by a new node and their replications keep referring to them
+type DeltaNode struct {
+	ID        uint           `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time      `json:"created_at"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+	Name      string         `json:"name" gorm:"not null"`
+	URL       string         `json:"url" gorm:"not null"`
+	AuthToken string         `json:"-"` // service token used for all requests to the node
+}
+
+// A change in state of a self-service replication, as reported by the provider
+type SelfServiceEvent struct {
+	ID              uint              `json:"id" gorm:"primarykey"`
+	ReplicationID   uint              `json:"replication_id" gorm:"index"`
+	ProviderActorID string            `json:"provider_actor_id" gorm:"index"`
+	FromState       SelfServiceStatus `json:"from_state"`
+	State           SelfServiceStatus `json:"state"`
+	Message         string            `json:"message"`
+	Timestamp       time.Time         `json:"timestamp"`
+}
+
+// A reservation holds a content for a provider until it expires, counting against the content's replication quota
+type Reservation struct {
+	gorm.Model
+	ProviderActorID string    `json:"provider_actor_id" gorm:"index"`
+	ContentCommP    string    `json:"content_commp" gorm:"index"`
+	Content         *Content  `json:"content,omitempty"`
+	ExpiresAt       time.Time `json:"expires_at" gorm:"index"`
+}
+
+type StatsEntityType string
+
+const (
+	StatsEntityDataset  StatsEntityType = "dataset"
+	StatsEntityProvider StatsEntityType = "provider"
+)
+
+// Replication totals for a dataset or provider at a point in time, taken periodically so growth can be charted without recomputing history
+// Replicated deals are on chain, pending deals have been made but are not on chain yet. Bytes are padded sizes
+type StatsSnapshot struct {
+	ID         uint            `json:"-" gorm:"primarykey"`
+	EntityType StatsEntityType `json:"entity_type" gorm:"index:idx_stats_entity_time,priority:1"`
+	EntityID   string          `json:"entity_id" gorm:"index:idx_stats_entity_time,priority:2"` // dataset name or provider actor ID
+	TakenAt    time.Time       `json:"taken_at" gorm:"index:idx_stats_entity_time,priority:3"`
+	StatsTotals
+}
+
+type StatsTotals struct {
+	CountReplicated uint64 `json:"count_replicated"`
+	BytesReplicated uint64 `json:"bytes_replicated"`
+	CountPending    uint64 `json:"count_pending"`
+	BytesPending    uint64 `json:"bytes_pending"`
+	CountFailed     uint64 `json:"count_failed"`
+	BytesFailed     uint64 `json:"bytes_failed"`
+	// Cancelled in DDM before landing on chain. Not counted as failed
+	CountCancelled uint64 `json:"count_cancelled"`
+	BytesCancelled uint64 `json:"bytes_cancelled"`
+}
+
 // A client is a Storage Provider that is being replicated to
 type Provider struct {
 	Key                 uuid.UUID            `json:"key,omitempty" gorm:"type:uuid"`
 	ActorID             string               `json:"actor_id" gorm:"primaryKey"`
 	ActorName           string               `json:"actor_name,omitempty"`
+	Region              string               `json:"region,omitempty"`
 	AllowSelfService    bool                 `json:"allow_self_service,omitempty" gorm:"notnull,default:true"`
+	DeltaNodeID         *uint                `json:"delta_node_id,omitempty"` // if set, all deals with the provider are made through this Delta node
 	BytesReplicated     ByteSizes            `json:"bytes_replicated,omitempty" gorm:"-"`
 	CountReplicated     uint64               `json:"count_replicated,omitempty" gorm:"-"`
+	Reputation          *ProviderReputation  `json:"reputation,omitempty" gorm:"-"`
 	Replications        []Replication        `json:"replications,omitempty" gorm:"foreignKey:ProviderActorID"`
 	ReplicationProfiles []ReplicationProfile `json:"replication_profiles" gorm:"foreignKey:ProviderActorID"`
 }
 
+// A provider's track record, computed from the outcomes of its deals over rolling windows
+type ProviderReputation struct {
+	// 0 to 100, computed from the scoring window. Nil if the provider has too few finished deals in it to be scored
+	Score   *float64           `json:"score"`
+	Windows []ReputationWindow `json:"windows"`
+}
+
+type ReputationWindow struct {
+	Days uint `json:"days"`
+	// Deals made in the window
+	Deals    uint64 `json:"deals"`
+	OnChain  uint64 `json:"on_chain"`
+	Failed   uint64 `json:"failed"`
+	InFlight uint64 `json:"in_flight"`
+	// Cancelled in DDM, so not held against the provider
+	Cancelled uint64 `json:"cancelled"`
+	// On chain / (on chain + failed). Deals still in flight or cancelled are not counted
+	SuccessRate                float64               `json:"success_rate"`
+	MedianTimeToOnChainSeconds uint64                `json:"median_time_to_on_chain_seconds"`
+	FailureCategories          map[DealStatus]uint64 `json:"failure_categories"`
+	// Self-service deals old enough that the provider should have reported telemetry for them, and how many it did
+	SelfServiceDeals        uint64  `json:"self_service_deals"`
+	TelemetryReported       uint64  `json:"telemetry_reported"`
+	TelemetryResponsiveness float64 `json:"telemetry_responsiveness"`
+}
+
 type ReplicationProfile struct {
-	ProviderActorID string `gorm:"primaryKey;uniqueIndex:idx_provider_dataset" json:"provider_actor_id"`
-	DatasetID       uint   `gorm:"primaryKey;uniqueIndex:idx_provider_dataset" json:"dataset_id"`
-	Unsealed        bool   `json:"unsealed"`
-	Indexed         bool   `json:"indexed"`
+	ProviderActorID  string         `gorm:"primaryKey;uniqueIndex:idx_provider_dataset" json:"provider_actor_id"`
+	DatasetID        uint           `gorm:"primaryKey;uniqueIndex:idx_provider_dataset" json:"dataset_id"`
+	Unsealed         bool           `json:"unsealed"`
+	Indexed          bool           `json:"indexed"`
+	Verified         *bool          `json:"verified,omitempty" gorm:"default:true"`                          // make verified (FIL+) deals. Nil is treated as verified
+	PricePerGiBEpoch string         `json:"price_per_gib_epoch,omitempty" gorm:"column:price_per_gib_epoch"` // price paid to the provider, in attoFIL per GiB per epoch. Empty for free deals
+	ConnectionMode   ConnectionMode `json:"connection_mode,omitempty"`                                       // overrides the dataset's connection mode, if set
+}
+
+// Whether deals made under the profile use datacap
+func (rp ReplicationProfile) IsVerified() bool {
+	return rp.Verified == nil || *rp.Verified
 }
 
 type ByteSizes struct {
@@ -90,6 +313,10 @@ type Dataset struct {
 	Name                string               `json:"name" gorm:"unique; not null"`
 	ReplicationQuota    uint64               `json:"replication_quota"`
 	DealDuration        uint64               `json:"deal_duration"`
+	Budget              string               `json:"budget,omitempty"`          // max total spend on deals, in attoFIL. Empty for no limit
+	Spent               string               `json:"spent,omitempty" gorm:"-"`  // total spent on deals, in attoFIL
+	ConnectionMode      ConnectionMode       `json:"connection_mode,omitempty"` // import (default) or e2e
+	DeltaNodeID         *uint                `json:"delta_node_id,omitempty"`   // if set, deals for the dataset are made through this Delta node, unless the provider is pinned to another
 	Wallets             []Wallet             `json:"wallets,omitempty" gorm:"many2many:wallet_datasets;"`
 	Contents            []Content            `json:"contents" gorm:"foreignKey:DatasetID;references:ID"`
 	BytesReplicated     ByteSizes            `json:"bytes_replicated,omitempty" gorm:"-"`
@@ -104,10 +331,11 @@ type Content struct {
 	PayloadCID      string        `json:"payload_cid" csv:"payloadCid"`
 	Size            uint64        `json:"size" csv:"size"`
 	PaddedSize      uint64        `json:"padded_size" csv:"paddedSize"`
-	DatasetID       uint          `json:"dataset_id"`
+	DatasetID       uint          `json:"dataset_id" gorm:"index:idx_contents_dataset"`
 	Replications    []Replication `json:"replications,omitempty" gorm:"foreignKey:ContentCommP"`
 	NumReplications uint64        `json:"num_replications"`
 	ContentLocation string        `json:"content_location"`
+	ImportedAt      time.Time     `json:"imported_at" csv:"-" gorm:"autoCreateTime"`
 }
 
 type WalletDatasets struct {
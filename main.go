@@ -33,6 +33,9 @@ func main() {
 	commands = append(commands, cmd.ProviderCmd()...)
 	commands = append(commands, cmd.DatasetCmd()...)
 	commands = append(commands, cmd.ContentCmd()...)
+	commands = append(commands, cmd.ReportCmd()...)
+	commands = append(commands, cmd.DbCmd()...)
+	commands = append(commands, cmd.DeltaNodeCmd()...)
 
 	app := &cli.App{
 		Commands: commands,